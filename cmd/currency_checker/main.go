@@ -29,6 +29,7 @@ package main
 import (
 	"context"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -38,28 +39,64 @@ import (
 	"github.com/gorilla/mux"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/credentials/insecure"
 
+	"github.com/awnzl/top_currency_checker/lib/admin"
+	"github.com/awnzl/top_currency_checker/lib/alerts"
+	"github.com/awnzl/top_currency_checker/lib/config/currencychecker"
 	"github.com/awnzl/top_currency_checker/lib/handlers"
 	"github.com/awnzl/top_currency_checker/lib/logger"
 	"github.com/awnzl/top_currency_checker/lib/middleware"
+	pcproto "github.com/awnzl/top_currency_checker/lib/proto/pricecollector"
+	rcproto "github.com/awnzl/top_currency_checker/lib/proto/rankcollector"
+	"github.com/awnzl/top_currency_checker/lib/tlsconfig"
 )
 
-const (
-	logLevel = "info"
-	port = "8080"
+var (
+	log  *zap.Logger
+	conf currencychecker.Config
 )
 
-var log *zap.Logger
+func newLogger() (*zap.Logger, zap.AtomicLevel) {
+	lvl, err := logger.NewAtomicLevel(conf.Log.Level)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 
-var (
-	pcAddr = os.Getenv("PC_ADDRESS")
-	rcAddr = os.Getenv("RC_ADDRESS")
-)
+	opts := []logger.Option{logger.WithLevel(lvl)}
+	if conf.Log.Sampling {
+		opts = append(opts, logger.WithSampling(conf.Log.SampleInitial, conf.Log.SampleThereafter))
+	} else {
+		opts = append(opts, logger.WithoutSampling())
+	}
+
+	return logger.NewZap(conf.Log.Level, opts...), lvl
+}
+
+// returns the credentials of the collector connection, TLS with the optional client certificate if enabled.
+// The certificate is verified for the configured server name or the host of the address.
+func collectorCredentials(addr string) credentials.TransportCredentials {
+	if !conf.CollectorsTLS.Enabled {
+		return insecure.NewCredentials()
+	}
+	serverName := conf.CollectorsTLS.ServerName
+	if serverName == "" {
+		serverName, _, _ = net.SplitHostPort(addr)
+	}
+	tlsConf, err := tlsconfig.Client(conf.CollectorsTLS.Files, serverName, log.Sugar().Infof)
+	if err != nil {
+		log.Fatal("can't load collectors TLS files", zap.Error(err))
+	}
+	log.Info("collectors TLS enabled", zap.String("address", addr), zap.String("server name", serverName),
+		zap.Bool("client certificate", conf.CollectorsTLS.Files.CertFile != ""))
+	return credentials.NewTLS(tlsConf)
+}
 
 // connects to the service or exits the program if the connection can't be established
-func getConnection(addr string) *grpc.ClientConn {
-	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+func getConnection(addr string, creds credentials.TransportCredentials) *grpc.ClientConn {
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(creds))
 	if err != nil {
 		log.Fatal("can't establish connection to service", zap.String("address", addr), zap.Error(err))
 	}
@@ -68,46 +105,114 @@ func getConnection(addr string) *grpc.ClientConn {
 }
 
 func main() {
-	log = logger.NewZap(logLevel)
+	var err error
+	if conf, err = currencychecker.Load(os.Args[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	var lvl zap.AtomicLevel
+	log, lvl = newLogger()
 	defer log.Sync()
+	log.Info("effective config", zap.Any("config", conf))
 
-	pcConn := getConnection(pcAddr)
+	pcConn := getConnection(conf.PriceCollectorAddr, collectorCredentials(conf.PriceCollectorAddr))
 	defer pcConn.Close()
 
-	rcConn := getConnection(rcAddr)
+	rcConn := getConnection(conf.RankCollectorAddr, collectorCredentials(conf.RankCollectorAddr))
 	defer rcConn.Close()
 
-	router := mux.NewRouter()
-	handlers.New(log, pcConn, rcConn).RegisterHandlers(
-		router,
+	mwFuncs := []mux.MiddlewareFunc{
+		middleware.RequestID,
 		middleware.NewMiddlewareLogger(log).Log,
 		middleware.SetContentTypeJSON,
-	)
+	}
+	if conf.APIKeysFile != "" {
+		keys, err := middleware.LoadAPIKeys(conf.APIKeysFile)
+		if err != nil {
+			log.Fatal("can't load api keys", zap.Error(err))
+		}
+		log.Info("api key authentication enabled", zap.Int("keys", len(keys)))
+		mwFuncs = append(mwFuncs, middleware.NewAuth(log, keys).Authenticate)
+	}
+
+	router := mux.NewRouter()
+	handlersConf := handlers.Config{
+		Budget:   conf.RequestBudget,
+		CacheTTL: conf.CacheTTL,
+		ScanSize: conf.ScanSize,
+	}
+	h := handlers.New(log, handlersConf, pcConn, rcConn)
+
+	alertsCtx, stopAlerts := context.WithCancel(context.Background())
+	defer stopAlerts()
+	if conf.Alerts.Enabled {
+		manager, err := alerts.New(log, conf.Alerts, pcproto.NewPriceServiceClient(pcConn), rcproto.NewRankServiceClient(rcConn))
+		if err != nil {
+			log.Fatal("can't load alerts", zap.Error(err))
+		}
+		h.SetAlerts(manager)
+		go manager.Run(alertsCtx)
+		log.Info("alerts enabled", zap.Duration("interval", conf.Alerts.Interval), zap.String("store file", conf.Alerts.StoreFile))
+	}
+	h.RegisterHandlers(router, mwFuncs...)
 
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
 
 	srv := &http.Server{
-		Addr:    fmt.Sprintf(":%v", port),
+		Addr:    fmt.Sprintf(":%v", conf.Port),
 		Handler: router,
 	}
 
+	if conf.TLS.CertFile != "" {
+		if srv.TLSConfig, err = tlsconfig.Server(conf.TLS, log.Sugar().Infof); err != nil {
+			log.Fatal("can't load TLS files", zap.Error(err))
+		}
+	}
+
 	go func() {
-		log.Info("start listening", zap.String("port", port))
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Info("start listening", zap.String("port", conf.Port), zap.Bool("tls", srv.TLSConfig != nil))
+		listen := srv.ListenAndServe
+		if srv.TLSConfig != nil {
+			// the certificate is taken from TLSConfig and reloaded when the files change
+			listen = func() error { return srv.ListenAndServeTLS("", "") }
+		}
+		if err := listen(); err != nil && err != http.ErrServerClosed {
 			log.Error("server error", zap.Error(err))
 			os.Exit(1)
 		}
 	}()
 
+	// admin endpoints are served on a separate port, which is not exposed to the clients
+	adminRouter := admin.NewRouter()
+	// GET returns the current level, PUT {"level":"debug"} changes it
+	adminRouter.Handle("/log/level", lvl).Methods(http.MethodGet, http.MethodPut)
+
+	adminSrv := &http.Server{
+		Addr:    fmt.Sprintf(":%v", conf.AdminPort),
+		Handler: adminRouter,
+	}
+
+	go func() {
+		log.Info("start admin listening", zap.String("port", conf.AdminPort))
+		if err := adminSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Error("admin server error", zap.Error(err))
+		}
+	}()
+
 	<-sigChan
 	log.Info("Received an interrupt signal...")
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
+	stopAlerts()
 	if err := srv.Shutdown(ctx); err != nil {
 		log.Error("failure during server shutdown: %w", zap.Error(err))
 	}
+	if err := adminSrv.Shutdown(ctx); err != nil {
+		log.Error("failure during admin server shutdown", zap.Error(err))
+	}
 	log.Info("Server stopped...")
 }
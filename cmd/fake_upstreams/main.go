@@ -0,0 +1,62 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/gorilla/mux"
+
+	"github.com/awnzl/top_currency_checker/lib/config"
+	"github.com/awnzl/top_currency_checker/lib/config/fakeupstreams"
+	"github.com/awnzl/top_currency_checker/lib/fakeupstream"
+)
+
+// applies the fault changes of the config file without restarting the server
+func watchConfig(l *config.Loader, conf fakeupstreams.Config, srv *fakeupstream.Server) {
+	watched := config.Watch(l, fakeupstreams.Read,
+		func(newConf fakeupstreams.Config) []config.Change {
+			changes := config.Diff(conf.Faults, newConf.Faults)
+			if len(changes) == 0 {
+				return nil
+			}
+			srv.SetFaults(newConf.Faults)
+			for _, change := range changes {
+				log.Printf("Config change applied: Faults.%v\n", change)
+			}
+			conf.Faults = newConf.Faults
+			return changes
+		},
+		func(err error) {
+			log.Printf("Config change rejected, keeping the current config: %v\n", err)
+		},
+	)
+	if watched {
+		log.Printf("Watching config file %s\n", l.ConfigFile())
+	}
+}
+
+func main() {
+	l := fakeupstreams.NewLoader()
+	if err := l.Load(os.Args[1:]); err != nil {
+		log.Fatalf("Failed to load config: %v\n", err)
+	}
+	conf, err := fakeupstreams.Read(l)
+	if err != nil {
+		log.Fatalf("Failed to load config: %v\n", err)
+	}
+	log.Printf("Effective config: %+v\n", conf)
+
+	market := fakeupstream.NewMarket(uint64(conf.Seed), conf.Coins, conf.Tick)
+	srv := fakeupstream.New(market, conf.Faults)
+	watchConfig(l, conf, srv)
+
+	router := mux.NewRouter()
+	srv.Register(router)
+
+	log.Printf("Listening on %s, CoinMarketCap at %s, CryptoCompare at %s\n",
+		conf.ListenAddress, fakeupstream.ListingsPath, fakeupstream.PricesPath)
+	if err := http.ListenAndServe(conf.ListenAddress, router); err != nil {
+		log.Fatalf("Failed to serve: %v\n", err)
+	}
+}
@@ -1,59 +1,112 @@
 package main
 
 import (
-	"fmt"
+	"context"
 	"log"
 	"net"
+	"net/http"
 	"os"
-	"strconv"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/reflection"
 
-	"github.com/awnzl/top_currency_checker/lib/proto/pricecollector"
-	"github.com/awnzl/top_currency_checker/lib/requester/config"
+	"github.com/awnzl/top_currency_checker/lib/admin"
+	"github.com/awnzl/top_currency_checker/lib/config/collector"
+	"github.com/awnzl/top_currency_checker/lib/config/pricecollector"
+	pcproto "github.com/awnzl/top_currency_checker/lib/proto/pricecollector"
+	"github.com/awnzl/top_currency_checker/lib/rpcjson"
+	"github.com/awnzl/top_currency_checker/lib/secrets"
 	service "github.com/awnzl/top_currency_checker/lib/services/pricecollector"
+	"github.com/awnzl/top_currency_checker/lib/tlsconfig"
 )
 
-var (
-	apiKey      string
-	apiURL      string
-	fsymsLilmit int
-
-	addr = "0.0.0.0:50050"
-)
-
-func prepareEnvironment() (err error) {
-	apiKey = os.Getenv("api_key")
-	apiURL = os.Getenv("api_endpoint")
-	fsymsLilmit, err = strconv.Atoi(os.Getenv("fsymsLimit"))
-	if err != nil {
-		return fmt.Errorf("parse fsymsLimit: %v", err)
+func serviceConfig(conf pricecollector.Config) service.Config {
+	return service.Config{
+		APIKeys:       conf.APIKeySources(),
+		KeyBudget:     conf.KeyBudget,
+		Budget:        conf.CreditBudget(),
+		APIURL:        conf.APIURL,
+		FSYMSLimit:    conf.FSYMSLimit,
+		FSYMSMinLimit: conf.FSYMSMinLimit,
+		FSYMSMaxLen:   conf.FSYMSMaxLen,
+		Concurrency:   conf.Concurrency,
+		ReqConfig:     conf.Request,
+		MaxStaleness:  conf.MaxStaleness,
 	}
-	return nil
 }
 
 func main() {
-	err := prepareEnvironment()
+	log.SetOutput(secrets.RedactWriter(os.Stderr))
+	l := pricecollector.NewLoader()
+	if err := l.Load(os.Args[1:]); err != nil {
+		log.Fatalf("Failed to load config: %v\n", err)
+	}
+	conf, err := pricecollector.Read(l)
 	if err != nil {
-		log.Fatalf("Failed to prepare environment: %v\n", err)
+		log.Fatalf("Failed to load config: %v\n", err)
+	}
+	log.Printf("Effective config: %+v\n", conf)
+	// fails fast on a missing key, later the last good one is kept while the file is being rotated
+	for _, src := range conf.APIKeySources() {
+		if _, err := src.Value(); err != nil {
+			log.Fatalf("Failed to read the API key: %v\n", err)
+		}
 	}
 
-	listener, err := net.Listen("tcp", addr)
+	listener, err := net.Listen("tcp", conf.ListenAddress)
 	if err != nil {
 		log.Fatalf("Failed to listen on: %v\n", err)
 	}
 
-	config.InitConfig("./req_config.yaml")
-	srv := grpc.NewServer()
-	srs := service.New(service.Config{
-		APIKey:     apiKey,
-		APIURL:     apiURL,
-		FSYMSLimit: fsymsLilmit,
-		ReqConfig:  config.GetConfig(),
-	})
-	pricecollector.RegisterPriceServiceServer(srv, srs)
+	var opts []grpc.ServerOption
+	if conf.TLS.CertFile != "" {
+		tlsConf, err := tlsconfig.Server(conf.TLS, log.Printf)
+		if err != nil {
+			log.Fatalf("Failed to load TLS files: %v\n", err)
+		}
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConf)))
+		log.Printf("TLS enabled, client certificates required: %v\n", conf.TLS.CAFile != "")
+	}
+
+	srv := grpc.NewServer(opts...)
+	srs := service.New(serviceConfig(conf))
+	srs.PublishBatchSize()
+	pcproto.RegisterPriceServiceServer(srv, srs)
+	if conf.Reflection {
+		// lets grpcurl list and call the RPCs without the .proto files
+		reflection.Register(srv)
+	}
+
+	// applies the changes of the config file without restarting the server
+	if collector.Watch(l, conf, pricecollector.Read, func(c pricecollector.Config) { srs.ApplyConfig(serviceConfig(c)) }, log.Printf) {
+		log.Printf("Watching config file %s\n", l.ConfigFile())
+	}
+	if conf.Budget.PollInterval > 0 {
+		log.Printf("Polling the upstream, the fastest interval is %v\n", conf.Budget.PollInterval)
+		go srs.Poll(context.Background())
+	}
+
+	if conf.AdminAddress != "" {
+		adminRouter := admin.NewRouter()
+		admin.RegisterUpstream(adminRouter, srs, conf.Request.FaultsEnabled)
+		if conf.Request.FaultsEnabled {
+			log.Println("Fault injection enabled, the upstream requests may fail on purpose")
+		}
+		if conf.AdminRPCJSON {
+			if err := rpcjson.Register(adminRouter, &pcproto.PriceService_ServiceDesc, srs); err != nil {
+				log.Fatalf("Failed to register the HTTP/JSON RPCs: %v\n", err)
+			}
+		}
+		go func() {
+			log.Printf("Admin listening on %s\n", conf.AdminAddress)
+			if err := http.ListenAndServe(conf.AdminAddress, adminRouter); err != nil {
+				log.Printf("Admin server error: %v\n", err)
+			}
+		}()
+	}
 
-	log.Printf("Listening on %s\n", addr)
+	log.Printf("Listening on %s\n", conf.ListenAddress)
 	if err := srv.Serve(listener); err != nil {
 		log.Fatalf("Failed to serve: %v\n", err)
 	}
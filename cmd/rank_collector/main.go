@@ -1,46 +1,108 @@
 package main
 
 import (
+	"context"
 	"log"
 	"net"
+	"net/http"
 	"os"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/reflection"
 
-	"github.com/awnzl/top_currency_checker/lib/proto/rankcollector"
-	"github.com/awnzl/top_currency_checker/lib/requester/config"
+	"github.com/awnzl/top_currency_checker/lib/admin"
+	"github.com/awnzl/top_currency_checker/lib/config/collector"
+	"github.com/awnzl/top_currency_checker/lib/config/rankcollector"
+	rcproto "github.com/awnzl/top_currency_checker/lib/proto/rankcollector"
+	"github.com/awnzl/top_currency_checker/lib/rpcjson"
+	"github.com/awnzl/top_currency_checker/lib/secrets"
 	service "github.com/awnzl/top_currency_checker/lib/services/rankcollector"
+	"github.com/awnzl/top_currency_checker/lib/tlsconfig"
 )
 
-var (
-	apiKey string
-	apiURL string
-	addr = "0.0.0.0:50051"
-)
-
-func prepareEnvironment() {
-	apiKey = os.Getenv("api_key")
-	apiURL = os.Getenv("api_endpoint")
+func serviceConfig(conf rankcollector.Config) service.Config {
+	return service.Config{
+		APIKeys:      conf.APIKeySources(),
+		KeyBudget:    conf.KeyBudget,
+		Budget:       conf.CreditBudget(),
+		APIURL:       conf.APIURL,
+		ReqConfig:    conf.Request,
+		MaxStaleness: conf.MaxStaleness,
+		ListingSize:  conf.ListingSize,
+	}
 }
 
 func main() {
-	prepareEnvironment()
+	log.SetOutput(secrets.RedactWriter(os.Stderr))
+	l := rankcollector.NewLoader()
+	if err := l.Load(os.Args[1:]); err != nil {
+		log.Fatalf("Failed to load config: %v\n", err)
+	}
+	conf, err := rankcollector.Read(l)
+	if err != nil {
+		log.Fatalf("Failed to load config: %v\n", err)
+	}
+	log.Printf("Effective config: %+v\n", conf)
+	// fails fast on a missing key, later the last good one is kept while the file is being rotated
+	for _, src := range conf.APIKeySources() {
+		if _, err := src.Value(); err != nil {
+			log.Fatalf("Failed to read the API key: %v\n", err)
+		}
+	}
 
-	listener, err := net.Listen("tcp", addr)
+	listener, err := net.Listen("tcp", conf.ListenAddress)
 	if err != nil {
 		log.Fatalf("Failed to listen on: %v\n", err)
 	}
 
-	config.InitConfig("./req_config.yaml")
-	srv := grpc.NewServer()
-	srs := service.New(service.Config{
-		APIKey:    apiKey,
-		APIURL:    apiURL,
-		ReqConfig: config.GetConfig(),
-	})
-	rankcollector.RegisterRankServiceServer(srv, srs)
+	var opts []grpc.ServerOption
+	if conf.TLS.CertFile != "" {
+		tlsConf, err := tlsconfig.Server(conf.TLS, log.Printf)
+		if err != nil {
+			log.Fatalf("Failed to load TLS files: %v\n", err)
+		}
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConf)))
+		log.Printf("TLS enabled, client certificates required: %v\n", conf.TLS.CAFile != "")
+	}
+
+	srv := grpc.NewServer(opts...)
+	srs := service.New(serviceConfig(conf))
+	rcproto.RegisterRankServiceServer(srv, srs)
+	if conf.Reflection {
+		// lets grpcurl list and call the RPCs without the .proto files
+		reflection.Register(srv)
+	}
+
+	// applies the changes of the config file without restarting the server
+	if collector.Watch(l, conf, rankcollector.Read, func(c rankcollector.Config) { srs.ApplyConfig(serviceConfig(c)) }, log.Printf) {
+		log.Printf("Watching config file %s\n", l.ConfigFile())
+	}
+	if conf.Budget.PollInterval > 0 {
+		log.Printf("Polling the upstream, the fastest interval is %v\n", conf.Budget.PollInterval)
+		go srs.Poll(context.Background())
+	}
+
+	if conf.AdminAddress != "" {
+		adminRouter := admin.NewRouter()
+		admin.RegisterUpstream(adminRouter, srs, conf.Request.FaultsEnabled)
+		if conf.Request.FaultsEnabled {
+			log.Println("Fault injection enabled, the upstream requests may fail on purpose")
+		}
+		if conf.AdminRPCJSON {
+			if err := rpcjson.Register(adminRouter, &rcproto.RankService_ServiceDesc, srs); err != nil {
+				log.Fatalf("Failed to register the HTTP/JSON RPCs: %v\n", err)
+			}
+		}
+		go func() {
+			log.Printf("Admin listening on %s\n", conf.AdminAddress)
+			if err := http.ListenAndServe(conf.AdminAddress, adminRouter); err != nil {
+				log.Printf("Admin server error: %v\n", err)
+			}
+		}()
+	}
 
-	log.Printf("Listening on %s\n", addr)
+	log.Printf("Listening on %s\n", conf.ListenAddress)
 	if err := srv.Serve(listener); err != nil {
 		log.Fatalf("Failed to serve: %v\n", err)
 	}
@@ -35,6 +35,7 @@ fi
 build_service "currency_checker" $SCRIPT_DIR/"currency_checker/dockerfile"
 build_service "price_collector" $SCRIPT_DIR/"price_collector/dockerfile"
 build_service "rank_collector" $SCRIPT_DIR/"rank_collector/dockerfile"
+build_service "fake_upstreams" $SCRIPT_DIR/"fake_upstreams/dockerfile"
 
 docker image rm $builder
 
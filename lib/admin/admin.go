@@ -0,0 +1,39 @@
+// Package admin contains the endpoints served on the internal admin ports of the services
+package admin
+
+import (
+	"expvar"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"github.com/awnzl/top_currency_checker/lib/budget"
+	"github.com/awnzl/top_currency_checker/lib/requester"
+	"github.com/awnzl/top_currency_checker/lib/requester/chaos"
+)
+
+// NewRouter returns the admin router with the expvar metrics registered at /debug/vars
+func NewRouter() *mux.Router {
+	router := mux.NewRouter()
+	router.Handle("/debug/vars", expvar.Handler()).Methods(http.MethodGet)
+	return router
+}
+
+// Upstream is a collector calling a provider API
+type Upstream interface {
+	Keys() *requester.KeyPool
+	Budget() *budget.Planner
+	Faults() *chaos.Transport
+}
+
+// RegisterUpstream adds the endpoints of the collector's provider: /upstream/keys serves the usage of
+// the API keys, /upstream/budget the credit usage and the planned polling. With faults enabled,
+// GET /upstream/faults returns the injected faults and PUT {"rules":["latency=2s@10"]} replaces them.
+// The collectors serve them as they are, the errors are the handlers' own.
+func RegisterUpstream(router *mux.Router, u Upstream, faults bool) {
+	router.Handle("/upstream/keys", u.Keys()).Methods(http.MethodGet)
+	router.Handle("/upstream/budget", u.Budget()).Methods(http.MethodGet)
+	if faults {
+		router.Handle("/upstream/faults", u.Faults()).Methods(http.MethodGet, http.MethodPut)
+	}
+}
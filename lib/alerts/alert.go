@@ -0,0 +1,148 @@
+// Package alerts evaluates the price and rank alerts of the clients on every refresh of the collected data
+// and delivers the triggered ones to their webhooks as signed JSON, with retries and a delivery log.
+package alerts
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/awnzl/top_currency_checker/lib/apierror"
+)
+
+const (
+	// KindAbove fires when the price rises above Threshold
+	KindAbove = "above"
+	// KindBelow fires when the price falls below Threshold
+	KindBelow = "below"
+	// KindChange fires when the price moves more than Percent either way within Window
+	KindChange = "change"
+	// KindEntersTop fires when the currency enters the top Rank
+	KindEntersTop = "enters_top"
+
+	// MaxRank is the deepest rank of the enters_top alerts
+	MaxRank = 1000
+	// MaxWindow is the longest window of the change alerts
+	MaxWindow = 24 * time.Hour
+
+	minSecretLen = 16
+)
+
+var symbolRe = regexp.MustCompile(`^[A-Z0-9]{1,20}$`)
+
+// Alert is a condition of a client on the price or the rank of a currency
+type Alert struct {
+	ID string `json:"id"`
+	// Owner is the name of the client's API key, empty when the authentication is disabled
+	Owner     string   `json:"owner,omitempty"`
+	Symbol    string   `json:"symbol"`
+	Kind      string   `json:"kind"`
+	Threshold float64  `json:"threshold,omitempty"`
+	Percent   float64  `json:"percent,omitempty"`
+	Window    Duration `json:"window,omitempty"`
+	Rank      int      `json:"rank,omitempty"`
+	// URL receives the webhooks
+	URL string `json:"url"`
+	// Secret signs the webhooks, it is generated unless set and returned on creation only
+	Secret          string     `json:"secret,omitempty"`
+	CreatedAt       time.Time  `json:"created_at"`
+	LastTriggeredAt *time.Time `json:"last_triggered_at"`
+}
+
+// Public returns the alert without its owner and secret
+func (a Alert) Public() Alert {
+	a.Owner, a.Secret = "", ""
+	return a
+}
+
+// usesPrice reports whether the alert is evaluated on the prices, the others are on the ranks
+func (a Alert) usesPrice() bool {
+	return a.Kind != KindEntersTop
+}
+
+// Duration is the time.Duration written as "1h30m" in JSON
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	if d == 0 {
+		return []byte(`""`), nil
+	}
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("a duration such as \"1h\" is expected")
+	}
+	if s == "" {
+		*d = 0
+		return nil
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("a duration such as \"1h\" is expected")
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// normalize upper-cases the symbol and clears the fields of the other kinds
+func (a *Alert) normalize() {
+	a.Symbol = strings.ToUpper(strings.TrimSpace(a.Symbol))
+	switch a.Kind {
+	case KindAbove, KindBelow:
+		a.Percent, a.Window, a.Rank = 0, 0, 0
+	case KindChange:
+		a.Threshold, a.Rank = 0, 0
+	case KindEntersTop:
+		a.Threshold, a.Percent, a.Window = 0, 0, 0
+	}
+}
+
+// validate checks the condition and the webhook of the alert
+func (a Alert) validate() error {
+	if !symbolRe.MatchString(a.Symbol) {
+		return apierror.New(apierror.InvalidAlert, "invalid symbol value: %q", a.Symbol)
+	}
+	switch a.Kind {
+	case KindAbove, KindBelow:
+		if a.Threshold <= 0 {
+			return apierror.New(apierror.InvalidAlert, "%s requires a positive threshold", a.Kind)
+		}
+	case KindChange:
+		if a.Percent <= 0 {
+			return apierror.New(apierror.InvalidAlert, "change requires a positive percent")
+		}
+		if w := time.Duration(a.Window); w < time.Minute || w > MaxWindow {
+			return apierror.New(apierror.InvalidAlert, "change requires a window from 1m to %v", MaxWindow)
+		}
+	case KindEntersTop:
+		if a.Rank < 1 || a.Rank > MaxRank {
+			return apierror.New(apierror.InvalidAlert, "enters_top requires a rank from 1 to %d", MaxRank)
+		}
+	default:
+		return apierror.New(apierror.InvalidAlert, "invalid kind value: %q, must be above, below, change or enters_top", a.Kind)
+	}
+
+	u, err := url.Parse(a.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return apierror.New(apierror.InvalidAlert, "url must be an absolute http(s) URL")
+	}
+	if a.Secret != "" && len(a.Secret) < minSecretLen {
+		return apierror.New(apierror.InvalidAlert, "secret must be at least %d characters long", minSecretLen)
+	}
+	return nil
+}
+
+// randomID returns a random hex string of n bytes
+func randomID(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,397 @@
+package alerts
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+
+	"github.com/awnzl/top_currency_checker/lib/apierror"
+	pc "github.com/awnzl/top_currency_checker/lib/proto/pricecollector"
+	rc "github.com/awnzl/top_currency_checker/lib/proto/rankcollector"
+)
+
+// WebhookConfig is the delivery of the webhooks
+type WebhookConfig struct {
+	// Timeout is the time of one attempt
+	Timeout time.Duration
+	// MaxAttempts is the number of the attempts of a delivery, the network errors, 429 and 5xx are retried
+	MaxAttempts int
+	// Backoff is the wait before the first retry, it doubles with every retry up to a minute
+	Backoff time.Duration
+	// AllowPrivate allows the webhooks to the loopback and the private addresses
+	AllowPrivate bool
+}
+
+type Config struct {
+	// Enabled serves the alerts API and evaluates the alerts
+	Enabled bool
+	// Interval is the polling of the collectors for the prices and the ranks of the alerts
+	Interval time.Duration
+	// StoreFile keeps the alerts across the restarts, empty keeps them in memory
+	StoreFile string
+	// MaxPerClient is the max number of the alerts of one client, 0 is unlimited
+	MaxPerClient int
+	Webhook      WebhookConfig
+}
+
+// sample is a price received at the time of its data
+type sample struct {
+	at    time.Time
+	price float64
+}
+
+// Manager keeps the alerts, evaluates them on the refreshed data and delivers the webhooks.
+// An alert fires when its condition becomes true: the first evaluation after it is created or
+// changed sets the baseline, and it fires again only after the condition was false in between.
+type Manager struct {
+	logger   *zap.Logger
+	config   Config
+	pcClient pc.PriceServiceClient
+	rcClient rc.RankServiceClient
+	store    *store
+	client   *http.Client
+	now      func() time.Time
+	// the deliveries in flight
+	wg sync.WaitGroup
+
+	mu sync.Mutex
+	// met is whether the condition of the alert held at its last evaluation
+	met map[string]bool
+	// history is the prices of the symbols within MaxWindow
+	history    map[string][]sample
+	rankAsOf   int64
+	deliveries map[string][]*Delivery
+}
+
+// New returns the manager of the alerts of the store file
+func New(log *zap.Logger, conf Config, pcClient pc.PriceServiceClient, rcClient rc.RankServiceClient) (*Manager, error) {
+	s, err := openStore(conf.StoreFile)
+	if err != nil {
+		return nil, err
+	}
+	return &Manager{
+		logger:     log,
+		config:     conf,
+		pcClient:   pcClient,
+		rcClient:   rcClient,
+		store:      s,
+		client:     newWebhookClient(conf.Webhook),
+		now:        time.Now,
+		met:        map[string]bool{},
+		history:    map[string][]sample{},
+		deliveries: map[string][]*Delivery{},
+	}, nil
+}
+
+var errNotFound = apierror.Status(codes.NotFound, apierror.NotFound, "alert not found")
+
+// Create adds the alert of the client, its secret is generated unless set
+func (m *Manager) Create(owner string, a Alert) (Alert, error) {
+	a.normalize()
+	if err := a.validate(); err != nil {
+		return Alert{}, err
+	}
+	a.ID, a.Owner, a.CreatedAt, a.LastTriggeredAt = randomID(8), owner, m.now().UTC(), nil
+	if a.Secret == "" {
+		a.Secret = randomID(32)
+	}
+	if err := m.store.put(a, m.config.MaxPerClient); err != nil {
+		if errors.Is(err, errTooMany) {
+			return Alert{}, apierror.New(apierror.InvalidAlert, "at most %d alerts per client", m.config.MaxPerClient)
+		}
+		return Alert{}, err
+	}
+	m.logger.Info("alert created", zap.String("alert", a.ID), zap.String("client", owner), zap.String("symbol", a.Symbol), zap.String("kind", a.Kind))
+	return a, nil
+}
+
+// List returns the alerts of the client in the order of creation
+func (m *Manager) List(owner string) []Alert {
+	var list []Alert
+	for _, a := range m.store.all() {
+		if a.Owner == owner {
+			list = append(list, a)
+		}
+	}
+	return list
+}
+
+// Get returns the alert of the client
+func (m *Manager) Get(owner, id string) (Alert, error) {
+	a, ok := m.store.get(id)
+	if !ok || a.Owner != owner {
+		return Alert{}, errNotFound
+	}
+	return a, nil
+}
+
+// Update replaces the condition and the webhook of the client's alert, the secret is kept unless set.
+// The condition is evaluated from a new baseline.
+func (m *Manager) Update(owner, id string, a Alert) (Alert, error) {
+	a.normalize()
+	// the alert is read and written under the store lock, the triggers and the deletes in between aren't lost
+	updated, err := m.store.replace(id, func(current Alert) (Alert, error) {
+		if current.Owner != owner {
+			return Alert{}, errNotFound
+		}
+		a.ID, a.Owner, a.CreatedAt, a.LastTriggeredAt = current.ID, current.Owner, current.CreatedAt, current.LastTriggeredAt
+		if a.Secret == "" {
+			a.Secret = current.Secret
+		}
+		if err := a.validate(); err != nil {
+			return Alert{}, err
+		}
+		return a, nil
+	})
+	if err != nil {
+		return Alert{}, err
+	}
+
+	m.mu.Lock()
+	delete(m.met, id)
+	m.mu.Unlock()
+	m.logger.Info("alert updated", zap.String("alert", id), zap.String("client", owner))
+	return updated, nil
+}
+
+// Delete removes the client's alert and its deliveries
+func (m *Manager) Delete(owner, id string) error {
+	if _, err := m.Get(owner, id); err != nil {
+		return err
+	}
+	if err := m.store.delete(id); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	delete(m.met, id)
+	delete(m.deliveries, id)
+	m.mu.Unlock()
+	m.logger.Info("alert deleted", zap.String("alert", id), zap.String("client", owner))
+	return nil
+}
+
+// Deliveries returns the last deliveries of the client's alert, the newest first
+func (m *Manager) Deliveries(owner, id string) ([]Delivery, error) {
+	if _, err := m.Get(owner, id); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	log := m.deliveries[id]
+	list := make([]Delivery, 0, len(log))
+	for _, d := range slices.Backward(log) {
+		c := *d
+		c.Attempts = slices.Clone(d.Attempts)
+		list = append(list, c)
+	}
+	return list, nil
+}
+
+// Run evaluates the alerts at the configured interval until the context is done,
+// the webhooks in flight are canceled with it
+func (m *Manager) Run(ctx context.Context) {
+	ticker := time.NewTicker(m.config.Interval)
+	defer ticker.Stop()
+	for {
+		m.Evaluate(ctx)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Wait waits for the webhooks in flight
+func (m *Manager) Wait() {
+	m.wg.Wait()
+}
+
+// Evaluate requests the prices and the ranks of the alerts and fires the ones whose conditions became
+// true on the refreshed data. The stale data and the data seen before are not evaluated.
+func (m *Manager) Evaluate(ctx context.Context) {
+	alerts := m.store.all()
+	if len(alerts) == 0 {
+		return
+	}
+	// the collector calls end before the next evaluation, the webhooks live with ctx
+	callCtx, cancel := context.WithTimeout(ctx, m.config.Interval)
+	defer cancel()
+
+	var symbols []string
+	maxRank := 0
+	for _, a := range alerts {
+		switch {
+		case !a.usesPrice():
+			maxRank = max(maxRank, a.Rank)
+		case !slices.Contains(symbols, a.Symbol):
+			symbols = append(symbols, a.Symbol)
+		}
+	}
+
+	var prices map[string]sample
+	if len(symbols) > 0 {
+		resp, err := m.pcClient.GetPrices(callCtx, &pc.PriceRequest{List: symbols})
+		if err != nil {
+			m.logger.Warn("alert prices request failed", zap.Error(err))
+		} else {
+			prices = m.addSamples(resp)
+		}
+	}
+	var ranks map[string]int
+	var ranksAsOf time.Time
+	if maxRank > 0 {
+		resp, err := m.rcClient.GetRanks(callCtx, &rc.RankRequest{Start: 1, Limit: int32(maxRank)})
+		if err != nil {
+			m.logger.Warn("alert ranks request failed", zap.Error(err))
+		} else if ranks = m.newRanks(resp); ranks != nil {
+			ranksAsOf = time.UnixMilli(resp.AsOf)
+		}
+	}
+
+	now := m.now()
+	for _, a := range alerts {
+		ev := Event{Alert: a.Public(), Symbol: a.Symbol, TriggeredAt: now.UTC()}
+		var met bool
+		if a.usesPrice() {
+			s, ok := prices[a.Symbol]
+			if !ok {
+				continue
+			}
+			ev.Price, ev.AsOf = &s.price, s.at.UTC()
+			switch a.Kind {
+			case KindAbove:
+				met = s.price > a.Threshold
+			case KindBelow:
+				met = s.price < a.Threshold
+			case KindChange:
+				if change, ok := m.change(a.Symbol, time.Duration(a.Window)); ok {
+					ev.ChangePercent = &change
+					met = math.Abs(change) > a.Percent
+				}
+			}
+		} else {
+			if ranks == nil {
+				continue
+			}
+			rank, ok := ranks[a.Symbol]
+			ev.Rank, ev.AsOf = rank, ranksAsOf.UTC()
+			met = ok && rank <= a.Rank
+		}
+		if m.transition(a.ID, met) {
+			m.trigger(ctx, a, ev)
+		}
+	}
+}
+
+// addSamples adds the fresh prices of the response to the history and returns them,
+// the stale ones and the ones seen before are skipped
+func (m *Manager) addSamples(resp *pc.PriceResponse) map[string]sample {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	at := time.UnixMilli(resp.AsOf)
+	fresh := make(map[string]sample, len(resp.Prices))
+	for symbol, price := range resp.Prices {
+		if _, stale := resp.StaleAsOf[symbol]; stale {
+			continue
+		}
+		h := m.history[symbol]
+		if len(h) > 0 && !at.After(h[len(h)-1].at) {
+			continue
+		}
+		s := sample{at: at, price: price}
+		h = append(h, s)
+		// the longest window is kept
+		i := 0
+		for i < len(h) && h[i].at.Before(at.Add(-MaxWindow)) {
+			i++
+		}
+		m.history[symbol] = h[i:]
+		fresh[symbol] = s
+	}
+	return fresh
+}
+
+// newRanks returns the ranks of the response by symbol, or nil if they are stale or seen before
+func (m *Manager) newRanks(resp *rc.RankResponse) map[string]int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if resp.Stale || resp.AsOf == m.rankAsOf {
+		return nil
+	}
+	m.rankAsOf = resp.AsOf
+	ranks := make(map[string]int, len(resp.List))
+	for i, symbol := range resp.List {
+		rank := i + 1
+		if i < len(resp.Coins) {
+			rank = int(resp.Coins[i].Rank)
+		}
+		ranks[symbol] = rank
+	}
+	return ranks
+}
+
+// change returns the largest move in percent of the last price from the prices within the window,
+// false if there is nothing to compare with
+func (m *Manager) change(symbol string, window time.Duration) (float64, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h := m.history[symbol]
+	if len(h) < 2 {
+		return 0, false
+	}
+	last := h[len(h)-1]
+	change := 0.0
+	for _, s := range h[:len(h)-1] {
+		if s.at.Before(last.at.Add(-window)) || s.price == 0 {
+			continue
+		}
+		if c := (last.price - s.price) / s.price * 100; math.Abs(c) > math.Abs(change) {
+			change = c
+		}
+	}
+	return change, true
+}
+
+// transition records whether the alert's condition holds and reports whether it just became true
+func (m *Manager) transition(id string, met bool) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	prev, seen := m.met[id]
+	m.met[id] = met
+	return seen && met && !prev
+}
+
+// trigger logs the delivery of the event and sends the webhook in the background
+func (m *Manager) trigger(ctx context.Context, a Alert, ev Event) {
+	ev.ID = randomID(8)
+	body, err := json.Marshal(ev)
+	if err != nil {
+		m.logger.Error("marshal alert event", zap.String("alert", a.ID), zap.Error(err))
+		return
+	}
+	d := &Delivery{ID: ev.ID, AlertID: a.ID, TriggeredAt: ev.TriggeredAt, Status: DeliveryPending}
+	m.addDelivery(d)
+	deliveryStats.Add("triggered", 1)
+	m.logger.Info("alert triggered", zap.String("alert", a.ID), zap.String("symbol", a.Symbol), zap.String("kind", a.Kind), zap.String("delivery", d.ID))
+
+	triggered := ev.TriggeredAt
+	if err := m.store.update(a.ID, func(a *Alert) { a.LastTriggeredAt = &triggered }); err != nil {
+		m.logger.Error("save alert", zap.String("alert", a.ID), zap.Error(err))
+	}
+
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		m.deliver(ctx, a, d, body)
+	}()
+}
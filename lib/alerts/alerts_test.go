@@ -0,0 +1,409 @@
+package alerts
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/awnzl/top_currency_checker/lib/apierror"
+	pc "github.com/awnzl/top_currency_checker/lib/proto/pricecollector"
+	rc "github.com/awnzl/top_currency_checker/lib/proto/rankcollector"
+)
+
+var t0 = time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+
+// market is the collectors' data, set by the tests between the evaluations
+type market struct {
+	mu     sync.Mutex
+	prices map[string]float64
+	ranks  []string
+	asOf   time.Time
+}
+
+func (m *market) set(at time.Time, prices map[string]float64, ranks ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.asOf, m.prices, m.ranks = at, prices, ranks
+}
+
+// priceClient and rankClient serve the market as the collectors
+type priceClient struct{ *market }
+
+func (c priceClient) GetPrices(_ context.Context, req *pc.PriceRequest, _ ...grpc.CallOption) (*pc.PriceResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	prices := map[string]float64{}
+	for _, s := range req.List {
+		if p, ok := c.prices[s]; ok {
+			prices[s] = p
+		}
+	}
+	return &pc.PriceResponse{Prices: prices, AsOf: c.asOf.UnixMilli()}, nil
+}
+
+func (c priceClient) GetCoin(context.Context, *pc.CoinPriceRequest, ...grpc.CallOption) (*pc.CoinPriceResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "not used by the alerts")
+}
+
+type rankClient struct{ *market }
+
+func (c rankClient) GetRanks(_ context.Context, req *rc.RankRequest, _ ...grpc.CallOption) (*rc.RankResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return &rc.RankResponse{List: c.ranks[:min(int(req.Limit), len(c.ranks))], AsOf: c.asOf.UnixMilli()}, nil
+}
+
+func (c rankClient) GetCoin(context.Context, *rc.CoinRequest, ...grpc.CallOption) (*rc.CoinResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "not used by the alerts")
+}
+
+// receiver is the webhook endpoint answering with the queued statuses, then 200
+type receiver struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	statuses []int
+	events   []Event
+	headers  []http.Header
+	bodies   [][]byte
+}
+
+func newReceiver(t *testing.T, statuses ...int) *receiver {
+	r := &receiver{statuses: statuses}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		var ev Event
+		json.Unmarshal(body, &ev)
+		r.events = append(r.events, ev)
+		r.headers = append(r.headers, req.Header.Clone())
+		r.bodies = append(r.bodies, body)
+		status := http.StatusOK
+		if len(r.statuses) > 0 {
+			status, r.statuses = r.statuses[0], r.statuses[1:]
+		}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(r.Close)
+	return r
+}
+
+func (r *receiver) received() []Event {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Event(nil), r.events...)
+}
+
+func newTestManager(t *testing.T, conf Config) (*Manager, *market) {
+	m := &market{}
+	if conf.Interval == 0 {
+		conf.Interval = time.Second
+	}
+	if conf.Webhook.MaxAttempts == 0 {
+		conf.Webhook = WebhookConfig{Timeout: time.Second, MaxAttempts: 3, Backoff: time.Millisecond, AllowPrivate: true}
+	}
+	manager, err := New(zap.NewNop(), conf, priceClient{m}, rankClient{m})
+	require.NoError(t, err)
+	return manager, m
+}
+
+func TestPriceCrossing(t *testing.T) {
+	manager, m := newTestManager(t, Config{})
+	hook := newReceiver(t)
+	a, err := manager.Create("dashboard", Alert{Symbol: "btc", Kind: KindAbove, Threshold: 70000, URL: hook.URL})
+	require.NoError(t, err)
+	assert.Equal(t, "BTC", a.Symbol)
+	assert.Len(t, a.Secret, 64)
+
+	step := func(at time.Duration, price float64) {
+		m.set(t0.Add(at), map[string]float64{"BTC": price})
+		manager.Evaluate(context.Background())
+		manager.Wait()
+	}
+	// the condition true at the first evaluation is the baseline
+	step(0, 71000)
+	step(time.Minute, 69000)
+	step(2*time.Minute, 71000)
+	// it holds, or the data is not refreshed
+	step(3*time.Minute, 72000)
+	manager.Evaluate(context.Background())
+	require.Len(t, hook.received(), 1)
+	// it fires again after it was false
+	step(4*time.Minute, 69500)
+	step(5*time.Minute, 70500)
+
+	events := hook.received()
+	require.Len(t, events, 2)
+	ev := events[0]
+	assert.Equal(t, "BTC", ev.Symbol)
+	assert.Equal(t, 71000.0, *ev.Price)
+	assert.Equal(t, t0.Add(2*time.Minute), ev.AsOf)
+	assert.Equal(t, a.ID, ev.Alert.ID)
+	assert.Empty(t, ev.Alert.Secret)
+	assert.Empty(t, ev.Alert.Owner)
+
+	// the body is signed with the alert's secret and the timestamp
+	h := hook.headers[0]
+	assert.Equal(t, ev.ID, h.Get(DeliveryHeader))
+	ts, err := strconv.ParseInt(h.Get(TimestampHeader), 10, 64)
+	require.NoError(t, err)
+	assert.True(t, Verify(a.Secret, ts, hook.bodies[0], h.Get(SignatureHeader)))
+	assert.False(t, Verify("another secret value", ts, hook.bodies[0], h.Get(SignatureHeader)))
+
+	deliveries, err := manager.Deliveries("dashboard", a.ID)
+	require.NoError(t, err)
+	require.Len(t, deliveries, 2)
+	assert.Equal(t, events[1].ID, deliveries[0].ID, "the newest first")
+	assert.Equal(t, DeliveryDelivered, deliveries[1].Status)
+	require.Len(t, deliveries[1].Attempts, 1)
+	assert.Equal(t, http.StatusOK, deliveries[1].Attempts[0].StatusCode)
+
+	got, err := manager.Get("dashboard", a.ID)
+	require.NoError(t, err)
+	assert.NotNil(t, got.LastTriggeredAt)
+}
+
+func TestChangeAndRank(t *testing.T) {
+	manager, m := newTestManager(t, Config{})
+	hook := newReceiver(t)
+	change, err := manager.Create("", Alert{Symbol: "ETH", Kind: KindChange, Percent: 5, Window: Duration(time.Hour), URL: hook.URL})
+	require.NoError(t, err)
+	top, err := manager.Create("", Alert{Symbol: "SOL", Kind: KindEntersTop, Rank: 3, URL: hook.URL})
+	require.NoError(t, err)
+
+	step := func(at time.Duration, eth float64, ranks ...string) {
+		m.set(t0.Add(at), map[string]float64{"ETH": eth}, ranks...)
+		manager.Evaluate(context.Background())
+		manager.Wait()
+	}
+	step(0, 2800, "BTC", "ETH", "USDT", "SOL")
+	// the moves from out of the window don't count
+	step(2*time.Hour, 3000, "BTC", "ETH", "USDT", "SOL")
+	step(2*time.Hour+20*time.Minute, 3050, "BTC", "ETH", "USDT", "SOL")
+	assert.Empty(t, hook.received())
+
+	// the largest move within the hour, 3050 to 2890, is -5.25%
+	step(2*time.Hour+40*time.Minute, 2890, "BTC", "SOL", "ETH")
+	events := hook.received()
+	require.Len(t, events, 2)
+	byAlert := map[string]Event{}
+	for _, ev := range events {
+		byAlert[ev.Alert.ID] = ev
+	}
+	require.NotNil(t, byAlert[change.ID].ChangePercent)
+	assert.InDelta(t, -5.25, *byAlert[change.ID].ChangePercent, 0.01)
+	assert.Equal(t, 2, byAlert[top.ID].Rank)
+}
+
+func TestRetries(t *testing.T) {
+	manager, m := newTestManager(t, Config{})
+	flaky := newReceiver(t, http.StatusInternalServerError, http.StatusTooManyRequests)
+	refusing := newReceiver(t, http.StatusBadRequest)
+	down := newReceiver(t, http.StatusBadGateway, http.StatusBadGateway, http.StatusBadGateway)
+
+	var ids []string
+	for _, url := range []string{flaky.URL, refusing.URL, down.URL} {
+		a, err := manager.Create("", Alert{Symbol: "BTC", Kind: KindBelow, Threshold: 60000, URL: url})
+		require.NoError(t, err)
+		ids = append(ids, a.ID)
+	}
+	m.set(t0, map[string]float64{"BTC": 61000})
+	manager.Evaluate(context.Background())
+	m.set(t0.Add(time.Minute), map[string]float64{"BTC": 59000})
+	manager.Evaluate(context.Background())
+	manager.Wait()
+
+	cases := []struct {
+		status   string
+		attempts []int
+	}{
+		{DeliveryDelivered, []int{500, 429, 200}},
+		{DeliveryFailed, []int{400}},
+		{DeliveryFailed, []int{502, 502, 502}},
+	}
+	for i, tc := range cases {
+		deliveries, err := manager.Deliveries("", ids[i])
+		require.NoError(t, err)
+		require.Len(t, deliveries, 1)
+		assert.Equal(t, tc.status, deliveries[0].Status, i)
+		var codes []int
+		for _, a := range deliveries[0].Attempts {
+			codes = append(codes, a.StatusCode)
+		}
+		assert.Equal(t, tc.attempts, codes, i)
+	}
+	// the retries are the same delivery
+	assert.Equal(t, flaky.headers[0].Get(DeliveryHeader), flaky.headers[2].Get(DeliveryHeader))
+}
+
+func TestPrivateHosts(t *testing.T) {
+	manager, m := newTestManager(t, Config{Webhook: WebhookConfig{Timeout: time.Second, MaxAttempts: 2, Backoff: time.Millisecond}})
+	hook := newReceiver(t)
+	a, err := manager.Create("", Alert{Symbol: "BTC", Kind: KindAbove, Threshold: 1, URL: hook.URL})
+	require.NoError(t, err)
+
+	m.set(t0, map[string]float64{"BTC": 0.5})
+	manager.Evaluate(context.Background())
+	m.set(t0.Add(time.Minute), map[string]float64{"BTC": 2})
+	manager.Evaluate(context.Background())
+	manager.Wait()
+
+	assert.Empty(t, hook.received())
+	deliveries, err := manager.Deliveries("", a.ID)
+	require.NoError(t, err)
+	require.Len(t, deliveries, 1)
+	assert.Equal(t, DeliveryFailed, deliveries[0].Status)
+	assert.Contains(t, deliveries[0].Attempts[0].Error, errPrivateHost.Error())
+}
+
+func TestCRUD(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "alerts.json")
+	manager, _ := newTestManager(t, Config{StoreFile: file, MaxPerClient: 2})
+
+	a, err := manager.Create("dashboard", Alert{Symbol: "BTC", Kind: KindAbove, Threshold: 70000, URL: "https://example.com/hook", Secret: "0123456789abcdef"})
+	require.NoError(t, err)
+	_, err = manager.Create("dashboard", Alert{Symbol: "ETH", Kind: KindEntersTop, Rank: 1, URL: "https://example.com/hook"})
+	require.NoError(t, err)
+	_, err = manager.Create("dashboard", Alert{Symbol: "SOL", Kind: KindEntersTop, Rank: 1, URL: "https://example.com/hook"})
+	assert.ErrorContains(t, err, "at most 2 alerts")
+
+	// the alerts of the other clients are not visible
+	_, err = manager.Get("cron", a.ID)
+	code, status, _ := apierror.FromError(err)
+	assert.Equal(t, apierror.NotFound, code)
+	assert.Equal(t, http.StatusNotFound, status)
+	assert.Empty(t, manager.List("cron"))
+	assert.Len(t, manager.List("dashboard"), 2)
+
+	// the secret is kept unless set
+	updated, err := manager.Update("dashboard", a.ID, Alert{Symbol: "BTC", Kind: KindBelow, Threshold: 50000, Percent: 3, URL: "https://example.com/other"})
+	require.NoError(t, err)
+	assert.Equal(t, KindBelow, updated.Kind)
+	assert.Zero(t, updated.Percent)
+	assert.Equal(t, "0123456789abcdef", updated.Secret)
+	assert.Equal(t, a.CreatedAt, updated.CreatedAt)
+
+	// the alerts are kept in the file
+	reopened, _ := newTestManager(t, Config{StoreFile: file})
+	got, err := reopened.Get("dashboard", a.ID)
+	require.NoError(t, err)
+	assert.Equal(t, updated.URL, got.URL)
+	assert.Equal(t, updated.Secret, got.Secret)
+
+	require.NoError(t, manager.Delete("dashboard", a.ID))
+	assert.Error(t, manager.Delete("dashboard", a.ID))
+	reopened, _ = newTestManager(t, Config{StoreFile: file})
+	assert.Len(t, reopened.List("dashboard"), 1)
+}
+
+// race runs the functions at once
+func race(fs ...func()) {
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for _, f := range fs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			f()
+		}()
+	}
+	close(start)
+	wg.Wait()
+}
+
+func TestConcurrentUpdate(t *testing.T) {
+	manager, _ := newTestManager(t, Config{})
+	hook := newReceiver(t)
+	alert := Alert{Symbol: "BTC", Kind: KindAbove, Threshold: 70000, URL: hook.URL}
+	change := Alert{Symbol: "BTC", Kind: KindBelow, Threshold: 50000, URL: hook.URL}
+
+	t.Run("delete", func(t *testing.T) {
+		for range 200 {
+			a, err := manager.Create("dashboard", alert)
+			require.NoError(t, err)
+			var updateErr, deleteErr error
+			race(
+				func() { _, updateErr = manager.Update("dashboard", a.ID, change) },
+				func() { deleteErr = manager.Delete("dashboard", a.ID) },
+			)
+			require.NoError(t, deleteErr)
+			if updateErr != nil {
+				code, _, _ := apierror.FromError(updateErr)
+				require.Equal(t, apierror.NotFound, code)
+			}
+			// the update doesn't bring the deleted alert back
+			_, err = manager.Get("dashboard", a.ID)
+			require.Error(t, err)
+		}
+	})
+
+	t.Run("trigger", func(t *testing.T) {
+		a, err := manager.Create("dashboard", alert)
+		require.NoError(t, err)
+		for i := range 200 {
+			triggered := t0.Add(time.Duration(i) * time.Minute)
+			race(
+				func() { manager.trigger(context.Background(), a, Event{TriggeredAt: triggered}) },
+				func() { _, err = manager.Update("dashboard", a.ID, change) },
+			)
+			require.NoError(t, err)
+			// the update doesn't drop the time of the trigger
+			got, err := manager.Get("dashboard", a.ID)
+			require.NoError(t, err)
+			require.NotNil(t, got.LastTriggeredAt)
+			require.Equal(t, triggered, *got.LastTriggeredAt)
+		}
+		manager.Wait()
+	})
+}
+
+func TestValidate(t *testing.T) {
+	url := "https://example.com/hook"
+	cases := []struct {
+		alert Alert
+		err   string
+	}{
+		{Alert{Symbol: "BTC", Kind: KindAbove, Threshold: 1, URL: url}, ""},
+		{Alert{Symbol: "B-C", Kind: KindAbove, Threshold: 1, URL: url}, "invalid symbol"},
+		{Alert{Symbol: "BTC", Kind: "crosses", URL: url}, "invalid kind"},
+		{Alert{Symbol: "BTC", Kind: KindBelow, URL: url}, "positive threshold"},
+		{Alert{Symbol: "BTC", Kind: KindChange, Percent: 5, URL: url}, "window"},
+		{Alert{Symbol: "BTC", Kind: KindChange, Percent: 5, Window: Duration(48 * time.Hour), URL: url}, "window"},
+		{Alert{Symbol: "BTC", Kind: KindEntersTop, Rank: MaxRank + 1, URL: url}, "rank"},
+		{Alert{Symbol: "BTC", Kind: KindAbove, Threshold: 1, URL: "ftp://example.com"}, "url"},
+		{Alert{Symbol: "BTC", Kind: KindAbove, Threshold: 1, URL: "/hook"}, "url"},
+		{Alert{Symbol: "BTC", Kind: KindAbove, Threshold: 1, URL: url, Secret: "short"}, "secret"},
+	}
+	for _, tc := range cases {
+		err := tc.alert.validate()
+		if tc.err == "" {
+			assert.NoError(t, err)
+			continue
+		}
+		assert.ErrorContains(t, err, tc.err)
+	}
+
+	var a Alert
+	require.NoError(t, json.Unmarshal([]byte(`{"symbol":"ETH","kind":"change","percent":5,"window":"1h"}`), &a))
+	assert.Equal(t, Duration(time.Hour), a.Window)
+	assert.Error(t, json.Unmarshal([]byte(`{"window":"an hour"}`), &a))
+	b, err := json.Marshal(Alert{Window: Duration(90 * time.Minute)})
+	require.NoError(t, err)
+	assert.Contains(t, string(b), `"window":"1h30m0s"`)
+}
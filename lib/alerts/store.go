@@ -0,0 +1,187 @@
+package alerts
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// store keeps the alerts by id, in the file if it is set
+type store struct {
+	path string
+
+	mu     sync.RWMutex
+	alerts map[string]Alert
+}
+
+type storeFile struct {
+	Alerts []Alert `json:"alerts"`
+}
+
+// openStore returns the store of the file, its alerts are loaded if it exists. No path keeps the alerts in memory.
+func openStore(path string) (*store, error) {
+	s := &store{path: path, alerts: map[string]Alert{}}
+	if path == "" {
+		return s, nil
+	}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read alerts file: %w", err)
+	}
+	var f storeFile
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, fmt.Errorf("parse alerts file %s: %w", path, err)
+	}
+	for _, a := range f.Alerts {
+		s.alerts[a.ID] = a
+	}
+	return s, nil
+}
+
+// all returns the alerts ordered by the creation time
+func (s *store) all() []Alert {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	list := make([]Alert, 0, len(s.alerts))
+	for _, a := range s.alerts {
+		list = append(list, a)
+	}
+	slices.SortFunc(list, func(a, b Alert) int {
+		if c := a.CreatedAt.Compare(b.CreatedAt); c != 0 {
+			return c
+		}
+		return strings.Compare(a.ID, b.ID)
+	})
+	return list
+}
+
+func (s *store) get(id string) (Alert, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	a, ok := s.alerts[id]
+	return a, ok
+}
+
+// errTooMany is returned for the new alert of the owner having the max number of them
+var errTooMany = errors.New("too many alerts")
+
+// put adds or replaces the alert and saves the file, the change is reverted if it can't be saved.
+// A new alert is refused if its owner has limit alerts already, 0 is no limit.
+func (s *store) put(a Alert, limit int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old, existed := s.alerts[a.ID]
+	if !existed && limit > 0 {
+		n := 0
+		for _, other := range s.alerts {
+			if other.Owner == a.Owner {
+				n++
+			}
+		}
+		if n >= limit {
+			return errTooMany
+		}
+	}
+	s.alerts[a.ID] = a
+	if err := s.save(); err != nil {
+		if existed {
+			s.alerts[a.ID] = old
+		} else {
+			delete(s.alerts, a.ID)
+		}
+		return err
+	}
+	return nil
+}
+
+// replace changes the alert to the one returned by f under the lock, so no change is lost in between.
+// The error of f keeps the alert, errNotFound is returned for a missing one; the change is reverted if it can't be saved.
+func (s *store) replace(id string, f func(Alert) (Alert, error)) (Alert, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old, ok := s.alerts[id]
+	if !ok {
+		return Alert{}, errNotFound
+	}
+	a, err := f(old)
+	if err != nil {
+		return Alert{}, err
+	}
+	s.alerts[id] = a
+	if err := s.save(); err != nil {
+		s.alerts[id] = old
+		return Alert{}, err
+	}
+	return a, nil
+}
+
+// update changes the alert if it exists, the failure to save the file is returned
+func (s *store) update(id string, f func(*Alert)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a, ok := s.alerts[id]
+	if !ok {
+		return nil
+	}
+	f(&a)
+	s.alerts[id] = a
+	return s.save()
+}
+
+// delete removes the alert and saves the file
+func (s *store) delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old, ok := s.alerts[id]
+	if !ok {
+		return nil
+	}
+	delete(s.alerts, id)
+	if err := s.save(); err != nil {
+		s.alerts[id] = old
+		return err
+	}
+	return nil
+}
+
+// save writes the alerts to the file atomically, the caller holds the lock
+func (s *store) save() error {
+	if s.path == "" {
+		return nil
+	}
+	f := storeFile{Alerts: make([]Alert, 0, len(s.alerts))}
+	for _, a := range s.alerts {
+		f.Alerts = append(f.Alerts, a)
+	}
+	slices.SortFunc(f.Alerts, func(a, b Alert) int { return strings.Compare(a.ID, b.ID) })
+	b, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// the file keeps the webhook secrets
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return fmt.Errorf("save alerts: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return fmt.Errorf("save alerts: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("save alerts: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("save alerts: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,203 @@
+package alerts
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"expvar"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// SignatureHeader is "sha256=" and the hex HMAC-SHA256 of TimestampHeader, "." and the body keyed by the alert's secret
+	SignatureHeader = "X-Alert-Signature"
+	// TimestampHeader is the Unix time of the attempt, the receivers reject the old ones to stop the replays
+	TimestampHeader = "X-Alert-Timestamp"
+	// DeliveryHeader is the id of the delivery, the same in all its attempts
+	DeliveryHeader = "X-Alert-Delivery"
+
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+
+	// the number of the last deliveries kept per alert
+	deliveryLogSize = 20
+	maxBackoff      = time.Minute
+)
+
+// the webhooks: triggered, delivered, failed and retried attempts
+var deliveryStats = expvar.NewMap("alert_webhooks")
+
+// Event is the body of the webhook
+type Event struct {
+	// ID is the id of the delivery
+	ID     string   `json:"id"`
+	Alert  Alert    `json:"alert"`
+	Symbol string   `json:"symbol"`
+	Price  *float64 `json:"price,omitempty"`
+	Rank   int      `json:"rank,omitempty"`
+	// ChangePercent is the move of the price within the window of the change alert
+	ChangePercent *float64 `json:"change_percent,omitempty"`
+	// AsOf is the time of the data which triggered the alert
+	AsOf        time.Time `json:"as_of"`
+	TriggeredAt time.Time `json:"triggered_at"`
+}
+
+// Delivery is the log of the webhook of one trigger
+type Delivery struct {
+	ID          string    `json:"id"`
+	AlertID     string    `json:"alert_id"`
+	TriggeredAt time.Time `json:"triggered_at"`
+	Status      string    `json:"status"`
+	Attempts    []Attempt `json:"attempts"`
+}
+
+// Attempt is one request of the delivery
+type Attempt struct {
+	At         time.Time `json:"at"`
+	StatusCode int       `json:"status_code,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	DurationMS int64     `json:"duration_ms"`
+}
+
+// Sign returns the signature of the body sent at the timestamp, see SignatureHeader
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10) + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify reports whether the signature of the body sent at the timestamp is valid, for the receivers
+func Verify(secret string, timestamp int64, body []byte, signature string) bool {
+	return hmac.Equal([]byte(Sign(secret, timestamp, body)), []byte(signature))
+}
+
+// errPrivateHost is returned for the webhooks to the private addresses unless they are allowed
+var errPrivateHost = errors.New("webhooks to the private addresses are not allowed")
+
+// newWebhookClient returns the client of the webhooks, the redirects are not followed
+// and the private addresses are refused unless allowed
+func newWebhookClient(conf WebhookConfig) *http.Client {
+	dialer := &net.Dialer{Timeout: conf.Timeout}
+	if !conf.AllowPrivate {
+		// checked on the resolved address, so the names pointing inside are refused too
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() {
+				return errPrivateHost
+			}
+			return nil
+		}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	transport.Proxy = nil
+	return &http.Client{
+		Timeout:   conf.Timeout,
+		Transport: transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// deliver posts the event to the alert's webhook until it is accepted, refused or the attempts run out,
+// the attempts are recorded in the delivery
+func (m *Manager) deliver(ctx context.Context, a Alert, d *Delivery, body []byte) {
+	conf := m.config.Webhook
+	backoff := conf.Backoff
+	for attempt := 1; ; attempt++ {
+		start := m.now()
+		code, err := m.post(ctx, a, d.ID, body)
+		rec := Attempt{At: start, StatusCode: code, DurationMS: m.now().Sub(start).Milliseconds()}
+		if err != nil {
+			rec.Error = err.Error()
+		}
+
+		status := DeliveryPending
+		retry := err != nil || code == http.StatusTooManyRequests || code >= http.StatusInternalServerError
+		switch {
+		case err == nil && code >= 200 && code < 300:
+			status = DeliveryDelivered
+		case !retry || attempt >= conf.MaxAttempts || ctx.Err() != nil:
+			status = DeliveryFailed
+		}
+		m.record(d, &rec, status)
+		if status != DeliveryPending {
+			deliveryStats.Add(status, 1)
+			if status == DeliveryFailed {
+				m.logger.Warn("webhook failed", zap.String("alert", a.ID), zap.String("delivery", d.ID), zap.Int("attempts", attempt),
+					zap.Int("status", code), zap.String("error", rec.Error))
+			}
+			return
+		}
+
+		deliveryStats.Add("retried", 1)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			m.record(d, nil, DeliveryFailed)
+			deliveryStats.Add(DeliveryFailed, 1)
+			return
+		}
+		backoff = min(2*backoff, maxBackoff)
+	}
+}
+
+// post sends the signed body and returns the status code of the response
+func (m *Manager) post(ctx context.Context, a Alert, deliveryID string, body []byte) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := m.now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "top-currency-checker-alerts")
+	req.Header.Set(DeliveryHeader, deliveryID)
+	req.Header.Set(TimestampHeader, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(SignatureHeader, Sign(a.Secret, timestamp, body))
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	return resp.StatusCode, nil
+}
+
+// record adds the attempt, if any, to the delivery and sets its status
+func (m *Manager) record(d *Delivery, a *Attempt, status string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if a != nil {
+		d.Attempts = append(d.Attempts, *a)
+	}
+	d.Status = status
+}
+
+// addDelivery adds the delivery to the log of the alert, the oldest ones are dropped
+func (m *Manager) addDelivery(d *Delivery) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	log := append(m.deliveries[d.AlertID], d)
+	if len(log) > deliveryLogSize {
+		log = log[len(log)-deliveryLogSize:]
+	}
+	m.deliveries[d.AlertID] = log
+}
@@ -0,0 +1,194 @@
+// Package apierror describes the errors of the HTTP API. The error codes are stable, the clients can rely on them;
+// the collectors send them over gRPC in the status details, so the handlers don't parse the messages.
+package apierror
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/awnzl/top_currency_checker/lib/requestid"
+	"github.com/awnzl/top_currency_checker/lib/secrets"
+	"github.com/awnzl/top_currency_checker/lib/upstream"
+)
+
+type Code string
+
+const (
+	InvalidLimit    Code = "INVALID_LIMIT"
+	InvalidOffset   Code = "INVALID_OFFSET"
+	InvalidFormat   Code = "INVALID_FORMAT"
+	InvalidFields   Code = "INVALID_FIELDS"
+	InvalidSymbol   Code = "INVALID_SYMBOL"
+	InvalidID       Code = "INVALID_ID"
+	InvalidFilter   Code = "INVALID_FILTER"
+	InvalidSort     Code = "INVALID_SORT"
+	InvalidArgument Code = "INVALID_ARGUMENT"
+	InvalidAlert    Code = "INVALID_ALERT"
+
+	Unauthorized  Code = "UNAUTHORIZED"
+	QuotaExceeded Code = "QUOTA_EXCEEDED" // the client's daily quota
+	RateLimited   Code = "RATE_LIMITED"   // the client's rate or the upstream rate limit
+	NotFound      Code = "NOT_FOUND"
+
+	Timeout             Code = "TIMEOUT"              // the request budget is exceeded
+	UpstreamUnavailable Code = "UPSTREAM_UNAVAILABLE" // the upstream failed and no last good data is kept
+	StaleData           Code = "STALE_DATA"           // the upstream failed and the last good data is too old
+	Internal            Code = "INTERNAL"
+)
+
+// domain of the ErrorInfo details carrying the codes over gRPC
+const domain = "top_currency_checker"
+
+// the messages of the server side errors, their details are logged and not sent to the clients
+var messages = map[Code]string{
+	RateLimited:         "upstream rate limit exceeded, try again later",
+	Timeout:             "request budget exceeded",
+	UpstreamUnavailable: "upstream is unavailable",
+	StaleData:           "upstream is unavailable and the last good data is too old",
+	Internal:            "internal server error",
+}
+
+// Error is a client error with a stable code
+type Error struct {
+	Code    Code
+	Message string
+}
+
+func New(code Code, format string, args ...any) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Status returns the gRPC status error with the code in its details
+func Status(c codes.Code, code Code, format string, args ...any) error {
+	// the upstream errors may quote the provider requests
+	st := status.New(c, secrets.Redact(fmt.Sprintf(format, args...)))
+	if withDetails, err := st.WithDetails(&errdetails.ErrorInfo{Reason: string(code), Domain: domain}); err == nil {
+		st = withDetails
+	}
+	return st.Err()
+}
+
+// UpstreamStatus converts the error of the upstream request to the gRPC status error,
+// the status errors are returned as is
+func UpstreamStatus(err error) error {
+	if _, ok := status.FromError(err); ok || err == nil {
+		return err
+	}
+	switch {
+	case errors.Is(err, upstream.RateLimitError):
+		return Status(codes.ResourceExhausted, RateLimited, "%v", err)
+	case errors.Is(err, context.DeadlineExceeded):
+		return Status(codes.DeadlineExceeded, Timeout, "%v", err)
+	case errors.Is(err, context.Canceled):
+		return status.Error(codes.Canceled, secrets.Redact(err.Error()))
+	}
+	return Status(codes.Unavailable, UpstreamUnavailable, "%v", err)
+}
+
+// FromError returns the code, the HTTP status and the message for the client. The messages of
+// the client errors are passed through, the server side ones are replaced with the generic ones.
+func FromError(err error) (Code, int, string) {
+	var apiErr *Error
+	if errors.As(err, &apiErr) {
+		return apiErr.Code, http.StatusBadRequest, apiErr.Message
+	}
+
+	st := status.Convert(err)
+	httpStatus := HTTPStatus(st.Code())
+	code := defaultCode(st.Code())
+	for _, d := range st.Details() {
+		if info, ok := d.(*errdetails.ErrorInfo); ok && info.Domain == domain {
+			code = Code(info.Reason)
+		}
+	}
+	if msg, ok := messages[code]; ok {
+		return code, httpStatus, msg
+	}
+	if httpStatus >= http.StatusInternalServerError {
+		return code, httpStatus, messages[Internal]
+	}
+	return code, httpStatus, st.Message()
+}
+
+// HTTPStatus translates the gRPC status code
+func HTTPStatus(c codes.Code) int {
+	switch c {
+	case codes.OK:
+		return http.StatusOK
+	case codes.InvalidArgument, codes.OutOfRange, codes.FailedPrecondition:
+		return http.StatusBadRequest
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.AlreadyExists, codes.Aborted:
+		return http.StatusConflict
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.Unimplemented:
+		return http.StatusNotImplemented
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusInternalServerError
+}
+
+func defaultCode(c codes.Code) Code {
+	switch c {
+	case codes.InvalidArgument, codes.OutOfRange, codes.FailedPrecondition:
+		return InvalidArgument
+	case codes.Unauthenticated, codes.PermissionDenied:
+		return Unauthorized
+	case codes.NotFound:
+		return NotFound
+	case codes.ResourceExhausted:
+		return RateLimited
+	case codes.Unavailable:
+		return UpstreamUnavailable
+	case codes.DeadlineExceeded:
+		return Timeout
+	}
+	return Internal
+}
+
+// Body is the error envelope of all the error responses
+type Body struct {
+	Error struct {
+		Code      Code   `json:"code"`
+		Message   string `json:"message"`
+		RequestID string `json:"request_id"`
+	} `json:"error"`
+}
+
+// Write sends the error envelope, the request id is taken from ctx. The error of the response
+// is returned for the caller to log, the status is sent already.
+func Write(ctx context.Context, w http.ResponseWriter, httpStatus int, code Code, msg string) error {
+	var body Body
+	body.Error.Code = code
+	body.Error.Message = msg
+	body.Error.RequestID = requestid.FromContext(ctx)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(httpStatus)
+	b, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("marshal error envelope: %w", err)
+	}
+	_, err = w.Write(b)
+	return err
+}
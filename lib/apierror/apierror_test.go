@@ -0,0 +1,72 @@
+package apierror
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/awnzl/top_currency_checker/lib/requestid"
+	"github.com/awnzl/top_currency_checker/lib/upstream"
+)
+
+func TestFromError(t *testing.T) {
+	cases := []struct {
+		err    error
+		code   Code
+		status int
+		msg    string
+	}{
+		{New(InvalidLimit, "invalid limit"), InvalidLimit, http.StatusBadRequest, "invalid limit"},
+		// the codes survive the conversion to a status and back, as they do over gRPC
+		{status.ErrorProto(status.Convert(UpstreamStatus(fmt.Errorf("batch: %w", upstream.RateLimitError))).Proto()),
+			RateLimited, http.StatusTooManyRequests, messages[RateLimited]},
+		{UpstreamStatus(errors.New("connection refused")), UpstreamUnavailable, http.StatusServiceUnavailable, messages[UpstreamUnavailable]},
+		{UpstreamStatus(fmt.Errorf("request canceled: %w", context.DeadlineExceeded)), Timeout, http.StatusGatewayTimeout, messages[Timeout]},
+		{Status(codes.NotFound, NotFound, "no price for XYZ"), NotFound, http.StatusNotFound, "no price for XYZ"},
+		{status.Error(codes.NotFound, "plain"), NotFound, http.StatusNotFound, "plain"},
+		{status.Error(codes.Internal, "secret details"), Internal, http.StatusInternalServerError, messages[Internal]},
+		{errors.New("render"), Internal, http.StatusInternalServerError, messages[Internal]},
+	}
+	for _, tc := range cases {
+		code, httpStatus, msg := FromError(tc.err)
+		assert.Equal(t, tc.code, code, tc.err.Error())
+		assert.Equal(t, tc.status, httpStatus, tc.err.Error())
+		assert.Equal(t, tc.msg, msg, tc.err.Error())
+	}
+}
+
+// brokenWriter fails the writes as a gone client
+type brokenWriter struct {
+	*httptest.ResponseRecorder
+}
+
+func (brokenWriter) Write([]byte) (int, error) {
+	return 0, errors.New("broken pipe")
+}
+
+func TestWrite(t *testing.T) {
+	ctx := requestid.WithContext(context.Background(), "req-1")
+	rec := httptest.NewRecorder()
+	require.NoError(t, Write(ctx, rec, http.StatusNotFound, NotFound, "no price for XYZ"))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	var body Body
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+	assert.Equal(t, NotFound, body.Error.Code)
+	assert.Equal(t, "no price for XYZ", body.Error.Message)
+	assert.Equal(t, "req-1", body.Error.RequestID)
+
+	// the failed write is returned to be logged
+	broken := brokenWriter{httptest.NewRecorder()}
+	assert.ErrorContains(t, Write(ctx, broken, http.StatusNotFound, NotFound, "no price for XYZ"), "broken pipe")
+	assert.Equal(t, http.StatusNotFound, broken.Code)
+}
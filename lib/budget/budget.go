@@ -0,0 +1,194 @@
+// Package budget plans the refresh intervals of the background pollers within the monthly
+// upstream credit allowance.
+//
+// The credits left for the month, less the reserve kept for the on-demand requests, are spread
+// evenly over the rest of the month. When the usage runs ahead of the plan, fewer credits are left
+// and the intervals grow; when the allowance is used up, the poller waits for the next month.
+package budget
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/awnzl/top_currency_checker/lib/budget/config"
+	"github.com/awnzl/top_currency_checker/lib/requester"
+	"github.com/awnzl/top_currency_checker/lib/secrets"
+)
+
+// the reports of the planners per provider
+var planners = expvar.NewMap("upstream_budget")
+
+// the max time of one refresh, the requests have their own timeouts and retries within it
+const refreshTimeout = time.Minute
+
+// Report is the state of the plan served by the admin endpoint and in the metrics
+type Report struct {
+	Allowance int `json:"allowance"`
+	Used      int `json:"used"`
+	// Planned is the share of the allowance for the elapsed part of the month
+	Planned     int  `json:"planned"`
+	AheadOfPlan bool `json:"ahead_of_plan"`
+	// ProjectedMonthEnd is the usage at the end of the month at the rate since the month or the tracking started
+	ProjectedMonthEnd int     `json:"projected_month_end"`
+	RefreshCredits    int     `json:"refresh_credits"`
+	IntervalSeconds   float64 `json:"interval_seconds"`
+}
+
+type Planner struct {
+	name string
+	// used returns the credits used in the current month
+	used func() int
+
+	mu             sync.Mutex
+	conf           config.Config
+	started        time.Time
+	interval       time.Duration
+	refreshCredits int
+	// the allowance is used up, the polled data is not served as fresh
+	usedUp bool
+	now    func() time.Time
+	log    *log.Logger
+}
+
+// New returns the planner and publishes its report in the upstream_budget metrics
+func New(name string, conf config.Config, used func() int) *Planner {
+	p := &Planner{
+		name:    name,
+		used:    used,
+		conf:    conf,
+		started: time.Now(),
+		now:     time.Now,
+		log:     log.New(secrets.RedactWriter(os.Stdout), "Budget: ", log.LstdFlags|log.Lshortfile),
+	}
+	planners.Set(name, expvar.Func(func() any { return p.Report() }))
+	return p
+}
+
+// SetConfig changes the allowance, the reserve and the interval at runtime, they are used from the next refresh
+func (p *Planner) SetConfig(conf config.Config) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.conf = conf
+}
+
+// Enabled reports whether the background polling is enabled
+func (p *Planner) Enabled() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.conf.PollInterval > 0
+}
+
+// Fresh returns the age within which the polled data is served instead of requesting the upstream,
+// it is the current refresh interval, 0 if the polling is disabled, hasn't started or the allowance is used up
+func (p *Planner) Fresh() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conf.PollInterval <= 0 || p.usedUp {
+		return 0
+	}
+	return p.interval
+}
+
+// Interval returns the fastest refresh interval which keeps the usage within the allowance,
+// given the credits of one refresh
+func (p *Planner) Interval(refreshCredits int) time.Duration {
+	used := p.used()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	interval, ok := p.plan(used, refreshCredits, p.now())
+	if !ok && !p.usedUp {
+		p.log.Printf("%s monthly allowance of %d credits is used up, %d used\n", p.name, p.conf.MonthlyCredits, used)
+	}
+	p.usedUp = !ok
+	if changed(p.interval, interval) {
+		p.log.Printf("%s refresh interval %v, %d credits per refresh, %d of %d monthly credits used\n",
+			p.name, interval.Round(time.Second), refreshCredits, used, p.conf.MonthlyCredits)
+	}
+	p.interval, p.refreshCredits = interval, refreshCredits
+	return interval
+}
+
+// plan returns the interval and false if the allowance is used up
+func (p *Planner) plan(used, refreshCredits int, now time.Time) (time.Duration, bool) {
+	if p.conf.MonthlyCredits <= 0 || refreshCredits <= 0 {
+		return p.conf.PollInterval, true
+	}
+	left := requester.PeriodEnd(now, "month").Sub(now)
+	remaining := p.conf.MonthlyCredits - used
+	refreshes := remaining * (100 - p.conf.ReservePercent) / 100 / refreshCredits
+	if refreshes <= 0 {
+		// the allowance is used up, the next refresh is in the next month
+		return max(left, p.conf.PollInterval), false
+	}
+	return max(left/time.Duration(refreshes), p.conf.PollInterval), true
+}
+
+// changed reports whether the interval changed by more than a tenth, the small changes are not logged
+func changed(old, new time.Duration) bool {
+	diff := old - new
+	return diff < 0 && -diff > old/10 || diff > old/10
+}
+
+// Report returns the current state of the plan
+func (p *Planner) Report() Report {
+	used := p.used()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := p.now()
+	monthStart := requester.PeriodStart(now, "month")
+	month := requester.PeriodEnd(now, "month").Sub(monthStart)
+	r := Report{
+		Allowance:         p.conf.MonthlyCredits,
+		Used:              used,
+		ProjectedMonthEnd: used,
+		RefreshCredits:    p.refreshCredits,
+		IntervalSeconds:   p.interval.Seconds(),
+	}
+	// the usage is tracked since the start, so the rate is measured since then
+	since := monthStart
+	if p.started.After(since) {
+		since = p.started
+	}
+	if tracked := now.Sub(since); tracked >= time.Minute {
+		rate := float64(used) / float64(tracked)
+		r.ProjectedMonthEnd = used + int(rate*float64(month-now.Sub(monthStart)))
+	}
+	if r.Allowance > 0 {
+		r.Planned = int(float64(r.Allowance) * float64(now.Sub(monthStart)) / float64(month))
+		r.AheadOfPlan = r.Used > r.Planned
+	}
+	return r
+}
+
+// ServeHTTP serves the report as JSON
+func (p *Planner) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p.Report())
+}
+
+// Run refreshes the data until the context is done, at the planned intervals. refreshCredits returns
+// the credits of the next refresh. It returns at once if the polling is disabled.
+func (p *Planner) Run(ctx context.Context, refreshCredits func() int, refresh func(ctx context.Context)) {
+	if !p.Enabled() {
+		return
+	}
+	for {
+		refreshCtx, cancel := context.WithTimeout(ctx, refreshTimeout)
+		refresh(refreshCtx)
+		cancel()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(p.Interval(refreshCredits())):
+		}
+	}
+}
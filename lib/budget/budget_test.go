@@ -0,0 +1,54 @@
+package budget
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/awnzl/top_currency_checker/lib/budget/config"
+)
+
+func TestInterval(t *testing.T) {
+	// 10 days left in the month
+	now := time.Date(2024, 4, 21, 0, 0, 0, 0, time.UTC)
+	used := 0
+	p := New("test", config.Config{PollInterval: time.Minute, MonthlyCredits: 10000, ReservePercent: 20}, func() int { return used })
+	p.now = func() time.Time { return now }
+	p.started = now.AddDate(0, 0, -25)
+
+	// 8000 of the 10000 credits, 3 per refresh: 2666 refreshes in 10 days
+	assert.Equal(t, 10*24*time.Hour/2666, p.Interval(3))
+	assert.Equal(t, p.Interval(3), p.Fresh())
+
+	// the usage ahead of the plan makes the interval longer
+	used = 9000
+	assert.Equal(t, 10*24*time.Hour/266, p.Interval(3))
+	r := p.Report()
+	assert.True(t, r.AheadOfPlan)
+	assert.Equal(t, 6666, r.Planned)
+	// 9000 in the 20 days of the month, 4500 more in the remaining 10 days
+	assert.Equal(t, 13500, r.ProjectedMonthEnd)
+
+	// the planned interval is never shorter than the configured one
+	used = 0
+	assert.Equal(t, time.Minute, p.Interval(0))
+	p.SetConfig(config.Config{PollInterval: time.Minute, MonthlyCredits: 10000000})
+	assert.Equal(t, time.Minute, p.Interval(1))
+
+	// the used up allowance waits for the next month and the polled data is not fresh
+	p.SetConfig(config.Config{PollInterval: time.Minute, MonthlyCredits: 100})
+	used = 100
+	assert.Equal(t, 10*24*time.Hour, p.Interval(1))
+	assert.Zero(t, p.Fresh())
+}
+
+func TestUnlimited(t *testing.T) {
+	p := New("unlimited", config.Config{PollInterval: 30 * time.Second}, func() int { return 12345 })
+	assert.Equal(t, 30*time.Second, p.Interval(10))
+	assert.False(t, p.Report().AheadOfPlan)
+
+	p.SetConfig(config.Config{})
+	assert.False(t, p.Enabled())
+	assert.Zero(t, p.Fresh())
+}
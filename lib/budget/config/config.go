@@ -0,0 +1,36 @@
+package config
+
+import (
+	"time"
+
+	"github.com/awnzl/top_currency_checker/lib/config"
+)
+
+type Config struct {
+	// PollInterval is the fastest refresh interval of the background poller, 0 disables it
+	PollInterval time.Duration
+	// MonthlyCredits is the upstream credit allowance of the month, 0 is unlimited
+	MonthlyCredits int
+	// ReservePercent is the share of the remaining credits kept for the on-demand requests
+	ReservePercent int
+}
+
+// Define registers the poller and credit budget options in the service config loader
+func Define(l *config.Loader) {
+	l.Define("poll.interval", time.Duration(0), "poll-interval", "fastest refresh interval of the background poller, 0 disables it", "POLL_INTERVAL")
+	l.Define("budget.monthly_credits", 0, "budget-monthly-credits", "upstream credits per calendar month, 0 is the sum of the API key monthly budgets", "BUDGET_MONTHLY_CREDITS")
+	l.Define("budget.reserve_percent", 20, "budget-reserve-percent", "percent of the remaining credits kept for the on-demand requests", "BUDGET_RESERVE_PERCENT")
+}
+
+// Read reads and validates the poller and credit budget options, the errors are recorded in the loader
+func Read(l *config.Loader) Config {
+	c := Config{
+		PollInterval:   l.Duration("poll.interval"),
+		MonthlyCredits: l.Int("budget.monthly_credits"),
+		ReservePercent: l.Int("budget.reserve_percent"),
+	}
+	l.Check(c.PollInterval >= 0, "poll.interval", "must not be negative")
+	l.Check(c.MonthlyCredits >= 0, "budget.monthly_credits", "must not be negative")
+	l.Check(c.ReservePercent >= 0 && c.ReservePercent < 100, "budget.reserve_percent", "must be from 0 to 99")
+	return c
+}
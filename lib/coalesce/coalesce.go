@@ -0,0 +1,52 @@
+// Package coalesce deduplicates concurrent identical work, the callers share one result
+package coalesce
+
+import (
+	"context"
+	"expvar"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// the number of calls and actual executions per group, calls - executions are the coalesced callers
+var stats = expvar.NewMap("coalesced")
+
+type Group struct {
+	name string
+	g    singleflight.Group
+}
+
+// New creates a group, the name is used in the metrics
+func New(name string) *Group {
+	return &Group{name: name}
+}
+
+// Do executes fn once for all the concurrent callers with the same key.
+// fn gets the context of the first caller which is not canceled with it, only its deadline is kept,
+// so one gone caller doesn't fail the others. The caller's ctx only stops its waiting.
+func Do[T any](ctx context.Context, g *Group, key string, fn func(ctx context.Context) (T, error)) (T, error) {
+	stats.Add(g.name+".calls", 1)
+	ch := g.g.DoChan(key, func() (any, error) {
+		stats.Add(g.name+".executions", 1)
+		fnCtx, cancel := detach(ctx)
+		defer cancel()
+		return fn(fnCtx)
+	})
+
+	select {
+	case res := <-ch:
+		v, _ := res.Val.(T)
+		return v, res.Err
+	case <-ctx.Done():
+		var zero T
+		return zero, ctx.Err()
+	}
+}
+
+func detach(ctx context.Context) (context.Context, context.CancelFunc) {
+	detached := context.WithoutCancel(ctx)
+	if deadline, ok := ctx.Deadline(); ok {
+		return context.WithDeadline(detached, deadline)
+	}
+	return context.WithCancel(detached)
+}
@@ -0,0 +1,146 @@
+package coalesce
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func counter(name string) int64 {
+	if v, ok := stats.Get(name).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+// newGroup returns the group of the test and its counters relative to the start of the test, they are global
+func newGroup(t *testing.T) (*Group, func(name string) int64) {
+	name := t.Name()
+	calls, executions := counter(name+".calls"), counter(name+".executions")
+	return New(name), func(stat string) int64 {
+		base := map[string]int64{"calls": calls, "executions": executions}[stat]
+		return counter(name+"."+stat) - base
+	}
+}
+
+// waitCalls waits until the group got n calls
+func waitCalls(t *testing.T, count func(string) int64, n int64) {
+	t.Helper()
+	require.Eventually(t, func() bool { return count("calls") == n }, time.Second, time.Millisecond)
+}
+
+func TestShared(t *testing.T) {
+	g, count := newGroup(t)
+	release := make(chan struct{})
+	var executions atomic.Int32
+	fn := func(context.Context) (int, error) {
+		executions.Add(1)
+		<-release
+		return 42, nil
+	}
+
+	const callers = 10
+	results := make(chan int, callers)
+	var wg sync.WaitGroup
+	for range callers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, err := Do(context.Background(), g, "key", fn)
+			assert.NoError(t, err)
+			results <- v
+		}()
+	}
+	waitCalls(t, count, callers)
+	// the last counted callers are joining the call
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(results)
+
+	for v := range results {
+		assert.Equal(t, 42, v)
+	}
+	assert.Equal(t, int32(1), executions.Load())
+	assert.Equal(t, int64(1), count("executions"))
+
+	// the call after the shared one is done executes again, and so does another key
+	_, err := Do(context.Background(), g, "key", func(context.Context) (int, error) { return 1, nil })
+	require.NoError(t, err)
+	v, err := Do(context.Background(), g, "other", func(context.Context) (int, error) { return 2, nil })
+	require.NoError(t, err)
+	assert.Equal(t, 2, v)
+	assert.Equal(t, int64(callers+2), count("calls"))
+	assert.Equal(t, int64(3), count("executions"))
+}
+
+func TestCanceledCaller(t *testing.T) {
+	g, count := newGroup(t)
+	release := make(chan struct{})
+	fnErr := make(chan error, 1)
+	fn := func(ctx context.Context) (string, error) {
+		select {
+		case <-release:
+			fnErr <- ctx.Err()
+			return "done", nil
+		case <-ctx.Done():
+			fnErr <- ctx.Err()
+			return "", ctx.Err()
+		}
+	}
+
+	// the first caller starts the work and is gone before it is done
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error, 1)
+	go func() {
+		_, err := Do(ctx, g, "key", fn)
+		first <- err
+	}()
+	waitCalls(t, count, 1)
+	second := make(chan string, 1)
+	go func() {
+		v, err := Do(context.Background(), g, "key", fn)
+		assert.NoError(t, err)
+		second <- v
+	}()
+	waitCalls(t, count, 2)
+
+	cancel()
+	assert.ErrorIs(t, <-first, context.Canceled)
+	close(release)
+	assert.Equal(t, "done", <-second)
+	assert.NoError(t, <-fnErr, "the work is not canceled with its first caller")
+	assert.Equal(t, int64(1), count("executions"))
+}
+
+func TestDeadline(t *testing.T) {
+	g, count := newGroup(t)
+	fn := func(ctx context.Context) (int, error) {
+		if _, ok := ctx.Deadline(); !ok {
+			return 0, errors.New("no deadline")
+		}
+		<-ctx.Done()
+		return 0, ctx.Err()
+	}
+
+	// the deadline of the first caller applies to the work, the others get its result
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	first := make(chan error, 1)
+	go func() {
+		_, err := Do(ctx, g, "key", fn)
+		first <- err
+	}()
+	waitCalls(t, count, 1)
+	_, err := Do(context.Background(), g, "key", fn)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.ErrorIs(t, <-first, context.DeadlineExceeded)
+	assert.Equal(t, int64(1), count("executions"))
+}
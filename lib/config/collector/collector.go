@@ -0,0 +1,116 @@
+// Package collector describes the configuration shared by the collector services and its reload at runtime
+package collector
+
+import (
+	"time"
+
+	budgetconfig "github.com/awnzl/top_currency_checker/lib/budget/config"
+	"github.com/awnzl/top_currency_checker/lib/config"
+	reqconfig "github.com/awnzl/top_currency_checker/lib/requester/config"
+	"github.com/awnzl/top_currency_checker/lib/secrets"
+	"github.com/awnzl/top_currency_checker/lib/tlsconfig"
+)
+
+// Common is the configuration of every collector, it is embedded in the service ones
+type Common struct {
+	ListenAddress string
+	AdminAddress  string
+	AdminRPCJSON  bool
+	Reflection    bool
+	TLS           tlsconfig.Files
+	APIKey        config.Secret
+	APIKeyFile    string
+	APIKeys       []config.Secret
+	KeyBudget     reqconfig.Budget
+	Budget        budgetconfig.Config
+	APIURL        string
+	Request       reqconfig.Config
+	MaxStaleness  time.Duration
+}
+
+// Collector returns the common part of the service configuration embedding it
+func (c *Common) Collector() *Common {
+	return c
+}
+
+// APIKeySources returns the sources of the provider API keys in the order of use: api.key or
+// api.key_file, then api.keys. The keys are literal or secret references such as env:CMC_API_KEY
+func (c Common) APIKeySources() []secrets.Source {
+	var sources []secrets.Source
+	switch {
+	case c.APIKeyFile != "":
+		sources = append(sources, secrets.File(c.APIKeyFile))
+	case c.APIKey != "":
+		sources = append(sources, secrets.Open(c.APIKey.Value()))
+	}
+	for _, key := range c.APIKeys {
+		sources = append(sources, secrets.Open(key.Value()))
+	}
+	return sources
+}
+
+// CreditBudget returns the polling budget, the allowance defaults to the sum of the API key monthly budgets
+func (c Common) CreditBudget() budgetconfig.Config {
+	b := c.Budget
+	if b.MonthlyCredits == 0 {
+		b.MonthlyCredits = c.KeyBudget.Monthly * len(c.APIKeySources())
+	}
+	return b
+}
+
+// Config is the pointer to a service configuration embedding Common
+type Config[T any] interface {
+	*T
+	Collector() *Common
+}
+
+// Reloadable returns the new configuration with the values which can't be changed
+// at runtime taken from the current one, and the list of such ignored changes
+func Reloadable[T any, P Config[T]](current, new T) (T, []config.Change) {
+	applied := new
+	a, c := P(&applied).Collector(), P(&current).Collector()
+	a.ListenAddress = c.ListenAddress
+	a.AdminAddress = c.AdminAddress
+	a.AdminRPCJSON = c.AdminRPCJSON
+	a.Reflection = c.Reflection
+	// the certificates are reloaded when the files change, the paths are fixed
+	a.TLS = c.TLS
+	a.APIURL = c.APIURL
+	// the transport of the fixtures is set up at startup
+	a.Request.FixturesMode = c.Request.FixturesMode
+	a.Request.FixturesDir = c.Request.FixturesDir
+	// so is the fault injection, its rules can be changed
+	a.Request.FaultsEnabled = c.Request.FaultsEnabled
+	// the poller is started or not at startup, its interval can be changed
+	if (c.Budget.PollInterval > 0) != (a.Budget.PollInterval > 0) {
+		a.Budget.PollInterval = c.Budget.PollInterval
+	}
+	return applied, config.Diff(applied, new)
+}
+
+// Watch applies the changes of the config file to the service without a restart. The invalid files are
+// rejected and the changes requiring a restart are ignored, the current configuration stays in effect;
+// every change is logged. It returns false when there is no config file to watch.
+func Watch[T any, P Config[T]](l *config.Loader, current T, read func(*config.Loader) (T, error), apply func(T), logf func(format string, args ...any)) bool {
+	return config.Watch(l, read,
+		func(newConf T) []config.Change {
+			newConf, ignored := Reloadable[T, P](current, newConf)
+			for _, change := range ignored {
+				logf("Config change requires restart, ignored: %v\n", change)
+			}
+			changes := config.Diff(current, newConf)
+			if len(changes) == 0 {
+				return nil
+			}
+			apply(newConf)
+			for _, change := range changes {
+				logf("Config change applied: %v\n", change)
+			}
+			current = newConf
+			return changes
+		},
+		func(err error) {
+			logf("Config change rejected, keeping the current config: %v\n", err)
+		},
+	)
+}
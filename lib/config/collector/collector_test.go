@@ -0,0 +1,130 @@
+package collector
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/awnzl/top_currency_checker/lib/config"
+)
+
+type testConfig struct {
+	Common
+	Size int
+}
+
+func TestReloadable(t *testing.T) {
+	current := testConfig{Common: Common{ListenAddress: ":1", APIURL: "http://a", MaxStaleness: time.Minute}, Size: 1}
+	current.Request.ReqTimeout = 5
+
+	changed := current
+	changed.ListenAddress = ":2"
+	changed.APIURL = "http://b"
+	changed.MaxStaleness = time.Hour
+	changed.Request.ReqTimeout = 10
+	changed.Request.FaultsEnabled = true
+	changed.Budget.PollInterval = time.Minute
+	changed.Size = 2
+
+	applied, ignored := Reloadable(current, changed)
+	assert.Equal(t, ":1", applied.ListenAddress)
+	assert.Equal(t, "http://a", applied.APIURL)
+	assert.False(t, applied.Request.FaultsEnabled)
+	assert.Zero(t, applied.Budget.PollInterval, "the poller is not started at runtime")
+	assert.Equal(t, time.Hour, applied.MaxStaleness)
+	assert.Equal(t, 10, applied.Request.ReqTimeout)
+	assert.Equal(t, 2, applied.Size)
+
+	var fields []string
+	for _, c := range ignored {
+		fields = append(fields, c.Field)
+	}
+	assert.ElementsMatch(t, []string{"ListenAddress", "APIURL", "Request.FaultsEnabled", "Budget.PollInterval"}, fields)
+
+	// the interval of the started poller can be changed
+	current.Budget.PollInterval = time.Minute
+	changed.Budget.PollInterval = time.Hour
+	applied, _ = Reloadable(current, changed)
+	assert.Equal(t, time.Hour, applied.Budget.PollInterval)
+}
+
+// logs collects the log lines of the watcher
+type logs struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (l *logs) logf(format string, args ...any) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lines = append(l.lines, strings.TrimSpace(fmt.Sprintf(format, args...)))
+}
+
+func (l *logs) contains(line string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, got := range l.lines {
+		if strings.HasPrefix(got, line) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestWatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	write := func(content string) {
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	}
+	write("listen: ':1'\nsize: 1\n")
+
+	l := config.NewLoader("test", "")
+	l.Define("listen", "", "listen", "listen address")
+	l.Define("size", 1, "size", "size")
+	require.NoError(t, l.Load([]string{"--config", path}))
+	read := func(l *config.Loader) (testConfig, error) {
+		l.Reset()
+		c := testConfig{Common: Common{ListenAddress: l.String("listen")}, Size: l.Int("size")}
+		l.Check(c.Size > 0, "size", "must be positive")
+		return c, l.Err()
+	}
+	conf, err := read(l)
+	require.NoError(t, err)
+
+	var (
+		mu      sync.Mutex
+		applied []int
+		log     logs
+	)
+	sizes := func() []int {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]int(nil), applied...)
+	}
+	require.True(t, Watch(l, conf, read, func(c testConfig) {
+		mu.Lock()
+		defer mu.Unlock()
+		applied = append(applied, c.Size)
+	}, log.logf))
+
+	// the reloadable change is applied, the listen address needs a restart
+	write("listen: ':2'\nsize: 2\n")
+	require.Eventually(t, func() bool { return log.contains("Config change applied: Size: 1 -> 2") }, 5*time.Second, 10*time.Millisecond)
+	assert.True(t, log.contains("Config change requires restart, ignored: ListenAddress: :1 -> :2"))
+	assert.Equal(t, []int{2}, sizes())
+
+	// the invalid file is rejected and the applied config is kept, the next change is diffed against it
+	write("listen: ':1'\nsize: 0\n")
+	require.Eventually(t, func() bool { return log.contains("Config change rejected, keeping the current config") }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []int{2}, sizes())
+	write("listen: ':1'\nsize: 3\n")
+	require.Eventually(t, func() bool { return log.contains("Config change applied: Size: 2 -> 3") }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []int{2, 3}, sizes())
+}
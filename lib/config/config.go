@@ -0,0 +1,254 @@
+// Package config loads the typed configuration of the services.
+//
+// The values are merged from (lowest priority first): defaults, a YAML file,
+// environment variables and command line flags.
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/cast"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+const redacted = "******"
+
+// Secret is a string value which is never printed or logged as is
+type Secret string
+
+func (s Secret) String() string {
+	if s == "" {
+		return ""
+	}
+	return redacted
+}
+
+func (s Secret) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// Value returns the real secret value
+func (s Secret) Value() string {
+	return string(s)
+}
+
+type option struct {
+	flag string
+	envs []string
+}
+
+type Loader struct {
+	name        string
+	v           *viper.Viper
+	flags       *pflag.FlagSet
+	options     map[string]option
+	defaultFile string
+	errs        []error
+	invalid     map[string]bool
+}
+
+// NewLoader creates a loader for the service. defaultFile is the YAML file used when
+// neither the --config flag nor the CONFIG_FILE env is set, it is optional.
+func NewLoader(name, defaultFile string) *Loader {
+	l := &Loader{
+		name:        name,
+		v:           viper.New(),
+		flags:       pflag.NewFlagSet(name, pflag.ContinueOnError),
+		options:     make(map[string]option),
+		defaultFile: defaultFile,
+		invalid:     make(map[string]bool),
+	}
+	l.flags.String("config", "", "path to the YAML config file (env CONFIG_FILE)")
+	return l
+}
+
+// Define registers the key with its default value, the flag name (may be empty)
+// and the env variables checked in the given order.
+// The type of the default value defines the type of the flag.
+func (l *Loader) Define(key string, def any, flag, usage string, envs ...string) {
+	l.v.SetDefault(key, def)
+	if len(envs) > 0 {
+		l.v.BindEnv(append([]string{key}, envs...)...)
+	}
+	l.options[key] = option{flag: flag, envs: envs}
+
+	if flag == "" {
+		return
+	}
+	switch d := def.(type) {
+	case string:
+		l.flags.String(flag, d, usage)
+	case int:
+		l.flags.Int(flag, d, usage)
+	case bool:
+		l.flags.Bool(flag, d, usage)
+	case time.Duration:
+		l.flags.Duration(flag, d, usage)
+	case []string:
+		l.flags.StringSlice(flag, d, usage)
+	default:
+		panic(fmt.Sprintf("config: unsupported flag type %T for %s", def, key))
+	}
+	l.v.BindPFlag(key, l.flags.Lookup(flag))
+}
+
+// Load parses the arguments (without the program name) and reads the config file
+func (l *Loader) Load(args []string) error {
+	if err := l.flags.Parse(args); err != nil {
+		return err
+	}
+
+	file, explicit := l.flags.Lookup("config").Value.String(), true
+	if file == "" {
+		file = os.Getenv("CONFIG_FILE")
+	}
+	if file == "" {
+		file, explicit = l.defaultFile, false
+	}
+	if file == "" {
+		return nil
+	}
+
+	l.v.SetConfigFile(file)
+	if err := l.v.ReadInConfig(); err != nil {
+		var pathErr *os.PathError
+		if !explicit && errors.As(err, &pathErr) {
+			// the default file is optional
+			l.v.SetConfigFile("")
+			return nil
+		}
+		return fmt.Errorf("read config file %s: %w", file, err)
+	}
+	return nil
+}
+
+// Viper returns the underlying viper instance
+func (l *Loader) Viper() *viper.Viper {
+	return l.v
+}
+
+// ConfigFile returns the used config file or an empty string
+func (l *Loader) ConfigFile() string {
+	return l.v.ConfigFileUsed()
+}
+
+func (l *Loader) String(key string) string {
+	s, err := cast.ToStringE(l.v.Get(key))
+	if err != nil {
+		l.Invalid(key, "must be a string")
+	}
+	return s
+}
+
+func (l *Loader) Secret(key string) Secret {
+	return Secret(l.String(key))
+}
+
+// Secrets returns the string list as secrets
+func (l *Loader) Secrets(key string) []Secret {
+	var res []Secret
+	for _, s := range l.Strings(key) {
+		res = append(res, Secret(s))
+	}
+	return res
+}
+
+func (l *Loader) Int(key string) int {
+	n, err := cast.ToIntE(l.v.Get(key))
+	if err != nil {
+		l.Invalid(key, fmt.Sprintf("must be an integer, got %q", fmt.Sprint(l.v.Get(key))))
+	}
+	return n
+}
+
+func (l *Loader) Bool(key string) bool {
+	b, err := cast.ToBoolE(l.v.Get(key))
+	if err != nil {
+		l.Invalid(key, fmt.Sprintf("must be a boolean, got %q", fmt.Sprint(l.v.Get(key))))
+	}
+	return b
+}
+
+func (l *Loader) Duration(key string) time.Duration {
+	d, err := cast.ToDurationE(l.v.Get(key))
+	if err != nil {
+		l.Invalid(key, fmt.Sprintf("must be a duration (e.g. 30s, 5m), got %q", fmt.Sprint(l.v.Get(key))))
+	}
+	return d
+}
+
+func (l *Loader) Strings(key string) []string {
+	var res []string
+	for _, s := range cast.ToStringSlice(l.v.Get(key)) {
+		// env values are comma separated
+		for _, part := range strings.Split(s, ",") {
+			if part = strings.TrimSpace(part); part != "" {
+				res = append(res, part)
+			}
+		}
+	}
+	return res
+}
+
+// Invalid records a validation error for the key. The error mentions where the value can be set.
+// Only the first error of each key is recorded.
+func (l *Loader) Invalid(key, msg string) {
+	if l.invalid[key] {
+		return
+	}
+	l.invalid[key] = true
+
+	var from []string
+	opt := l.options[key]
+	if len(opt.envs) > 0 {
+		from = append(from, "env "+strings.Join(opt.envs, "/"))
+	}
+	if opt.flag != "" {
+		from = append(from, "flag --"+opt.flag)
+	}
+	if len(from) > 0 {
+		msg += " (set with " + strings.Join(from, ", ") + ")"
+	}
+	l.errs = append(l.errs, fmt.Errorf("%s: %s", key, msg))
+}
+
+// Check records a validation error when ok is false
+func (l *Loader) Check(ok bool, key, msg string) {
+	if !ok {
+		l.Invalid(key, msg)
+	}
+}
+
+// CheckFile records an error if the file is set and doesn't exist
+func (l *Loader) CheckFile(key, path string) {
+	if path == "" {
+		return
+	}
+	_, err := os.Stat(path)
+	l.Check(err == nil, key, "must be an existing file")
+}
+
+// Err returns all the errors found while reading the values
+func (l *Loader) Err() error {
+	if len(l.errs) == 0 {
+		return nil
+	}
+	msgs := make([]string, 0, len(l.errs))
+	for _, err := range l.errs {
+		msgs = append(msgs, "  "+err.Error())
+	}
+	sort.Strings(msgs)
+	return fmt.Errorf("invalid %s configuration:\n%s", l.name, strings.Join(msgs, "\n"))
+}
+
+// Reset drops the recorded errors, so the loader can be used to read the values again
+func (l *Loader) Reset() {
+	l.errs = nil
+	l.invalid = make(map[string]bool)
+}
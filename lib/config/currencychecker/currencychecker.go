@@ -0,0 +1,178 @@
+// Package currencychecker describes the configuration of the currency_checker service
+package currencychecker
+
+import (
+	"net"
+	"time"
+
+	"github.com/awnzl/top_currency_checker/lib/alerts"
+	"github.com/awnzl/top_currency_checker/lib/config"
+	"github.com/awnzl/top_currency_checker/lib/logger"
+	"github.com/awnzl/top_currency_checker/lib/tlsconfig"
+)
+
+type Log struct {
+	Level            string
+	Sampling         bool
+	SampleInitial    int
+	SampleThereafter int
+}
+
+// CollectorsTLS is the client TLS configuration of the collector connections
+type CollectorsTLS struct {
+	Enabled bool
+	// Files are the client certificate for mTLS and the CA verifying the collectors instead of the system roots
+	Files      tlsconfig.Files
+	ServerName string
+}
+
+type Config struct {
+	Port               string
+	AdminPort          string
+	PriceCollectorAddr string
+	RankCollectorAddr  string
+	APIKeysFile        string
+	RequestBudget      time.Duration
+	CacheTTL           time.Duration
+	ScanSize           int
+	TLS                tlsconfig.Files
+	CollectorsTLS      CollectorsTLS
+	Alerts             alerts.Config
+	Log                Log
+}
+
+// NewLoader returns the loader with all the currency_checker options defined
+func NewLoader() *config.Loader {
+	l := config.NewLoader("currency_checker", "")
+	l.Define("listen.port", "8080", "port", "HTTP API port", "PORT")
+	l.Define("admin.port", "8081", "admin-port", "admin HTTP port", "ADMIN_PORT")
+	l.Define("price_collector.address", "", "pc-address", "price_collector gRPC address", "PC_ADDRESS")
+	l.Define("rank_collector.address", "", "rc-address", "rank_collector gRPC address", "RC_ADDRESS")
+	l.Define("request.budget", 10*time.Second, "request-budget", "overall time of an HTTP request including the collector calls", "REQUEST_BUDGET")
+	l.Define("cache.ttl", 5*time.Second, "cache-ttl", "time the rendered responses are reused, 0 disables the cache", "CACHE_TTL")
+	// every scanned coin is priced, so it bounds the upstream price requests of a query
+	l.Define("scan.size", 200, "scan-size", "number of the top coins the price filters and the sorting by price are applied to", "SCAN_SIZE")
+	l.Define("tls.cert_file", "", "tls-cert-file", "HTTP API certificate, PEM; empty disables TLS", "TLS_CERT_FILE")
+	l.Define("tls.key_file", "", "tls-key-file", "HTTP API private key, PEM", "TLS_KEY_FILE")
+	l.Define("collectors.tls.enabled", false, "collectors-tls", "connect to the collectors over TLS", "COLLECTORS_TLS")
+	l.Define("collectors.tls.ca_file", "", "collectors-tls-ca-file", "CA verifying the collectors, PEM; the system roots by default", "COLLECTORS_TLS_CA_FILE")
+	l.Define("collectors.tls.cert_file", "", "collectors-tls-cert-file", "client certificate for the collectors requiring mTLS, PEM", "COLLECTORS_TLS_CERT_FILE")
+	l.Define("collectors.tls.key_file", "", "collectors-tls-key-file", "client private key, PEM", "COLLECTORS_TLS_KEY_FILE")
+	l.Define("collectors.tls.server_name", "", "collectors-tls-server-name", "name verified in the collector certificates, the dialed host by default", "COLLECTORS_TLS_SERVER_NAME")
+	l.Define("alerts.enabled", false, "alerts", "enable the /v1/alerts API, needs auth.keys_file", "ALERTS_ENABLED")
+	// longer than the collectors' request.rate_limit, the evaluations within it get no fresh data
+	l.Define("alerts.interval", time.Minute, "alerts-interval", "polling of the collectors for the alerts", "ALERTS_INTERVAL")
+	l.Define("alerts.store_file", "", "alerts-store-file", "JSON file keeping the alerts across the restarts, empty keeps them in memory", "ALERTS_STORE_FILE")
+	l.Define("alerts.max_per_client", 100, "alerts-max-per-client", "max number of the alerts of one API key, 0 is unlimited", "ALERTS_MAX_PER_CLIENT")
+	l.Define("alerts.webhook.timeout", 5*time.Second, "alerts-webhook-timeout", "time of one webhook attempt", "ALERTS_WEBHOOK_TIMEOUT")
+	l.Define("alerts.webhook.max_attempts", 5, "alerts-webhook-max-attempts", "number of the attempts of a webhook", "ALERTS_WEBHOOK_MAX_ATTEMPTS")
+	l.Define("alerts.webhook.backoff", time.Second, "alerts-webhook-backoff", "wait before the first webhook retry, doubled with every retry", "ALERTS_WEBHOOK_BACKOFF")
+	l.Define("alerts.webhook.allow_private", false, "alerts-webhook-allow-private", "allow the webhooks to the loopback and the private addresses", "ALERTS_WEBHOOK_ALLOW_PRIVATE")
+	l.Define("auth.keys_file", "", "api-keys-file", "YAML file with the client API keys and quotas, empty disables the authentication", "API_KEYS_FILE")
+	l.Define("log.level", "info", "log-level", "log level: debug, info, warn, error", "LOG_LEVEL")
+	l.Define("log.sampling", true, "log-sampling", "enable log sampling", "LOG_SAMPLING")
+	l.Define("log.sample_initial", 100, "log-sample-initial", "number of the same log entries logged each second before sampling", "LOG_SAMPLE_INITIAL")
+	l.Define("log.sample_thereafter", 100, "log-sample-thereafter", "log every n-th entry after the initial ones", "LOG_SAMPLE_THEREAFTER")
+	return l
+}
+
+// Load merges defaults, the config file, env and flags and validates the result
+func Load(args []string) (Config, error) {
+	l := NewLoader()
+	if err := l.Load(args); err != nil {
+		return Config{}, err
+	}
+	return Read(l)
+}
+
+// Read reads and validates the values of the loaded loader
+func Read(l *config.Loader) (Config, error) {
+	l.Reset()
+	c := Config{
+		Port:               l.String("listen.port"),
+		AdminPort:          l.String("admin.port"),
+		PriceCollectorAddr: l.String("price_collector.address"),
+		RankCollectorAddr:  l.String("rank_collector.address"),
+		APIKeysFile:        l.String("auth.keys_file"),
+		RequestBudget:      l.Duration("request.budget"),
+		CacheTTL:           l.Duration("cache.ttl"),
+		ScanSize:           l.Int("scan.size"),
+		TLS: tlsconfig.Files{
+			CertFile: l.String("tls.cert_file"),
+			KeyFile:  l.String("tls.key_file"),
+		},
+		CollectorsTLS: CollectorsTLS{
+			Enabled: l.Bool("collectors.tls.enabled"),
+			Files: tlsconfig.Files{
+				CertFile: l.String("collectors.tls.cert_file"),
+				KeyFile:  l.String("collectors.tls.key_file"),
+				CAFile:   l.String("collectors.tls.ca_file"),
+			},
+			ServerName: l.String("collectors.tls.server_name"),
+		},
+		Alerts: alerts.Config{
+			Enabled:      l.Bool("alerts.enabled"),
+			Interval:     l.Duration("alerts.interval"),
+			StoreFile:    l.String("alerts.store_file"),
+			MaxPerClient: l.Int("alerts.max_per_client"),
+			Webhook: alerts.WebhookConfig{
+				Timeout:      l.Duration("alerts.webhook.timeout"),
+				MaxAttempts:  l.Int("alerts.webhook.max_attempts"),
+				Backoff:      l.Duration("alerts.webhook.backoff"),
+				AllowPrivate: l.Bool("alerts.webhook.allow_private"),
+			},
+		},
+		Log: Log{
+			Level:            l.String("log.level"),
+			Sampling:         l.Bool("log.sampling"),
+			SampleInitial:    l.Int("log.sample_initial"),
+			SampleThereafter: l.Int("log.sample_thereafter"),
+		},
+	}
+
+	checkPort(l, "listen.port", c.Port)
+	checkPort(l, "admin.port", c.AdminPort)
+	l.Check(c.Port != c.AdminPort, "admin.port", "must differ from listen.port")
+	l.Check(c.RequestBudget > 0, "request.budget", "must be positive")
+	l.Check(c.CacheTTL >= 0, "cache.ttl", "must not be negative")
+	l.Check(c.ScanSize > 0, "scan.size", "must be positive")
+	l.Check((c.TLS.CertFile == "") == (c.TLS.KeyFile == ""), "tls.key_file", "must be set together with tls.cert_file")
+	l.CheckFile("tls.cert_file", c.TLS.CertFile)
+	l.CheckFile("tls.key_file", c.TLS.KeyFile)
+	ct := c.CollectorsTLS
+	l.Check((ct.Files.CertFile == "") == (ct.Files.KeyFile == ""), "collectors.tls.key_file", "must be set together with collectors.tls.cert_file")
+	l.Check(ct.Enabled || (ct.Files == tlsconfig.Files{} && ct.ServerName == ""), "collectors.tls.enabled", "must be set to use the collectors.tls options")
+	l.CheckFile("collectors.tls.ca_file", ct.Files.CAFile)
+	l.CheckFile("collectors.tls.cert_file", ct.Files.CertFile)
+	l.CheckFile("collectors.tls.key_file", ct.Files.KeyFile)
+	checkAddr(l, "price_collector.address", c.PriceCollectorAddr)
+	checkAddr(l, "rank_collector.address", c.RankCollectorAddr)
+	// the alerts are owned by the API keys, without them every caller would share them
+	l.Check(!c.Alerts.Enabled || c.APIKeysFile != "", "alerts.enabled", "needs the API key authentication, set auth.keys_file")
+	l.Check(c.Alerts.Interval > 0, "alerts.interval", "must be positive")
+	l.Check(c.Alerts.MaxPerClient >= 0, "alerts.max_per_client", "must not be negative")
+	l.Check(c.Alerts.Webhook.Timeout > 0, "alerts.webhook.timeout", "must be positive")
+	l.Check(c.Alerts.Webhook.MaxAttempts > 0, "alerts.webhook.max_attempts", "must be a positive integer")
+	l.Check(c.Alerts.Webhook.Backoff > 0, "alerts.webhook.backoff", "must be positive")
+	if _, err := logger.ParseLevel(c.Log.Level); err != nil {
+		l.Invalid("log.level", "must be one of debug, info, warn, error")
+	}
+	l.Check(c.Log.SampleInitial > 0, "log.sample_initial", "must be positive")
+	l.Check(c.Log.SampleThereafter > 0, "log.sample_thereafter", "must be positive")
+
+	return c, l.Err()
+}
+
+func checkPort(l *config.Loader, key, port string) {
+	_, err := net.LookupPort("tcp", port)
+	l.Check(port != "" && err == nil, key, "must be a valid port")
+}
+
+func checkAddr(l *config.Loader, key, addr string) {
+	if addr == "" {
+		l.Invalid(key, "is required")
+		return
+	}
+	_, _, err := net.SplitHostPort(addr)
+	l.Check(err == nil, key, "must be host:port")
+}
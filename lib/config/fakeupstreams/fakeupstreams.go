@@ -0,0 +1,83 @@
+// Package fakeupstreams describes the configuration of the fake_upstreams service
+package fakeupstreams
+
+import (
+	"time"
+
+	"github.com/awnzl/top_currency_checker/lib/config"
+	"github.com/awnzl/top_currency_checker/lib/fakeupstream"
+)
+
+type Config struct {
+	ListenAddress string
+	Seed          int
+	Coins         int
+	Tick          time.Duration
+	Faults        fakeupstream.Faults
+}
+
+// NewLoader returns the loader with all the fake_upstreams options defined
+func NewLoader() *config.Loader {
+	l := config.NewLoader("fake_upstreams", "")
+	l.Define("listen.address", "0.0.0.0:9090", "listen-address", "HTTP listen address", "LISTEN_ADDRESS")
+	l.Define("market.seed", 1, "seed", "seed of the synthetic market, the same seed gives the same data", "MARKET_SEED")
+	l.Define("market.coins", 600, "coins", "number of the synthetic currencies", "MARKET_COINS")
+	l.Define("market.tick", 5*time.Second, "tick", "interval of the price steps", "MARKET_TICK")
+	l.Define("faults.rate_limit_percent", 0, "rate-limit-percent", "percent of the requests answered with the provider's rate limit error", "FAULT_RATE_LIMIT_PERCENT")
+	l.Define("faults.server_error_percent", 0, "server-error-percent", "percent of the requests answered with 500", "FAULT_SERVER_ERROR_PERCENT")
+	l.Define("faults.timeout_percent", 0, "timeout-percent", "percent of the requests answered after faults.timeout_delay", "FAULT_TIMEOUT_PERCENT")
+	l.Define("faults.timeout_delay", 30*time.Second, "timeout-delay", "delay of the timed out responses", "FAULT_TIMEOUT_DELAY")
+	l.Define("faults.malformed_percent", 0, "malformed-percent", "percent of the requests answered with a truncated JSON", "FAULT_MALFORMED_PERCENT")
+	l.Define("faults.fsyms_max_length", 300, "fsyms-max-length", "max length of the fsyms of the price requests, the longer ones are rejected", "FAULT_FSYMS_MAX_LENGTH")
+	return l
+}
+
+// Load merges defaults, the config file, env and flags and validates the result
+func Load(args []string) (Config, error) {
+	l := NewLoader()
+	if err := l.Load(args); err != nil {
+		return Config{}, err
+	}
+	return Read(l)
+}
+
+// Read reads and validates the values of the loaded loader
+func Read(l *config.Loader) (Config, error) {
+	l.Reset()
+	c := Config{
+		ListenAddress: l.String("listen.address"),
+		Seed:          l.Int("market.seed"),
+		Coins:         l.Int("market.coins"),
+		Tick:          l.Duration("market.tick"),
+		Faults: fakeupstream.Faults{
+			RateLimit:    l.Int("faults.rate_limit_percent"),
+			ServerError:  l.Int("faults.server_error_percent"),
+			Timeout:      l.Int("faults.timeout_percent"),
+			TimeoutDelay: l.Duration("faults.timeout_delay"),
+			Malformed:    l.Int("faults.malformed_percent"),
+			FsymsMaxLen:  l.Int("faults.fsyms_max_length"),
+		},
+	}
+
+	l.Check(c.ListenAddress != "", "listen.address", "is required")
+	l.Check(c.Seed >= 0, "market.seed", "must not be negative")
+	l.Check(c.Coins > 0 && c.Coins <= 5000, "market.coins", "must be from 1 to 5000")
+	l.Check(c.Tick > 0, "market.tick", "must be positive")
+	for _, p := range []struct {
+		key     string
+		percent int
+	}{
+		{"faults.rate_limit_percent", c.Faults.RateLimit},
+		{"faults.server_error_percent", c.Faults.ServerError},
+		{"faults.timeout_percent", c.Faults.Timeout},
+		{"faults.malformed_percent", c.Faults.Malformed},
+	} {
+		l.Check(p.percent >= 0 && p.percent <= 100, p.key, "must be from 0 to 100")
+	}
+	f := c.Faults
+	l.Check(f.RateLimit+f.ServerError+f.Timeout+f.Malformed <= 100, "faults.malformed_percent", "the fault percents must add up to at most 100")
+	l.Check(c.Faults.TimeoutDelay >= 0, "faults.timeout_delay", "must not be negative")
+	l.Check(c.Faults.FsymsMaxLen > 0, "faults.fsyms_max_length", "must be a positive integer")
+
+	return c, l.Err()
+}
@@ -0,0 +1,111 @@
+// Package pricecollector describes the configuration of the price_collector service
+package pricecollector
+
+import (
+	"net/url"
+	"time"
+
+	budgetconfig "github.com/awnzl/top_currency_checker/lib/budget/config"
+	"github.com/awnzl/top_currency_checker/lib/config"
+	"github.com/awnzl/top_currency_checker/lib/config/collector"
+	reqconfig "github.com/awnzl/top_currency_checker/lib/requester/config"
+	"github.com/awnzl/top_currency_checker/lib/tlsconfig"
+)
+
+type Config struct {
+	collector.Common
+	FSYMSLimit    int
+	FSYMSMinLimit int
+	FSYMSMaxLen   int
+	Concurrency   int
+}
+
+// NewLoader returns the loader with all the price_collector options defined
+func NewLoader() *config.Loader {
+	l := config.NewLoader("price_collector", "./req_config.yaml")
+	l.Define("listen.address", "0.0.0.0:50050", "listen-address", "gRPC listen address", "LISTEN_ADDRESS")
+	l.Define("admin.address", "0.0.0.0:50060", "admin-address", "admin HTTP listen address, empty to disable", "ADMIN_ADDRESS")
+	l.Define("admin.rpc_json", false, "admin-rpc-json", "serve the RPCs as HTTP/JSON on the admin address", "ADMIN_RPC_JSON")
+	l.Define("grpc.reflection", true, "grpc-reflection", "enable the gRPC server reflection", "GRPC_REFLECTION")
+	l.Define("tls.cert_file", "", "tls-cert-file", "gRPC server certificate, PEM; empty disables TLS", "TLS_CERT_FILE")
+	l.Define("tls.key_file", "", "tls-key-file", "gRPC server private key, PEM", "TLS_KEY_FILE")
+	l.Define("tls.client_ca_file", "", "tls-client-ca-file", "CA verifying the client certificates, PEM; enables mTLS", "TLS_CLIENT_CA_FILE")
+	l.Define("api.key", "", "", "", "API_KEY", "api_key")
+	l.Define("api.key_file", "", "api-key-file", "file with the provider API key, re-read when it changes", "API_KEY_FILE")
+	l.Define("api.keys", []string{}, "", "", "API_KEYS")
+	reqconfig.DefineBudget(l)
+	budgetconfig.Define(l)
+	l.Define("api.endpoint", "", "api-endpoint", "CryptoCompare API endpoint", "API_ENDPOINT", "api_endpoint")
+	l.Define("api.fsyms_limit", 50, "fsyms-limit", "max number of symbols in one price request, the batch size starts at it", "FSYMS_LIMIT", "fsymsLimit")
+	l.Define("api.fsyms_min_limit", 5, "fsyms-min-limit", "min number of symbols in one price request the batch size shrinks to", "FSYMS_MIN_LIMIT")
+	l.Define("api.fsyms_max_length", 300, "fsyms-max-length", "max length of the comma separated symbols of one price request", "FSYMS_MAX_LENGTH")
+	l.Define("api.batch_concurrency", 4, "batch-concurrency", "max number of the price requests of one call in flight", "BATCH_CONCURRENCY")
+	l.Define("snapshot.max_staleness", 10*time.Minute, "max-staleness", "max age of the last good data served when the upstream fails, 0 disables it", "MAX_STALENESS")
+	reqconfig.Define(l)
+	return l
+}
+
+// Load merges defaults, the config file, env and flags and validates the result
+func Load(args []string) (Config, error) {
+	l := NewLoader()
+	if err := l.Load(args); err != nil {
+		return Config{}, err
+	}
+	return Read(l)
+}
+
+// Read reads and validates the values of the loaded loader
+func Read(l *config.Loader) (Config, error) {
+	l.Reset()
+	c := Config{
+		Common: collector.Common{
+			ListenAddress: l.String("listen.address"),
+			AdminAddress:  l.String("admin.address"),
+			AdminRPCJSON:  l.Bool("admin.rpc_json"),
+			Reflection:    l.Bool("grpc.reflection"),
+			APIKey:        l.Secret("api.key"),
+			APIKeyFile:    l.String("api.key_file"),
+			APIKeys:       l.Secrets("api.keys"),
+			KeyBudget:     reqconfig.ReadBudget(l),
+			Budget:        budgetconfig.Read(l),
+			APIURL:        l.String("api.endpoint"),
+			Request:       reqconfig.Read(l),
+			MaxStaleness:  l.Duration("snapshot.max_staleness"),
+			TLS: tlsconfig.Files{
+				CertFile: l.String("tls.cert_file"),
+				KeyFile:  l.String("tls.key_file"),
+				CAFile:   l.String("tls.client_ca_file"),
+			},
+		},
+		FSYMSLimit:    l.Int("api.fsyms_limit"),
+		FSYMSMinLimit: l.Int("api.fsyms_min_limit"),
+		FSYMSMaxLen:   l.Int("api.fsyms_max_length"),
+		Concurrency:   l.Int("api.batch_concurrency"),
+	}
+
+	l.Check(c.ListenAddress != "", "listen.address", "is required")
+	l.Check(!c.AdminRPCJSON || c.AdminAddress != "", "admin.rpc_json", "requires admin.address")
+	l.Check((c.TLS.CertFile == "") == (c.TLS.KeyFile == ""), "tls.key_file", "must be set together with tls.cert_file")
+	l.Check(c.TLS.CAFile == "" || c.TLS.CertFile != "", "tls.client_ca_file", "requires tls.cert_file")
+	l.CheckFile("tls.cert_file", c.TLS.CertFile)
+	l.CheckFile("tls.key_file", c.TLS.KeyFile)
+	l.CheckFile("tls.client_ca_file", c.TLS.CAFile)
+	l.Check(c.APIKey != "" || c.APIKeyFile != "" || len(c.APIKeys) > 0, "api.key", "is required, or api.key_file or api.keys")
+	l.Check(c.APIKey == "" || c.APIKeyFile == "", "api.key_file", "must not be set together with api.key")
+	l.CheckFile("api.key_file", c.APIKeyFile)
+	l.Check(isURL(c.APIURL), "api.endpoint", "must be an absolute http(s) URL")
+	l.Check(c.FSYMSLimit > 0, "api.fsyms_limit", "must be a positive integer")
+	l.Check(c.FSYMSMinLimit > 0, "api.fsyms_min_limit", "must be a positive integer")
+	l.Check(c.FSYMSMinLimit <= c.FSYMSLimit, "api.fsyms_min_limit", "must not be greater than api.fsyms_limit")
+	l.Check(c.FSYMSMaxLen > 0, "api.fsyms_max_length", "must be a positive integer")
+	l.Check(c.Concurrency > 0, "api.batch_concurrency", "must be a positive integer")
+
+	l.Check(c.MaxStaleness >= 0, "snapshot.max_staleness", "must not be negative")
+
+	return c, l.Err()
+}
+
+func isURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
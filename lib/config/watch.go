@@ -0,0 +1,94 @@
+package config
+
+import (
+	"expvar"
+	"fmt"
+	"os"
+	"reflect"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// counts the applied value changes and the rejected config file reloads
+var reloads = expvar.NewMap("config_reloads")
+
+// Watch re-reads the config file each time it changes. read parses and validates the values,
+// apply is called only with valid values and returns the applied changes, otherwise onError
+// is called and the last valid configuration stays in effect.
+// It returns false when there is no config file to watch.
+func Watch[T any](l *Loader, read func(*Loader) (T, error), apply func(T) []Change, onError func(error)) bool {
+	if l.ConfigFile() == "" {
+		return false
+	}
+
+	var mu sync.Mutex
+	l.v.OnConfigChange(func(fsnotify.Event) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		// an empty file is usually seen in the middle of a write, it is not applied as all defaults
+		if info, err := os.Stat(l.ConfigFile()); err == nil && info.Size() == 0 {
+			return
+		}
+		// viper keeps the previous values when the file can't be parsed, read it again to get the error
+		if err := l.v.ReadInConfig(); err != nil {
+			reloads.Add("rejected", 1)
+			onError(fmt.Errorf("read config file %s: %w", l.ConfigFile(), err))
+			return
+		}
+		conf, err := read(l)
+		if err != nil {
+			reloads.Add("rejected", 1)
+			onError(err)
+			return
+		}
+		reloads.Add("applied", int64(len(apply(conf))))
+	})
+	l.v.WatchConfig()
+
+	return true
+}
+
+// Change is a changed configuration value
+type Change struct {
+	Field string
+	Old   any
+	New   any
+}
+
+func (c Change) String() string {
+	return fmt.Sprintf("%s: %v -> %v", c.Field, c.Old, c.New)
+}
+
+// Diff returns the changed fields of two configurations of the same struct type.
+// Nested structs are compared field by field, the field names are joined with dots;
+// the fields of the embedded structs are named as the promoted ones.
+func Diff(old, new any) []Change {
+	return diff("", reflect.ValueOf(old), reflect.ValueOf(new))
+}
+
+func diff(prefix string, old, new reflect.Value) []Change {
+	if old.Kind() != reflect.Struct {
+		if reflect.DeepEqual(old.Interface(), new.Interface()) {
+			return nil
+		}
+		return []Change{{Field: prefix, Old: old.Interface(), New: new.Interface()}}
+	}
+
+	var changes []Change
+	for i := 0; i < old.NumField(); i++ {
+		field := old.Type().Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name := field.Name
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			name = prefix
+		} else if prefix != "" {
+			name = prefix + "." + name
+		}
+		changes = append(changes, diff(name, old.Field(i), new.Field(i))...)
+	}
+	return changes
+}
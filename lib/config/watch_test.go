@@ -0,0 +1,140 @@
+package config
+
+import (
+	"errors"
+	"expvar"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type inner struct {
+	Size  int
+	Names []string
+}
+
+type Embedded struct {
+	Address string
+}
+
+type diffConfig struct {
+	Embedded
+	Key     Secret
+	Timeout time.Duration
+	Inner   inner
+	hidden  int
+}
+
+func TestDiff(t *testing.T) {
+	old := diffConfig{Embedded: Embedded{Address: ":1"}, Key: "a", Timeout: time.Second, Inner: inner{Size: 1, Names: []string{"x"}}, hidden: 1}
+	assert.Empty(t, Diff(old, old))
+
+	changed := old
+	changed.Address = ":2"
+	changed.Key = "b"
+	changed.Inner = inner{Size: 2, Names: []string{"x", "y"}}
+	changed.hidden = 2
+	changes := Diff(old, changed)
+
+	var lines []string
+	for _, c := range changes {
+		lines = append(lines, c.String())
+	}
+	// the embedded fields are named as the promoted ones, the unexported ones are skipped
+	assert.Equal(t, []string{
+		"Address: :1 -> :2",
+		"Key: ****** -> ******",
+		"Inner.Size: 1 -> 2",
+		"Inner.Names: [x] -> [x y]",
+	}, lines)
+}
+
+// writeFile replaces the config file, the watcher sees the change
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+}
+
+func counter(name string) int64 {
+	if v, ok := reloads.Get(name).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+func TestWatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeFile(t, path, "size: 1\n")
+
+	l := NewLoader("test", "")
+	l.Define("size", 1, "size", "size")
+	require.NoError(t, l.Load([]string{"--config", path}))
+	read := func(l *Loader) (int, error) {
+		l.Reset()
+		size := l.Int("size")
+		l.Check(size > 0, "size", "must be positive")
+		return size, l.Err()
+	}
+
+	current := 1
+	applied, rejected := make(chan int, 10), make(chan error, 10)
+	appliedBefore, rejectedBefore := counter("applied"), counter("rejected")
+	require.True(t, Watch(l, read,
+		func(size int) []Change {
+			if size == current {
+				return nil
+			}
+			changes := []Change{{Field: "size", Old: current, New: size}}
+			current = size
+			applied <- size
+			return changes
+		},
+		func(err error) { rejected <- err },
+	))
+
+	wait := func(t *testing.T) (int, error) {
+		t.Helper()
+		select {
+		case size := <-applied:
+			return size, nil
+		case err := <-rejected:
+			return 0, err
+		case <-time.After(5 * time.Second):
+			t.Fatal("the config change is not seen")
+			return 0, nil
+		}
+	}
+
+	writeFile(t, path, "size: 2\n")
+	size, err := wait(t)
+	require.NoError(t, err)
+	assert.Equal(t, 2, size)
+
+	// the invalid values and the broken file are rejected, the applied config is kept
+	writeFile(t, path, "size: -1\n")
+	_, err = wait(t)
+	assert.ErrorContains(t, err, "size")
+	writeFile(t, path, "size: [\n")
+	_, err = wait(t)
+	assert.ErrorContains(t, err, "read config file")
+
+	// a write may be seen more than once, the rejections of the broken file are skipped
+	writeFile(t, path, "size: 3\n")
+	for err = errors.New("rejected"); err != nil; {
+		size, err = wait(t)
+	}
+	assert.Equal(t, 3, size)
+
+	assert.Equal(t, int64(2), counter("applied")-appliedBefore)
+	assert.GreaterOrEqual(t, counter("rejected")-rejectedBefore, int64(2))
+}
+
+func TestWatchWithoutFile(t *testing.T) {
+	l := NewLoader("test", "")
+	require.NoError(t, l.Load(nil))
+	assert.False(t, Watch(l, func(*Loader) (int, error) { return 0, nil }, func(int) []Change { return nil }, func(error) {}))
+}
@@ -0,0 +1,100 @@
+package fakeupstream
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestMarket(seed uint64, now *time.Time) *Market {
+	m := NewMarket(seed, 100, time.Second)
+	m.start = time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	m.now = func() time.Time { return *now }
+	return m
+}
+
+func TestMarketDeterministic(t *testing.T) {
+	now := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	a, b := newTestMarket(7, &now), newTestMarket(7, &now)
+	start := a.Listing(1, 100)
+	assert.Equal(t, "BTC", start[0].Symbol)
+	assert.Equal(t, "FKA", start[20].Symbol)
+
+	now = now.Add(time.Hour)
+	listing := a.Listing(1, 100)
+	assert.Equal(t, listing, b.Listing(1, 100), "the same seed gives the same market")
+	assert.NotEqual(t, start[0].Price, listing[0].Price, "the prices evolve")
+	for i := 1; i < len(listing); i++ {
+		assert.Equal(t, i+1, listing[i].Rank)
+		assert.GreaterOrEqual(t, listing[i-1].MarketCap(), listing[i].MarketCap())
+	}
+
+	swapped := false
+	for i, c := range listing {
+		swapped = swapped || c.ID != int64(i+1)
+	}
+	assert.True(t, swapped, "the ranks swap in an hour of ticks")
+
+	assert.NotEqual(t, listing, newTestMarket(8, &now).Listing(1, 100))
+}
+
+func serve(t *testing.T, faults Faults, uri string, header http.Header) *httptest.ResponseRecorder {
+	t.Helper()
+	router := mux.NewRouter()
+	New(NewMarket(1, 50, time.Minute), faults).Register(router)
+	req := httptest.NewRequest(http.MethodGet, uri, nil)
+	req.Header = header
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestEndpoints(t *testing.T) {
+	key := http.Header{"X-Cmc_pro_api_key": {"fake"}}
+	w := serve(t, Faults{}, ListingsPath+"?start=2&limit=3&convert=USD", key)
+	require.Equal(t, http.StatusOK, w.Code)
+	var listing struct {
+		Data []struct {
+			Symbol  string `json:"symbol"`
+			CMCRank int    `json:"cmc_rank"`
+		} `json:"data"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &listing))
+	require.Len(t, listing.Data, 3)
+	assert.Equal(t, 2, listing.Data[0].CMCRank)
+
+	w = serve(t, Faults{}, ListingsPath+"?limit=3", nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = serve(t, Faults{}, PricesPath+"?fsyms=BTC,NOPE&tsyms=USD", nil)
+	var prices map[string]map[string]float64
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &prices))
+	assert.Equal(t, 68000.0, prices["BTC"]["USD"])
+	assert.NotContains(t, prices, "NOPE")
+}
+
+func TestFaults(t *testing.T) {
+	key := http.Header{"X-Cmc_pro_api_key": {"fake"}}
+	w := serve(t, Faults{RateLimit: 100}, ListingsPath+"?limit=3", key)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Contains(t, w.Body.String(), `"error_code":1008`)
+
+	w = serve(t, Faults{RateLimit: 100}, PricesPath+"?fsyms=BTC&tsyms=USD", nil)
+	assert.Contains(t, w.Body.String(), `"Type":99`)
+
+	w = serve(t, Faults{ServerError: 100}, PricesPath+"?fsyms=BTC&tsyms=USD", nil)
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+
+	w = serve(t, Faults{Malformed: 100}, ListingsPath+"?limit=3", key)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.False(t, json.Valid(w.Body.Bytes()))
+
+	w = serve(t, Faults{Timeout: 100, TimeoutDelay: time.Millisecond}, PricesPath+"?fsyms=BTC&tsyms=USD", nil)
+	assert.Equal(t, http.StatusGatewayTimeout, w.Code)
+}
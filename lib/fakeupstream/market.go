@@ -0,0 +1,190 @@
+// Package fakeupstream serves synthetic CoinMarketCap listings and CryptoCompare prices, so the
+// stack runs without the paid keys or the network.
+//
+// The market is deterministic for the seed: the prices make a random walk advanced once per tick,
+// so the data evolves and the ranks swap from time to time, the same way on every run.
+package fakeupstream
+
+import (
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"sort"
+	"sync"
+	"time"
+)
+
+// the real top symbols come first, the rest are generated
+var knownCoins = []struct {
+	symbol, name string
+	price        float64
+}{
+	{"BTC", "Bitcoin", 68000}, {"ETH", "Ethereum", 3700}, {"USDT", "Tether USDt", 1}, {"BNB", "BNB", 600},
+	{"SOL", "Solana", 165}, {"USDC", "USDC", 1}, {"XRP", "XRP", 0.52}, {"DOGE", "Dogecoin", 0.16},
+	{"TON", "Toncoin", 6.5}, {"ADA", "Cardano", 0.45}, {"SHIB", "Shiba Inu", 0.000025}, {"AVAX", "Avalanche", 36},
+	{"TRX", "TRON", 0.12}, {"DOT", "Polkadot", 7}, {"BCH", "Bitcoin Cash", 480}, {"LINK", "Chainlink", 17},
+	{"NEAR", "NEAR Protocol", 7.2}, {"MATIC", "Polygon", 0.7}, {"LTC", "Litecoin", 83}, {"ICP", "Internet Computer", 12},
+}
+
+// Coin is the state of a synthetic currency
+type Coin struct {
+	ID     int64
+	Symbol string
+	Name   string
+	Rank   int
+	Price  float64
+	Supply float64
+	// Open is the price a day of ticks ago, the 24h change is measured from it
+	Open float64
+}
+
+func (c *Coin) MarketCap() float64 {
+	return c.Price * c.Supply
+}
+
+func (c *Coin) PercentChange24h() float64 {
+	return (c.Price/c.Open - 1) * 100
+}
+
+type Market struct {
+	seed  uint64
+	tick  time.Duration
+	start time.Time
+	now   func() time.Time
+
+	mu       sync.Mutex
+	coins    []*Coin // by rank
+	byID     []*Coin
+	bySymbol map[string]*Coin
+	volatile []float64
+	ticks    int64
+	unpriced map[string]bool
+}
+
+// NewMarket returns the market of n currencies, the state is advanced once per tick since the start
+func NewMarket(seed uint64, n int, tick time.Duration) *Market {
+	rnd := rand.New(rand.NewPCG(seed, 0))
+	m := &Market{
+		seed:     seed,
+		tick:     tick,
+		start:    time.Now(),
+		now:      time.Now,
+		bySymbol: make(map[string]*Coin, n),
+	}
+	for i := 0; i < n; i++ {
+		c := &Coin{ID: int64(i + 1)}
+		// the prices are spread over the orders of magnitude
+		c.Price = math.Pow(10, 4.8-rnd.Float64()*8)
+		volatile := 0.001 + rnd.Float64()*0.006
+		if i < len(knownCoins) {
+			c.Symbol, c.Name, c.Price = knownCoins[i].symbol, knownCoins[i].name, knownCoins[i].price
+			if c.Price == 1 {
+				// the stablecoins stay close to the dollar
+				volatile = 0.00005
+			}
+		} else {
+			c.Symbol = syntheticSymbol(i)
+			c.Name = "Fake " + c.Symbol
+		}
+		// the market caps fall by the rank
+		c.Supply = 1.3e12 * math.Pow(float64(i+1), -1.6) / c.Price
+		c.Open = c.Price
+		m.coins = append(m.coins, c)
+		m.byID = append(m.byID, c)
+		m.bySymbol[c.Symbol] = c
+		m.volatile = append(m.volatile, volatile)
+	}
+	m.rank()
+	return m
+}
+
+// syntheticSymbol returns the distinct symbol of the index, e.g. FKAB
+func syntheticSymbol(i int) string {
+	s := ""
+	for i = i - len(knownCoins); ; i = i/26 - 1 {
+		s = string(rune('A'+i%26)) + s
+		if i < 26 {
+			break
+		}
+	}
+	return fmt.Sprintf("FK%s", s)
+}
+
+func (m *Market) rank() {
+	sort.SliceStable(m.coins, func(i, j int) bool { return m.coins[i].MarketCap() > m.coins[j].MarketCap() })
+	for i, c := range m.coins {
+		c.Rank = i + 1
+	}
+}
+
+// advance moves the market to the current tick, each step depends on the seed and the tick only
+func (m *Market) advance() {
+	target := int64(m.now().Sub(m.start) / m.tick)
+	ticksPerDay := int64(24 * time.Hour / m.tick)
+	for ; m.ticks < target; m.ticks++ {
+		rnd := rand.New(rand.NewPCG(m.seed, uint64(m.ticks+1)))
+		// the coins are walked in the order of the ids, the ranks don't change the sequence
+		for _, c := range m.byID {
+			c.Price *= math.Exp(m.volatile[c.ID-1] * rnd.NormFloat64())
+			if ticksPerDay > 0 && (m.ticks+1)%ticksPerDay == 0 {
+				c.Open = c.Price
+			}
+		}
+		// a neighbor overtakes now and then, so the ranks swap even in the top
+		if rnd.IntN(20) == 0 && len(m.coins) > 1 {
+			i := rnd.IntN(min(len(m.coins)-1, 30))
+			upper, lower := m.coins[i], m.coins[i+1]
+			lower.Price *= upper.MarketCap() / lower.MarketCap() * 1.01
+		}
+		m.rank()
+	}
+}
+
+// SetClock replaces the clock, the market keeps its state and steps on from the current time of the clock
+func (m *Market) SetClock(now func() time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.advance()
+	m.now = now
+	m.start = now().Add(-time.Duration(m.ticks) * m.tick)
+}
+
+// Unprice removes the prices of the symbols, they stay listed like the currencies CryptoCompare doesn't track
+func (m *Market) Unprice(symbols ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.unpriced == nil {
+		m.unpriced = make(map[string]bool, len(symbols))
+	}
+	for _, s := range symbols {
+		m.unpriced[s] = true
+	}
+}
+
+// Listing returns the copies of the currencies ranked from start, at most limit of them
+func (m *Market) Listing(start, limit int) []Coin {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.advance()
+	from := min(max(start-1, 0), len(m.coins))
+	to := min(from+limit, len(m.coins))
+	res := make([]Coin, 0, to-from)
+	for _, c := range m.coins[from:to] {
+		res = append(res, *c)
+	}
+	return res
+}
+
+// Prices returns the prices of the known symbols
+func (m *Market) Prices(symbols []string) map[string]float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.advance()
+	prices := make(map[string]float64, len(symbols))
+	for _, s := range symbols {
+		if c, ok := m.bySymbol[s]; ok && !m.unpriced[s] {
+			prices[s] = c.Price
+		}
+	}
+	return prices
+}
@@ -0,0 +1,283 @@
+package fakeupstream
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// ListingsPath is the CoinMarketCap listings path, the rank_collector endpoint is the URL of it ending with "?"
+	ListingsPath = "/v1/cryptocurrency/listings/latest"
+	// PricesPath is the CryptoCompare prices path, the price_collector endpoint is the URL of /data
+	PricesPath = "/data/pricemulti"
+
+	// CryptoCompare rejects the longer fsyms
+	maxFsymsLen = 300
+)
+
+// Faults are the percents of the requests answered with the errors, checked in this order
+type Faults struct {
+	// RateLimit is answered with the provider's rate limit error
+	RateLimit int
+	// ServerError is answered with 500
+	ServerError int
+	// Timeout is answered after TimeoutDelay, or never if the client goes first
+	Timeout      int
+	TimeoutDelay time.Duration
+	// Malformed is answered with a truncated JSON
+	Malformed int
+	// FsymsMaxLen rejects the longer fsyms as CryptoCompare does, 0 is its 300
+	FsymsMaxLen int
+}
+
+type Server struct {
+	market *Market
+
+	mu     sync.Mutex
+	faults Faults
+	rnd    *rand.Rand
+	log    *log.Logger
+}
+
+// New returns the server of the market, the faults are injected in the same sequence for the seed
+func New(market *Market, faults Faults) *Server {
+	return &Server{
+		market: market,
+		faults: faults,
+		rnd:    rand.New(rand.NewPCG(market.seed, 1)),
+		log:    log.New(os.Stdout, "FakeUpstreams: ", log.LstdFlags|log.Lshortfile),
+	}
+}
+
+// SetFaults changes the injected faults at runtime
+func (s *Server) SetFaults(faults Faults) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = faults
+}
+
+// Register adds the upstream endpoints to the router
+func (s *Server) Register(router *mux.Router) {
+	router.HandleFunc(ListingsPath, s.listings).Methods(http.MethodGet)
+	router.HandleFunc(PricesPath, s.prices).Methods(http.MethodGet)
+}
+
+type fault int
+
+const (
+	noFault fault = iota
+	rateLimitFault
+	serverErrorFault
+	timeoutFault
+	malformedFault
+)
+
+// fault draws the fault of the request
+func (s *Server) fault() (fault, time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := s.rnd.IntN(100)
+	for _, f := range []struct {
+		percent int
+		fault   fault
+	}{
+		{s.faults.RateLimit, rateLimitFault},
+		{s.faults.ServerError, serverErrorFault},
+		{s.faults.Timeout, timeoutFault},
+		{s.faults.Malformed, malformedFault},
+	} {
+		if n < f.percent {
+			return f.fault, s.faults.TimeoutDelay
+		}
+		n -= f.percent
+	}
+	return noFault, 0
+}
+
+// inject draws the fault of the request and answers the server errors and the timeouts,
+// the rate limit and the malformed responses are answered by the handlers
+func (s *Server) inject(w http.ResponseWriter, r *http.Request) fault {
+	f, delay := s.fault()
+	switch f {
+	case serverErrorFault:
+		s.log.Printf("Injected 500: %s\n", r.URL)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+	case timeoutFault:
+		s.log.Printf("Injected timeout of %v: %s\n", delay, r.URL)
+		select {
+		case <-time.After(delay):
+			http.Error(w, "gateway timeout", http.StatusGatewayTimeout)
+		case <-r.Context().Done():
+		}
+	case rateLimitFault:
+		s.log.Printf("Injected rate limit: %s\n", r.URL)
+	case malformedFault:
+		s.log.Printf("Injected malformed JSON: %s\n", r.URL)
+	}
+	return f
+}
+
+func write(w http.ResponseWriter, status int, body any, malformed bool) {
+	b, _ := json.Marshal(body)
+	if malformed {
+		b = b[:len(b)/2]
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(b)
+}
+
+type cmcStatus struct {
+	Timestamp    string  `json:"timestamp"`
+	ErrorCode    int     `json:"error_code"`
+	ErrorMessage *string `json:"error_message"`
+	Elapsed      int     `json:"elapsed"`
+	CreditCount  int     `json:"credit_count"`
+}
+
+func cmcError(w http.ResponseWriter, status, code int, msg string) {
+	write(w, status, map[string]any{"status": cmcStatus{
+		Timestamp:    time.Now().UTC().Format(time.RFC3339Nano),
+		ErrorCode:    code,
+		ErrorMessage: &msg,
+	}}, false)
+}
+
+type cmcUSD struct {
+	Price            float64 `json:"price"`
+	MarketCap        float64 `json:"market_cap"`
+	PercentChange24h float64 `json:"percent_change_24h"`
+	LastUpdated      string  `json:"last_updated"`
+}
+
+type cmcCoin struct {
+	ID                int64   `json:"id"`
+	Name              string  `json:"name"`
+	Symbol            string  `json:"symbol"`
+	Slug              string  `json:"slug"`
+	CMCRank           int     `json:"cmc_rank"`
+	CirculatingSupply float64 `json:"circulating_supply"`
+	Quote             struct {
+		USD cmcUSD `json:"USD"`
+	} `json:"quote"`
+}
+
+// listings serves the CoinMarketCap /v1/cryptocurrency/listings/latest
+func (s *Server) listings(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("X-CMC_PRO_API_KEY") == "" && r.URL.Query().Get("CMC_PRO_API_KEY") == "" {
+		cmcError(w, http.StatusUnauthorized, 1002, "API key missing.")
+		return
+	}
+	start, limit := 1, 100
+	if v := r.URL.Query().Get("start"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			cmcError(w, http.StatusBadRequest, 400, `"start" must be a positive integer`)
+			return
+		}
+		start = n
+	}
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 5000 {
+			cmcError(w, http.StatusBadRequest, 400, `"limit" must be an integer from 1 to 5000`)
+			return
+		}
+		limit = n
+	}
+
+	f := s.inject(w, r)
+	switch f {
+	case serverErrorFault, timeoutFault:
+		return
+	case rateLimitFault:
+		cmcError(w, http.StatusTooManyRequests, 1008, "You've exceeded your API Key's HTTP request rate limit. Rate limits reset every minute.")
+		return
+	}
+
+	coins := s.market.Listing(start, limit)
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	data := make([]cmcCoin, 0, len(coins))
+	for _, c := range coins {
+		cc := cmcCoin{
+			ID:                c.ID,
+			Name:              c.Name,
+			Symbol:            c.Symbol,
+			Slug:              strings.ToLower(strings.ReplaceAll(c.Name, " ", "-")),
+			CMCRank:           c.Rank,
+			CirculatingSupply: c.Supply,
+		}
+		cc.Quote.USD = cmcUSD{Price: c.Price, MarketCap: c.MarketCap(), PercentChange24h: c.PercentChange24h(), LastUpdated: now}
+		data = append(data, cc)
+	}
+	write(w, http.StatusOK, map[string]any{
+		"status": cmcStatus{Timestamp: now, CreditCount: (len(data) + 199) / 200},
+		"data":   data,
+	}, f == malformedFault)
+}
+
+func ccError(w http.ResponseWriter, msg string, extra map[string]any) {
+	body := map[string]any{"Response": "Error", "Message": msg, "HasWarning": false, "Type": 2, "Data": map[string]any{}}
+	for k, v := range extra {
+		body[k] = v
+	}
+	write(w, http.StatusOK, body, false)
+}
+
+// prices serves the CryptoCompare /data/pricemulti
+func (s *Server) prices(w http.ResponseWriter, r *http.Request) {
+	fsyms := r.URL.Query().Get("fsyms")
+	if r.URL.Query().Get("tsyms") != "USD" {
+		ccError(w, "tsyms param is invalid, only USD is supported by the fake", map[string]any{"ParamWithError": "tsyms"})
+		return
+	}
+	if fsyms == "" {
+		ccError(w, "fsyms is a required param.", map[string]any{"ParamWithError": "fsyms"})
+		return
+	}
+	s.mu.Lock()
+	maxLen := cmp.Or(s.faults.FsymsMaxLen, maxFsymsLen)
+	s.mu.Unlock()
+	if len(fsyms) > maxLen {
+		ccError(w, fmt.Sprintf("fsyms param is invalid. (fsyms length is higher than maxlength: %d)", maxLen), map[string]any{"ParamWithError": "fsyms"})
+		return
+	}
+
+	f := s.inject(w, r)
+	switch f {
+	case serverErrorFault, timeoutFault:
+		return
+	case rateLimitFault:
+		ccError(w, "You are over your rate limit please upgrade your account!", map[string]any{
+			"Type": 99,
+			"RateLimit": map[string]any{
+				"calls_made": map[string]int{"second": 1, "minute": 301},
+				"max_calls":  map[string]int{"second": 20, "minute": 300},
+			},
+		})
+		return
+	}
+
+	symbols := strings.Split(fsyms, ",")
+	prices := s.market.Prices(symbols)
+	if len(prices) == 0 {
+		ccError(w, fmt.Sprintf("cccagg_or_exchange market does not exist for this coin pair (%s-USD)", symbols[0]), map[string]any{"ParamWithError": "fsyms"})
+		return
+	}
+	body := make(map[string]map[string]float64, len(prices))
+	for symbol, price := range prices {
+		body[symbol] = map[string]float64{"USD": price}
+	}
+	write(w, http.StatusOK, body, f == malformedFault)
+}
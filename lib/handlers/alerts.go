@@ -0,0 +1,135 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+
+	"github.com/awnzl/top_currency_checker/lib/alerts"
+	"github.com/awnzl/top_currency_checker/lib/apierror"
+	"github.com/awnzl/top_currency_checker/lib/middleware"
+)
+
+// the max size of the alert request body
+const maxAlertBody = 16 << 10
+
+// SetAlerts enables the /v1/alerts API of the manager, it is called before RegisterHandlers
+func (h *Handlers) SetAlerts(m *alerts.Manager) {
+	h.alerts = m
+}
+
+func (h *Handlers) registerAlerts(v1 *mux.Router) {
+	v1.HandleFunc("/alerts", h.requireClient(h.listAlerts)).Methods(http.MethodGet)
+	v1.HandleFunc("/alerts", h.requireClient(h.createAlert)).Methods(http.MethodPost)
+	v1.HandleFunc("/alerts/{id}", h.requireClient(h.getAlert)).Methods(http.MethodGet)
+	v1.HandleFunc("/alerts/{id}", h.requireClient(h.updateAlert)).Methods(http.MethodPut)
+	v1.HandleFunc("/alerts/{id}", h.requireClient(h.deleteAlert)).Methods(http.MethodDelete)
+	v1.HandleFunc("/alerts/{id}/deliveries", h.requireClient(h.alertDeliveries)).Methods(http.MethodGet)
+}
+
+// requireClient rejects the requests without an authenticated API key with 401, the alerts are owned by the keys
+func (h *Handlers) requireClient(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if middleware.ClientFromContext(r.Context()) == "" {
+			if err := apierror.Write(r.Context(), w, http.StatusUnauthorized, apierror.Unauthorized, "the alerts need an api key"); err != nil {
+				h.logger.Error("write response", zap.Error(err))
+			}
+			return
+		}
+		next(w, r)
+	}
+}
+
+// listAlerts returns the alerts of the client
+func (h *Handlers) listAlerts(w http.ResponseWriter, r *http.Request) {
+	list := []alerts.Alert{}
+	for _, a := range h.alerts.List(middleware.ClientFromContext(r.Context())) {
+		list = append(list, a.Public())
+	}
+	h.writeJSON(w, r, http.StatusOK, list)
+}
+
+// createAlert adds the alert of the client, the response is the only one with its secret
+func (h *Handlers) createAlert(w http.ResponseWriter, r *http.Request) {
+	var a alerts.Alert
+	if err := decodeAlert(w, r, &a); err != nil {
+		h.processError(r.Context(), err, w)
+		return
+	}
+	created, err := h.alerts.Create(middleware.ClientFromContext(r.Context()), a)
+	if err != nil {
+		h.processError(r.Context(), err, w)
+		return
+	}
+	created.Owner = ""
+	w.Header().Set("Location", "/"+versionV1+"/alerts/"+created.ID)
+	h.writeJSON(w, r, http.StatusCreated, created)
+}
+
+func (h *Handlers) getAlert(w http.ResponseWriter, r *http.Request) {
+	a, err := h.alerts.Get(middleware.ClientFromContext(r.Context()), mux.Vars(r)["id"])
+	if err != nil {
+		h.processError(r.Context(), err, w)
+		return
+	}
+	h.writeJSON(w, r, http.StatusOK, a.Public())
+}
+
+// updateAlert replaces the condition and the webhook of the alert
+func (h *Handlers) updateAlert(w http.ResponseWriter, r *http.Request) {
+	var a alerts.Alert
+	if err := decodeAlert(w, r, &a); err != nil {
+		h.processError(r.Context(), err, w)
+		return
+	}
+	updated, err := h.alerts.Update(middleware.ClientFromContext(r.Context()), mux.Vars(r)["id"], a)
+	if err != nil {
+		h.processError(r.Context(), err, w)
+		return
+	}
+	h.writeJSON(w, r, http.StatusOK, updated.Public())
+}
+
+func (h *Handlers) deleteAlert(w http.ResponseWriter, r *http.Request) {
+	if err := h.alerts.Delete(middleware.ClientFromContext(r.Context()), mux.Vars(r)["id"]); err != nil {
+		h.processError(r.Context(), err, w)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// alertDeliveries returns the last webhooks of the alert with their attempts
+func (h *Handlers) alertDeliveries(w http.ResponseWriter, r *http.Request) {
+	list, err := h.alerts.Deliveries(middleware.ClientFromContext(r.Context()), mux.Vars(r)["id"])
+	if err != nil {
+		h.processError(r.Context(), err, w)
+		return
+	}
+	h.writeJSON(w, r, http.StatusOK, list)
+}
+
+// decodeAlert reads the alert from the JSON body, the unknown fields are rejected
+func decodeAlert(w http.ResponseWriter, r *http.Request, a *alerts.Alert) error {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAlertBody))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(a); err != nil {
+		return apierror.New(apierror.InvalidAlert, "invalid body: %v", err)
+	}
+	return nil
+}
+
+func (h *Handlers) writeJSON(w http.ResponseWriter, r *http.Request, status int, v any) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		h.processError(r.Context(), fmt.Errorf("marshal: %w", err), w)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if _, err := w.Write(b); err != nil {
+		h.logger.Error("write response", zap.Error(err))
+	}
+}
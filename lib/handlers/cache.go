@@ -0,0 +1,137 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"expvar"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// hits and misses of the response cache
+var responseCacheStats = expvar.NewMap("response_cache")
+
+// cachedResponse is a rendered response of the root handler
+type cachedResponse struct {
+	body         []byte
+	contentType  string
+	etag         string
+	lastModified time.Time // time of the underlying rank and price snapshots
+	expires      time.Time
+	partial      bool      // some prices are missing, see PartialHeader
+	stale        bool      // see StaleHeader
+	asOf         time.Time // time of the oldest data, see AsOfHeader
+}
+
+func newCachedResponse(body []byte, contentType string, lastModified time.Time, ttl time.Duration) *cachedResponse {
+	// the etag depends on the content only, so the clients polling an unchanged list get 304
+	// even when the snapshots were refreshed
+	sum := sha256.Sum256(body)
+	return &cachedResponse{
+		body:         body,
+		contentType:  contentType,
+		etag:         `"` + hex.EncodeToString(sum[:16]) + `"`,
+		lastModified: lastModified,
+		expires:      time.Now().Add(ttl),
+	}
+}
+
+// notModified checks the conditional request headers
+func (c *cachedResponse) notModified(r *http.Request) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, tag := range strings.Split(inm, ",") {
+			tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+			if tag == c.etag || tag == "*" {
+				return true
+			}
+		}
+		return false
+	}
+	if ims, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil {
+		return !c.lastModified.Truncate(time.Second).After(ims)
+	}
+	return false
+}
+
+// write sends the response or 304 if the client has it already
+func (c *cachedResponse) write(w http.ResponseWriter, r *http.Request, logger *zap.Logger) {
+	header := w.Header()
+	if c.partial {
+		header.Set(PartialHeader, "true")
+	}
+	if c.stale {
+		header.Set(StaleHeader, "true")
+	}
+	if !c.asOf.IsZero() {
+		header.Set(AsOfHeader, c.asOf.UTC().Format(time.RFC3339))
+	}
+	header.Set("ETag", c.etag)
+	if !c.lastModified.IsZero() {
+		header.Set("Last-Modified", c.lastModified.UTC().Format(http.TimeFormat))
+	}
+	maxAge := max(time.Until(c.expires).Round(time.Second), 0)
+	header.Set("Cache-Control", fmt.Sprintf("max-age=%d", int(maxAge.Seconds())))
+
+	if c.notModified(r) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	header.Set("Content-Type", c.contentType)
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(c.body); err != nil {
+		logger.Error("write response", zap.Error(err))
+	}
+}
+
+// responseCache keeps the rendered responses per query for the TTL
+type responseCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]*cachedResponse
+}
+
+func newResponseCache(ttl time.Duration) *responseCache {
+	return &responseCache{
+		ttl:     ttl,
+		entries: make(map[string]*cachedResponse),
+	}
+}
+
+func (rc *responseCache) get(key string) (*cachedResponse, bool) {
+	if rc.ttl <= 0 {
+		return nil, false
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	entry, ok := rc.entries[key]
+	if !ok || time.Now().After(entry.expires) {
+		responseCacheStats.Add("miss", 1)
+		return nil, false
+	}
+	responseCacheStats.Add("hit", 1)
+	return entry, true
+}
+
+func (rc *responseCache) set(key string, entry *cachedResponse) {
+	if rc.ttl <= 0 {
+		return
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	// drop the expired entries, the number of distinct queries is small
+	now := time.Now()
+	for k, e := range rc.entries {
+		if now.After(e.expires) {
+			delete(rc.entries, k)
+		}
+	}
+	rc.entries[key] = entry
+}
@@ -0,0 +1,145 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+
+	rc "github.com/awnzl/top_currency_checker/lib/proto/rankcollector"
+)
+
+// countingRanks counts the rank requests, each build of the response makes one
+type countingRanks struct {
+	fakeRanks
+	calls atomic.Int32
+}
+
+func (c *countingRanks) GetRanks(ctx context.Context, req *rc.RankRequest, opts ...grpc.CallOption) (*rc.RankResponse, error) {
+	c.calls.Add(1)
+	return c.fakeRanks.GetRanks(ctx, req, opts...)
+}
+
+// newCachingRouter returns the router of the handlers with the response cache of the TTL
+func newCachingRouter(ttl time.Duration) (*mux.Router, *countingRanks) {
+	ranks := &countingRanks{}
+	h := newTestHandlers()
+	h.rcClient = ranks
+	h.config.CacheTTL, h.cache = ttl, newResponseCache(ttl)
+	return routerOf(h), ranks
+}
+
+func get(router http.Handler, target string, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestETag(t *testing.T) {
+	// the etag depends on the body only
+	a := newCachedResponse([]byte(`[1]`), "application/json", time.Now(), time.Minute)
+	b := newCachedResponse([]byte(`[1]`), "application/json", time.Now().Add(time.Hour), 0)
+	c := newCachedResponse([]byte(`[2]`), "application/json", time.Now(), time.Minute)
+	assert.Equal(t, a.etag, b.etag)
+	assert.NotEqual(t, a.etag, c.etag)
+
+	// the rebuilt responses of the same list have the same etag
+	router, ranks := newCachingRouter(0)
+	first := get(router, "/v1/top?limit=2", nil)
+	second := get(router, "/v1/top?limit=2", nil)
+	require.Equal(t, http.StatusOK, first.Code)
+	require.Equal(t, http.StatusOK, second.Code)
+	assert.Equal(t, int32(2), ranks.calls.Load())
+	assert.NotEmpty(t, first.Header().Get("ETag"))
+	assert.Equal(t, first.Header().Get("ETag"), second.Header().Get("ETag"))
+	assert.NotEqual(t, first.Header().Get("ETag"), get(router, "/v1/top?limit=1", nil).Header().Get("ETag"))
+}
+
+func TestConditionalRequests(t *testing.T) {
+	router, _ := newCachingRouter(time.Minute)
+	rec := get(router, "/v1/top?limit=2", nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	etag := rec.Header().Get("ETag")
+	lastModified, err := http.ParseTime(rec.Header().Get("Last-Modified"))
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		name   string
+		header http.Header
+		code   int
+	}{
+		{"matching etag", http.Header{"If-None-Match": {etag}}, http.StatusNotModified},
+		{"weak etag in a list", http.Header{"If-None-Match": {`"other", W/` + etag}}, http.StatusNotModified},
+		{"other etag", http.Header{"If-None-Match": {`"other"`}}, http.StatusOK},
+		// If-None-Match takes precedence
+		{"other etag, not modified since", http.Header{"If-None-Match": {`"other"`}, "If-Modified-Since": {lastModified.Format(http.TimeFormat)}}, http.StatusOK},
+		{"not modified since", http.Header{"If-Modified-Since": {lastModified.Format(http.TimeFormat)}}, http.StatusNotModified},
+		{"stale modified since", http.Header{"If-Modified-Since": {lastModified.Add(-time.Hour).Format(http.TimeFormat)}}, http.StatusOK},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := get(router, "/v1/top?limit=2", tc.header)
+			require.Equal(t, tc.code, rec.Code)
+			assert.Equal(t, etag, rec.Header().Get("ETag"))
+			if tc.code == http.StatusNotModified {
+				assert.Empty(t, rec.Body.String())
+				return
+			}
+			assert.JSONEq(t, `[{"rank":1,"symbol":"BTC","price":60000},{"rank":2,"symbol":"ETH","price":3000}]`, rec.Body.String())
+		})
+	}
+}
+
+func TestResponseCache(t *testing.T) {
+	t.Run("expired entry is rebuilt", func(t *testing.T) {
+		router, ranks := newCachingRouter(50 * time.Millisecond)
+		get(router, "/v1/top?limit=2", nil)
+		get(router, "/v1/top?limit=2", nil)
+		assert.Equal(t, int32(1), ranks.calls.Load())
+
+		time.Sleep(60 * time.Millisecond)
+		rec := get(router, "/v1/top?limit=2", nil)
+		require.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, int32(2), ranks.calls.Load())
+	})
+
+	t.Run("queries do not share entries", func(t *testing.T) {
+		router, ranks := newCachingRouter(time.Minute)
+		one := get(router, "/v1/top?limit=1", nil)
+		two := get(router, "/v1/top?limit=2", nil)
+		csv := get(router, "/v1/top?limit=1&format=csv", nil)
+		assert.Equal(t, int32(3), ranks.calls.Load())
+		assert.JSONEq(t, `[{"rank":1,"symbol":"BTC","price":60000}]`, one.Body.String())
+		assert.JSONEq(t, `[{"rank":1,"symbol":"BTC","price":60000},{"rank":2,"symbol":"ETH","price":3000}]`, two.Body.String())
+		assert.NotEqual(t, one.Header().Get("Content-Type"), csv.Header().Get("Content-Type"))
+
+		// the repeated queries are served from their entries
+		assert.Equal(t, one.Body.String(), get(router, "/v1/top?limit=1", nil).Body.String())
+		assert.Equal(t, two.Body.String(), get(router, "/v1/top?limit=2", nil).Body.String())
+		assert.Equal(t, int32(3), ranks.calls.Load())
+	})
+
+	t.Run("partial responses are not cached", func(t *testing.T) {
+		ranks := &countingRanks{}
+		h := newTestHandlers()
+		h.rcClient, h.pcClient = ranks, failingPrices{failing: "ETH"}
+		h.config.CacheTTL, h.cache = time.Minute, newResponseCache(time.Minute)
+		router := routerOf(h)
+		for range 2 {
+			rec := get(router, "/v1/top?limit=2", nil)
+			require.Equal(t, http.StatusOK, rec.Code)
+			assert.Equal(t, "true", rec.Header().Get(PartialHeader))
+		}
+		assert.Equal(t, int32(2), ranks.calls.Load())
+	})
+}
@@ -0,0 +1,154 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/awnzl/top_currency_checker/lib/apierror"
+	pc "github.com/awnzl/top_currency_checker/lib/proto/pricecollector"
+	rc "github.com/awnzl/top_currency_checker/lib/proto/rankcollector"
+)
+
+type coinDetails struct {
+	Rank      int32    `json:"Rank"`
+	Symbol    string   `json:"Symbol"`
+	Name      string   `json:"Name"`
+	ID        int64    `json:"ID"`
+	Price     *float64 `json:"Price USD"` // null if the price is unknown
+	MarketCap float64  `json:"Market Cap USD"`
+	Change24h float64  `json:"Change 24h %"`
+	RankAsOf  string   `json:"Rank As Of"`
+	PriceAsOf *string  `json:"Price As Of"`
+	Stale     bool     `json:"Stale"`
+}
+
+// coinDetailsV1 is coinDetails with the stable snake_case names of the v1 API
+type coinDetailsV1 struct {
+	Rank      int32    `json:"rank"`
+	Symbol    string   `json:"symbol"`
+	Name      string   `json:"name"`
+	ID        int64    `json:"id"`
+	Price     *float64 `json:"price"`
+	MarketCap float64  `json:"market_cap"`
+	Change24h float64  `json:"change_24h"`
+	RankAsOf  string   `json:"rank_as_of"`
+	PriceAsOf *string  `json:"price_as_of"`
+	Stale     bool     `json:"stale"`
+}
+
+// coinHandler returns the rank, price and details of one currency by its symbol or CoinMarketCap id
+func (h *Handlers) coinHandler(version string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		h.serveCoin(version, w, r)
+	}
+}
+
+func (h *Handlers) serveCoin(version string, w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	var req rc.CoinRequest
+	if id, ok := vars["id"]; ok {
+		var err error
+		if req.ID, err = strconv.ParseInt(id, 10, 64); err != nil || req.ID <= 0 {
+			h.processError(r.Context(), apierror.New(apierror.InvalidID, "invalid id value"), w)
+			return
+		}
+	} else {
+		req.Symbol = strings.ToUpper(vars["symbol"])
+		if !symbolRe.MatchString(req.Symbol) {
+			h.processError(r.Context(), apierror.New(apierror.InvalidSymbol, "invalid symbol value"), w)
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), h.config.Budget)
+	defer cancel()
+
+	type priceResult struct {
+		resp *pc.CoinPriceResponse
+		err  error
+	}
+	priceCh := make(chan priceResult, 1)
+	getPrice := func(symbol string) {
+		resp, err := h.pcClient.GetCoin(ctx, &pc.CoinPriceRequest{Symbol: symbol})
+		priceCh <- priceResult{resp, err}
+	}
+	// the price of a known symbol is requested in parallel with the details
+	if req.Symbol != "" {
+		go getPrice(req.Symbol)
+	}
+
+	rankResp, err := h.rcClient.GetCoin(ctx, &req)
+	if err != nil {
+		h.processError(ctx, err, w)
+		return
+	}
+	if req.Symbol == "" {
+		go getPrice(rankResp.Coin.Symbol)
+	}
+
+	c := rankResp.Coin
+	details := coinDetails{
+		Rank:      c.Rank,
+		Symbol:    c.Symbol,
+		Name:      c.Name,
+		ID:        c.ID,
+		MarketCap: c.MarketCap,
+		Change24h: c.PercentChange24H,
+		RankAsOf:  time.UnixMilli(rankResp.AsOf).UTC().Format(time.RFC3339),
+		Stale:     rankResp.Stale,
+	}
+	asOf := time.UnixMilli(rankResp.AsOf)
+
+	price := <-priceCh
+	partial := false
+	switch {
+	case price.err == nil:
+		details.Price = &price.resp.Price
+		priceAsOf := time.UnixMilli(price.resp.AsOf)
+		formatted := priceAsOf.UTC().Format(time.RFC3339)
+		details.PriceAsOf = &formatted
+		details.Stale = details.Stale || price.resp.Stale
+		if priceAsOf.Before(asOf) {
+			asOf = priceAsOf
+		}
+	case status.Code(price.err) == codes.NotFound:
+		// the currency is ranked, but has no price
+	default:
+		// the details are served without the price, as the lists are without the failed prices
+		h.logger.Warn("coin price failed", zap.String("symbol", c.Symbol), zap.Error(price.err))
+		partial = true
+	}
+
+	var body any = details
+	if version == versionV1 {
+		body = coinDetailsV1(details)
+	}
+	b, err := json.Marshal(body)
+	if err != nil {
+		h.processError(ctx, fmt.Errorf("marshal: %w", err), w)
+		return
+	}
+
+	if partial {
+		w.Header().Set(PartialHeader, "true")
+	}
+	if details.Stale {
+		w.Header().Set(StaleHeader, "true")
+	}
+	w.Header().Set(AsOfHeader, asOf.UTC().Format(time.RFC3339))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(b); err != nil {
+		h.logger.Error("write response", zap.Error(err))
+	}
+}
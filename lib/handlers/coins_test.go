@@ -0,0 +1,81 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+
+	"github.com/awnzl/top_currency_checker/lib/apierror"
+	pc "github.com/awnzl/top_currency_checker/lib/proto/pricecollector"
+)
+
+// unavailablePrices fails the price lookups as the collector without its upstream
+type unavailablePrices struct {
+	fakePrices
+}
+
+func (unavailablePrices) GetCoin(context.Context, *pc.CoinPriceRequest, ...grpc.CallOption) (*pc.CoinPriceResponse, error) {
+	return nil, apierror.Status(codes.Unavailable, apierror.UpstreamUnavailable, "the upstream failed")
+}
+
+func TestCoin(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		target  string
+		prices  pc.PriceServiceClient
+		code    int
+		body    string
+		partial bool
+	}{
+		{name: "found", target: "/v1/coins/btc", code: http.StatusOK,
+			body: `{"rank":1,"symbol":"BTC","name":"Bitcoin","id":1,"price":60000,"market_cap":1e12,"change_24h":1.5}`},
+		{name: "found by id", target: "/v1/coins/id/1027", code: http.StatusOK,
+			body: `{"rank":2,"symbol":"ETH","name":"Ethereum","id":1027,"price":3000,"market_cap":4e11,"change_24h":-0.5}`},
+		{name: "legacy", target: "/coins/BTC", code: http.StatusOK,
+			body: `{"Rank":1,"Symbol":"BTC","Name":"Bitcoin","ID":1,"Price USD":60000,"Market Cap USD":1e12,"Change 24h %":1.5}`},
+		{name: "not found", target: "/v1/coins/NOPE", code: http.StatusNotFound},
+		{name: "invalid symbol", target: "/v1/coins/B-C", code: http.StatusBadRequest},
+		{name: "rank failed", target: "/v1/coins/LIMITED", code: http.StatusTooManyRequests},
+		// the ranked currency without a price has a null one
+		{name: "price not found", target: "/v1/coins/XYZ", code: http.StatusOK,
+			body: `{"rank":3,"symbol":"XYZ","name":"Unpriced","id":9999,"price":null,"price_as_of":null,"market_cap":1e6,"change_24h":0}`},
+		// the failed price doesn't fail the details
+		{name: "price failed", target: "/v1/coins/ETH", prices: unavailablePrices{}, code: http.StatusOK, partial: true,
+			body: `{"rank":2,"symbol":"ETH","name":"Ethereum","id":1027,"price":null,"price_as_of":null,"market_cap":4e11,"change_24h":-0.5}`},
+		{name: "price failed by id", target: "/v1/coins/id/1", prices: unavailablePrices{}, code: http.StatusOK, partial: true,
+			body: `{"rank":1,"symbol":"BTC","name":"Bitcoin","id":1,"price":null,"price_as_of":null,"market_cap":1e12,"change_24h":1.5}`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := newTestHandlers()
+			if tc.prices != nil {
+				h.pcClient = tc.prices
+			}
+			rec := get(routerOf(h), tc.target, nil)
+			require.Equal(t, tc.code, rec.Code, rec.Body.String())
+			if tc.code != http.StatusOK {
+				return
+			}
+
+			// the times of the data are not compared
+			var body map[string]any
+			require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+			var want map[string]any
+			require.NoError(t, json.Unmarshal([]byte(tc.body), &want))
+			for key, value := range want {
+				assert.Equal(t, value, body[key], key)
+			}
+			if tc.partial {
+				assert.Equal(t, "true", rec.Header().Get(PartialHeader))
+			} else {
+				assert.Empty(t, rec.Header().Get(PartialHeader))
+			}
+			assert.NotEmpty(t, rec.Header().Get(AsOfHeader))
+		})
+	}
+}
@@ -2,133 +2,219 @@ package handlers
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
-	"strconv"
+	"time"
 
 	"github.com/gorilla/mux"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
 
+	"github.com/awnzl/top_currency_checker/lib/alerts"
+	"github.com/awnzl/top_currency_checker/lib/apierror"
+	"github.com/awnzl/top_currency_checker/lib/coalesce"
 	pc "github.com/awnzl/top_currency_checker/lib/proto/pricecollector"
 	rc "github.com/awnzl/top_currency_checker/lib/proto/rankcollector"
-	"github.com/awnzl/top_currency_checker/lib/requester"
+	"github.com/awnzl/top_currency_checker/lib/requestid"
 )
 
+const (
+	// PartialHeader is set when not all the prices were received in time
+	PartialHeader = "X-Partial-Result"
+	// StaleHeader is set when the ranks or some of the prices are served from the last good snapshots
+	StaleHeader = "X-Data-Stale"
+	// AsOfHeader is the time of the oldest data in the response
+	AsOfHeader = "X-Data-As-Of"
+)
+
+type Config struct {
+	// Budget is the overall time of a request, including the calls to the collectors
+	Budget time.Duration
+	// CacheTTL is the time the rendered responses are reused, 0 disables the cache
+	CacheTTL time.Duration
+	// ScanSize is the number of the top coins the price filters and the sorting by price are applied to,
+	// all their prices are requested; 0 scans the whole retained listing
+	ScanSize int
+}
+
 type Handlers struct {
 	logger   *zap.Logger
+	config   Config
 	pcClient pc.PriceServiceClient
 	rcClient rc.RankServiceClient
+	recent   recentSymbols
+	cache    *responseCache
+	flights  *coalesce.Group
+	alerts   *alerts.Manager
 }
 
-func New(log *zap.Logger, pcConn, rcConn *grpc.ClientConn) *Handlers {
+func New(log *zap.Logger, conf Config, pcConn, rcConn *grpc.ClientConn) *Handlers {
 	return &Handlers{
-		logger: log,
+		logger:   log,
+		config:   conf,
+		cache:    newResponseCache(conf.CacheTTL),
+		flights:  coalesce.New("handler_top"),
 		pcClient: pc.NewPriceServiceClient(pcConn),
 		rcClient: rc.NewRankServiceClient(rcConn),
 	}
 }
 
 func (h *Handlers) RegisterHandlers(router *mux.Router, mwFuncs ...mux.MiddlewareFunc) {
-	router.HandleFunc("/", h.rootHandler)
+	// the legacy routes are kept for the compatibility, see the v1 ones
+	router.HandleFunc("/", h.topHandler(versionLegacy))
+	router.HandleFunc("/coins/id/{id}", h.coinHandler(versionLegacy)).Methods(http.MethodGet)
+	router.HandleFunc("/coins/{symbol}", h.coinHandler(versionLegacy)).Methods(http.MethodGet)
+
+	v1 := router.PathPrefix("/" + versionV1).Subrouter()
+	v1.HandleFunc("/top", h.topHandler(versionV1)).Methods(http.MethodGet)
+	v1.HandleFunc("/coins/id/{id}", h.coinHandler(versionV1)).Methods(http.MethodGet)
+	v1.HandleFunc("/coins/{symbol}", h.coinHandler(versionV1)).Methods(http.MethodGet)
+	v1.HandleFunc("/prices", h.pricesHandler).Methods(http.MethodGet)
+	v1.HandleFunc("/openapi.json", h.openAPIHandler).Methods(http.MethodGet)
+	if h.alerts != nil {
+		h.registerAlerts(v1)
+	}
+
 	router.Use(mwFuncs...)
 }
 
-func (h *Handlers) rootHandler(w http.ResponseWriter, r *http.Request) {
-	var err error
-	limit := 100
-
-	if lim := r.URL.Query().Get("limit"); lim != "" {
-		if limit, err = strconv.Atoi(lim); err != nil {
-			h.logger.Error(err.Error())
-			h.writeError("system", "invalid limit value", http.StatusBadRequest, w)
-			return
-		}
+// topHandler returns the top coins list of the API version
+func (h *Handlers) topHandler(version string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		h.serveTop(version, w, r)
 	}
+}
 
-	// get currencies rank information
-	rankResp, err := h.rcClient.GetRanks(context.Background(), &rc.RankRequest{Limit: int32(limit+50)})
+func (h *Handlers) serveTop(version string, w http.ResponseWriter, r *http.Request) {
+	query, err := parseTopQuery(r, version)
 	if err != nil {
-		h.processError(err, w)
+		h.processError(r.Context(), err, w)
 		return
 	}
-	h.logger.Info("rankResp", zap.Any("currencies number", len(rankResp.List)), zap.Any("currencies", rankResp.List))
 
-	// get prices for the currencies
-	priceResp, err := h.pcClient.GetPrices(context.Background(), &pc.PriceRequest{List: rankResp.List})
-	if err != nil {
-		h.processError(err, w)
+	if cached, ok := h.cache.get(query.cacheKey()); ok {
+		cached.write(w, r, h.logger)
 		return
 	}
-	h.logger.Info("priceResp", zap.Any("currencies number", len(priceResp.Prices)), zap.Any("currencies", priceResp.Prices))
 
-	list := rankResp.List
-	if len(rankResp.List) > limit {
-		list = rankResp.List[:limit]
-	}
-	h.handleResponse(list, priceResp.Prices, w)
-}
+	// the deadline is propagated to the collectors, client disconnects cancel the calls
+	ctx, cancel := context.WithTimeout(r.Context(), h.config.Budget)
+	defer cancel()
 
-func (h *Handlers) processError(err error, w http.ResponseWriter) {
-	if err == requester.RateLimitError {
-		h.writeError("system", err.Error(), http.StatusTooManyRequests, w)
+	// the concurrent identical requests share one build
+	resp, err := coalesce.Do(ctx, h.flights, query.cacheKey(), func(ctx context.Context) (*cachedResponse, error) {
+		return h.buildTop(ctx, query)
+	})
+	if err != nil {
+		h.processError(ctx, err, w)
 		return
 	}
-	h.logger.Error(err.Error())
-	h.writeError("system", err.Error(), http.StatusInternalServerError, w)
+	resp.write(w, r, h.logger)
 }
 
-func (h *Handlers) handleResponse(rankList []string, prices map[string]float64, w http.ResponseWriter) {
-	// Rank, Symbol, Price USD
-	type data struct {
-		Rank int `json:"Rank"`
-		Symbol string `json:"Symbol"`
-		Price float64 `json:"Price USD"`
+// buildTop requests the ranks and prices and renders the response, complete responses are cached
+func (h *Handlers) buildTop(ctx context.Context, query topQuery) (*cachedResponse, error) {
+	// get currencies rank information and the prices for the currencies
+	var rankResp *rc.RankResponse
+	var priceResp *pc.PriceResponse
+	var err error
+	if query.scan() {
+		rankResp, priceResp, err = h.getFilteredRanksAndPrices(ctx, query)
+	} else {
+		rankResp, priceResp, err = h.getRanksAndPrices(ctx, &rc.RankRequest{Start: int32(query.offset + 1), Limit: int32(query.limit)})
 	}
-
-	var result []data
-	for rank, symbol := range rankList {
-		result = append(result, data{
-			Rank: rank + 1,
-			Symbol: symbol,
-			Price: prices[symbol],
-		})
+	if err != nil {
+		return nil, err
 	}
+	h.logger.Info("priceResp", zap.Int("currencies number", len(priceResp.Prices)))
+	h.logger.Debug("priceResp", zap.Any("currencies", priceResp.Prices))
 
-	b, err := json.Marshal(result)
+	coins := mergeCoins(rankResp, priceResp)
+	if query.pricedScan() {
+		coins = query.page(coins)
+	}
+	body, contentType, err := render(coins, query.format, query.fields, query.version)
 	if err != nil {
-		h.logger.Error(err.Error())
-		h.writeError("system", "internal server error", http.StatusInternalServerError, w)
-		return
+		return nil, fmt.Errorf("render: %w", err)
 	}
 
-	h.writeResponse(b, w)
+	lastModified := time.UnixMilli(max(rankResp.AsOf, priceResp.AsOf))
+	oldest := time.UnixMilli(rankResp.AsOf)
+	for _, c := range coins {
+		if c.Price != nil && c.AsOf.Before(oldest) {
+			oldest = c.AsOf
+		}
+	}
+	stale := rankResp.Stale || priceResp.Stale
+	if stale {
+		h.logger.Warn("stale data", zap.Bool("ranks", rankResp.Stale), zap.Int("prices", len(priceResp.StaleAsOf)), zap.Time("as of", oldest))
+	}
+
+	if priceResp.Partial {
+		// the ranks are complete, the prices which didn't make it are null;
+		// incomplete responses are not cached
+		h.logger.Warn("partial prices", zap.Int("received", len(priceResp.Prices)), zap.Int("requested", len(rankResp.List)), zap.Int("failed", len(priceResp.Errors)))
+		resp := newCachedResponse(body, contentType, lastModified, 0)
+		resp.partial, resp.stale, resp.asOf = true, stale, oldest
+		return resp, nil
+	}
+
+	resp := newCachedResponse(body, contentType, lastModified, h.config.CacheTTL)
+	resp.stale, resp.asOf = stale, oldest
+	h.cache.set(query.cacheKey(), resp)
+	return resp, nil
 }
 
-func (h *Handlers) writeError(lvl, msg string, status int, w http.ResponseWriter) {
-	w.WriteHeader(status)
-
-	b, err := json.Marshal(
-		struct {
-			Level string `json:"Level,omitempty"`
-			Error string `json:"Error,omitempty"`
-		}{
-			lvl, msg,
-		},
-	)
-	if err != nil {
-		h.logger.Error("marshal", zap.Error(err))
+// processError sends the error envelope, the codes and statuses of the collector errors are kept
+func (h *Handlers) processError(ctx context.Context, err error, w http.ResponseWriter) {
+	switch {
+	case errors.Is(ctx.Err(), context.Canceled):
+		// the client is gone, nobody reads the response
+		h.logger.Info("request canceled by the client", zap.Error(err))
 		return
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		err = status.FromContextError(ctx.Err()).Err()
 	}
 
-	if _, err := w.Write(b); err != nil {
-		h.logger.Error("write error response", zap.Error(err))
+	code, httpStatus, msg := apierror.FromError(err)
+	fields := []zap.Field{zap.String("code", string(code)), zap.String("RequestID", requestid.FromContext(ctx)), zap.Error(err)}
+	if httpStatus >= http.StatusInternalServerError {
+		h.logger.Error("request failed", fields...)
+	} else {
+		h.logger.Info("request rejected", fields...)
+	}
+	if err := apierror.Write(ctx, w, httpStatus, code, msg); err != nil {
+		h.logger.Error("write response", zap.Error(err))
 	}
 }
 
-func (h *Handlers) writeResponse(b []byte, w http.ResponseWriter) {
-	w.WriteHeader(http.StatusOK)
-	if _, err := w.Write(b); err != nil {
-		h.logger.Error("write response", zap.Error(err))
+// mergeCoins joins the ranked currencies with their prices
+func mergeCoins(rankResp *rc.RankResponse, priceResp *pc.PriceResponse) []coin {
+	coins := make([]coin, 0, len(rankResp.List))
+	for i, symbol := range rankResp.List {
+		var price *float64
+		if p, ok := priceResp.Prices[symbol]; ok {
+			price = &p
+		}
+		asOf, stale := priceResp.StaleAsOf[symbol]
+		if !stale {
+			asOf = priceResp.AsOf
+		}
+		c := coin{
+			Rank:   i + 1,
+			Symbol: symbol,
+			Price:  price,
+			AsOf:   time.UnixMilli(asOf),
+			Stale:  stale || rankResp.Stale,
+		}
+		if i < len(rankResp.Coins) {
+			c.Rank = int(rankResp.Coins[i].Rank)
+			c.MarketCap = rankResp.Coins[i].MarketCap
+			c.Change24h = rankResp.Coins[i].PercentChange24H
+		}
+		coins = append(coins, c)
 	}
+	return coins
 }
@@ -0,0 +1,387 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+
+	"github.com/awnzl/top_currency_checker/lib/alerts"
+	"github.com/awnzl/top_currency_checker/lib/apierror"
+	"github.com/awnzl/top_currency_checker/lib/coalesce"
+	"github.com/awnzl/top_currency_checker/lib/middleware"
+	pc "github.com/awnzl/top_currency_checker/lib/proto/pricecollector"
+	rc "github.com/awnzl/top_currency_checker/lib/proto/rankcollector"
+)
+
+var testCoins = []*rc.Coin{
+	{Symbol: "BTC", Rank: 1, Name: "Bitcoin", ID: 1, MarketCap: 1e12, PercentChange24H: 1.5},
+	{Symbol: "ETH", Rank: 2, Name: "Ethereum", ID: 1027, MarketCap: 4e11, PercentChange24H: -0.5},
+	{Symbol: "XYZ", Rank: 3, Name: "Unpriced", ID: 9999, MarketCap: 1e6},
+}
+
+var testPrices = map[string]float64{"BTC": 60000, "ETH": 3000}
+
+type fakeRanks struct{}
+
+func (fakeRanks) GetRanks(_ context.Context, req *rc.RankRequest, _ ...grpc.CallOption) (*rc.RankResponse, error) {
+	start := max(int(req.Start), 1) - 1
+	end := len(testCoins)
+	if req.Limit > 0 {
+		end = min(start+int(req.Limit), end)
+	}
+	coins := testCoins[min(start, end):end]
+	return &rc.RankResponse{List: symbols(coins), Coins: coins, AsOf: time.Now().UnixMilli()}, nil
+}
+
+func (fakeRanks) GetCoin(_ context.Context, req *rc.CoinRequest, _ ...grpc.CallOption) (*rc.CoinResponse, error) {
+	if req.Symbol == "LIMITED" {
+		return nil, apierror.Status(codes.ResourceExhausted, apierror.RateLimited, "rate limit exceeded")
+	}
+	for _, c := range testCoins {
+		if c.ID == req.ID || strings.EqualFold(c.Symbol, req.Symbol) {
+			return &rc.CoinResponse{Coin: c, AsOf: time.Now().UnixMilli()}, nil
+		}
+	}
+	return nil, apierror.Status(codes.NotFound, apierror.NotFound, "not found")
+}
+
+type fakePrices struct{}
+
+func (fakePrices) GetPrices(_ context.Context, req *pc.PriceRequest, _ ...grpc.CallOption) (*pc.PriceResponse, error) {
+	prices := map[string]float64{}
+	for _, symbol := range req.List {
+		if p, ok := testPrices[symbol]; ok {
+			prices[symbol] = p
+		}
+	}
+	return &pc.PriceResponse{Prices: prices, AsOf: time.Now().UnixMilli()}, nil
+}
+
+func (fakePrices) GetCoin(_ context.Context, req *pc.CoinPriceRequest, _ ...grpc.CallOption) (*pc.CoinPriceResponse, error) {
+	p, ok := testPrices[req.Symbol]
+	if !ok {
+		return nil, apierror.Status(codes.NotFound, apierror.NotFound, "not found")
+	}
+	return &pc.CoinPriceResponse{Symbol: req.Symbol, Price: p, AsOf: time.Now().UnixMilli()}, nil
+}
+
+func symbols(coins []*rc.Coin) []string {
+	var list []string
+	for _, c := range coins {
+		list = append(list, c.Symbol)
+	}
+	return list
+}
+
+func newTestHandlers() *Handlers {
+	h := &Handlers{
+		logger:   zap.NewNop(),
+		config:   Config{Budget: time.Second, ScanSize: 10},
+		pcClient: fakePrices{},
+		rcClient: fakeRanks{},
+		cache:    newResponseCache(0),
+		flights:  coalesce.New("handler_top_test"),
+	}
+	manager, err := alerts.New(zap.NewNop(), alerts.Config{Enabled: true, Interval: time.Second}, fakePrices{}, fakeRanks{})
+	if err != nil {
+		panic(err)
+	}
+	h.SetAlerts(manager)
+	return h
+}
+
+func newTestRouter(mwFuncs ...mux.MiddlewareFunc) *mux.Router {
+	return routerOf(newTestHandlers(), mwFuncs...)
+}
+
+func routerOf(h *Handlers, mwFuncs ...mux.MiddlewareFunc) *mux.Router {
+	router := mux.NewRouter()
+	h.RegisterHandlers(router, mwFuncs...)
+	return router
+}
+
+// asClient authenticates every request as the client
+func asClient(name string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, r.WithContext(middleware.WithClient(r.Context(), name)))
+		})
+	}
+}
+
+// TestOpenAPIContract validates the live v1 responses against the served OpenAPI document
+func TestOpenAPIContract(t *testing.T) {
+	router := newTestRouter(asClient("tester"))
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/openapi.json", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	var spec map[string]any
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &spec))
+
+	// the alert of the cases below
+	rec = httptest.NewRecorder()
+	body := `{"symbol":"btc","kind":"change","percent":5,"window":"1h","url":"https://example.com/hook"}`
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/v1/alerts", strings.NewReader(body)))
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	var created map[string]any
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &created))
+	assert.NoError(t, validate(spec, responseSchema(t, spec, "/alerts", http.MethodPost, http.StatusCreated), created, "body"))
+	assert.NotEmpty(t, created["secret"])
+	alert := "/v1/alerts/" + created["id"].(string)
+	assert.Equal(t, alert, rec.Header().Get("Location"))
+
+	cases := []struct {
+		uri, path string
+		status    int
+		code      apierror.Code
+	}{
+		{"/v1/top", "/top", http.StatusOK, ""},
+		{"/v1/top?limit=2&fields=rank,symbol,price,market_cap,change_24h,as_of,stale", "/top", http.StatusOK, ""},
+		{"/v1/top?sort=price&min_market_cap=1", "/top", http.StatusOK, ""},
+		{"/v1/top?limit=0", "/top", http.StatusBadRequest, apierror.InvalidLimit},
+		{"/v1/coins/btc", "/coins/{symbol}", http.StatusOK, ""},
+		{"/v1/coins/XYZ", "/coins/{symbol}", http.StatusOK, ""},
+		{"/v1/coins/NOPE", "/coins/{symbol}", http.StatusNotFound, apierror.NotFound},
+		{"/v1/coins/LIMITED", "/coins/{symbol}", http.StatusTooManyRequests, apierror.RateLimited},
+		{"/v1/coins/id/1027", "/coins/id/{id}", http.StatusOK, ""},
+		{"/v1/coins/id/5", "/coins/id/{id}", http.StatusNotFound, apierror.NotFound},
+		{"/v1/prices?symbols=BTC,xyz", "/prices", http.StatusOK, ""},
+		{"/v1/prices", "/prices", http.StatusBadRequest, apierror.InvalidSymbol},
+		{"/v1/alerts", "/alerts", http.StatusOK, ""},
+		{alert, "/alerts/{id}", http.StatusOK, ""},
+		{"/v1/alerts/nope", "/alerts/{id}", http.StatusNotFound, apierror.NotFound},
+		{alert + "/deliveries", "/alerts/{id}/deliveries", http.StatusOK, ""},
+	}
+	for _, tc := range cases {
+		t.Run(tc.uri, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tc.uri, nil))
+			require.Equal(t, tc.status, rec.Code, rec.Body.String())
+			assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+
+			schema := responseSchema(t, spec, tc.path, http.MethodGet, tc.status)
+			var body any
+			require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+			assert.NoError(t, validate(spec, schema, body, "body"))
+			if tc.code != "" {
+				assert.Equal(t, string(tc.code), lookup(body, "error", "code"))
+			}
+		})
+	}
+}
+
+func TestLegacyAlias(t *testing.T) {
+	router := newTestRouter()
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/?limit=2", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `[{"Rank":1,"Symbol":"BTC","Price USD":60000},{"Rank":2,"Symbol":"ETH","Price USD":3000}]`, rec.Body.String())
+
+	// the baseline encoding: 0 for the unknown prices and null for no coins
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/?start=3&limit=1", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, `[{"Rank":3,"Symbol":"XYZ","Price USD":0}]`, rec.Body.String())
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/?start=10&limit=2", nil))
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Equal(t, `null`, rec.Body.String())
+
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/top?limit=2", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `[{"rank":1,"symbol":"BTC","price":60000},{"rank":2,"symbol":"ETH","price":3000}]`, rec.Body.String())
+
+	// v1 has null for the unknown prices and an empty list for no coins
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/top?offset=2&limit=1", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `[{"rank":3,"symbol":"XYZ","price":null}]`, rec.Body.String())
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/top?offset=10&limit=2", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `[]`, rec.Body.String())
+}
+
+func responseSchema(t *testing.T, spec map[string]any, path, method string, code int) map[string]any {
+	t.Helper()
+	op, ok := lookup(spec, "paths", path, strings.ToLower(method)).(map[string]any)
+	require.True(t, ok, "no operation %s", path)
+	resp, ok := resolve(spec, lookup(op, "responses", fmt.Sprint(code))).(map[string]any)
+	require.True(t, ok, "no response %d of %s", code, path)
+	schema, ok := lookup(resp, "content", "application/json", "schema").(map[string]any)
+	require.True(t, ok, "no json schema of the response %d of %s", code, path)
+	return schema
+}
+
+func lookup(v any, keys ...string) any {
+	for _, k := range keys {
+		m, ok := v.(map[string]any)
+		if !ok {
+			return nil
+		}
+		v = m[k]
+	}
+	return v
+}
+
+// resolve follows the local $ref of the spec
+func resolve(spec map[string]any, v any) any {
+	m, ok := v.(map[string]any)
+	if !ok {
+		return v
+	}
+	ref, ok := m["$ref"].(string)
+	if !ok {
+		return v
+	}
+	return resolve(spec, lookup(spec, strings.Split(strings.TrimPrefix(ref, "#/"), "/")...))
+}
+
+// validate checks the subset of the OpenAPI schema keywords the spec uses
+func validate(spec map[string]any, s any, v any, at string) error {
+	schema, ok := resolve(spec, s).(map[string]any)
+	if !ok {
+		return fmt.Errorf("%s: invalid schema", at)
+	}
+	if v == nil {
+		if schema["nullable"] == true {
+			return nil
+		}
+		return fmt.Errorf("%s: null is not allowed", at)
+	}
+	if enum, ok := schema["enum"].([]any); ok {
+		found := false
+		for _, e := range enum {
+			found = found || e == v
+		}
+		if !found {
+			return fmt.Errorf("%s: %v is not one of %v", at, v, enum)
+		}
+	}
+
+	switch schema["type"] {
+	case "object":
+		obj, ok := v.(map[string]any)
+		if !ok {
+			return fmt.Errorf("%s: not an object", at)
+		}
+		props, _ := schema["properties"].(map[string]any)
+		required, _ := schema["required"].([]any)
+		for _, name := range required {
+			if _, ok := obj[name.(string)]; !ok {
+				return fmt.Errorf("%s: missing %s", at, name)
+			}
+		}
+		for name, value := range obj {
+			prop, ok := props[name]
+			if !ok {
+				if schema["additionalProperties"] == false {
+					return fmt.Errorf("%s: unexpected %s", at, name)
+				}
+				continue
+			}
+			if err := validate(spec, prop, value, at+"."+name); err != nil {
+				return err
+			}
+		}
+	case "array":
+		arr, ok := v.([]any)
+		if !ok {
+			return fmt.Errorf("%s: not an array", at)
+		}
+		for i, item := range arr {
+			if err := validate(spec, schema["items"], item, fmt.Sprintf("%s[%d]", at, i)); err != nil {
+				return err
+			}
+		}
+	case "string":
+		str, ok := v.(string)
+		if !ok {
+			return fmt.Errorf("%s: not a string", at)
+		}
+		if schema["format"] == "date-time" {
+			if _, err := time.Parse(time.RFC3339, str); err != nil {
+				return fmt.Errorf("%s: not a date-time: %v", at, err)
+			}
+		}
+	case "integer":
+		n, ok := v.(float64)
+		if !ok || n != float64(int64(n)) {
+			return fmt.Errorf("%s: not an integer", at)
+		}
+	case "number":
+		if _, ok := v.(float64); !ok {
+			return fmt.Errorf("%s: not a number", at)
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			return fmt.Errorf("%s: not a boolean", at)
+		}
+	}
+	return nil
+}
+
+func TestAlertsAPI(t *testing.T) {
+	h := newTestHandlers()
+	owner, other, anonymous := routerOf(h, asClient("owner")), routerOf(h, asClient("other")), routerOf(h)
+	doAs := func(router *mux.Router, method, uri, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(method, uri, strings.NewReader(body)))
+		return rec
+	}
+	do := func(method, uri, body string) *httptest.ResponseRecorder {
+		return doAs(owner, method, uri, body)
+	}
+
+	rec := do(http.MethodPost, "/v1/alerts", `{"symbol":"BTC","kind":"above","threshold":70000,"url":"https://example.com/hook"}`)
+	require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	var created alerts.Alert
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &created))
+	uri := "/v1/alerts/" + created.ID
+
+	// the secret is not returned again
+	rec = do(http.MethodGet, uri, "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.NotContains(t, rec.Body.String(), "secret")
+
+	// the alerts of the other keys are not found, the callers without a key are refused
+	assert.Equal(t, http.StatusNotFound, doAs(other, http.MethodGet, uri, "").Code)
+	assert.Equal(t, http.StatusNotFound, doAs(other, http.MethodPut, uri, `{"symbol":"BTC","kind":"above","threshold":1,"url":"https://evil.example.com/hook"}`).Code)
+	assert.Equal(t, http.StatusNotFound, doAs(other, http.MethodDelete, uri, "").Code)
+	assert.JSONEq(t, `[]`, doAs(other, http.MethodGet, "/v1/alerts", "").Body.String())
+	for _, method := range []string{http.MethodGet, http.MethodPut, http.MethodDelete} {
+		rec = doAs(anonymous, method, uri, `{"symbol":"BTC","kind":"above","threshold":1,"url":"https://evil.example.com/hook"}`)
+		assert.Equal(t, http.StatusUnauthorized, rec.Code, method)
+		assert.Contains(t, rec.Body.String(), string(apierror.Unauthorized))
+	}
+	assert.Equal(t, http.StatusUnauthorized, doAs(anonymous, http.MethodGet, "/v1/alerts", "").Code)
+
+	rec = do(http.MethodPut, uri, `{"symbol":"SOL","kind":"enters_top","rank":5,"url":"https://example.com/hook"}`)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Contains(t, rec.Body.String(), `"rank":5`)
+
+	rec = do(http.MethodPost, "/v1/alerts", `{"symbol":"BTC","kind":"above","url":"https://example.com/hook"}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, rec.Body.String(), string(apierror.InvalidAlert))
+	rec = do(http.MethodPost, "/v1/alerts", `{"symbol":"BTC","kind":"above","threshold":1,"url":"https://example.com/hook","owner_id":1}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	assert.Equal(t, http.StatusNoContent, do(http.MethodDelete, uri, "").Code)
+	assert.Equal(t, http.StatusNotFound, do(http.MethodGet, uri, "").Code)
+	assert.JSONEq(t, `[]`, do(http.MethodGet, "/v1/alerts", "").Body.String())
+}
@@ -0,0 +1,211 @@
+package handlers
+
+import (
+	"context"
+	"expvar"
+	"sync"
+
+	"go.uber.org/zap"
+
+	pc "github.com/awnzl/top_currency_checker/lib/proto/pricecollector"
+	rc "github.com/awnzl/top_currency_checker/lib/proto/rankcollector"
+)
+
+// outcomes of the speculative price requests: hit, reconciled, miss
+var speculativePrices = expvar.NewMap("speculative_prices")
+
+// recentSymbols keeps the last received ranked lists by the start rank, they are used
+// to request the prices before the fresh ranks arrive
+type recentSymbols struct {
+	mu    sync.Mutex
+	lists map[int32][]string
+}
+
+// get returns up to n of the recently ranked symbols starting from start
+func (rs *recentSymbols) get(start int32, n int) []string {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	list := rs.lists[start]
+	return list[:min(n, len(list))]
+}
+
+func (rs *recentSymbols) set(start int32, list []string) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if rs.lists == nil {
+		rs.lists = make(map[int32][]string)
+	}
+	// the list is replaced only by the same or a longer one, so the requests with
+	// small limits don't shrink the speculative set of the bigger ones
+	if len(list) >= len(rs.lists[start]) {
+		rs.lists[start] = list
+	}
+}
+
+// getRanksAndPrices requests the prices of the recently ranked symbols in parallel with the ranks.
+// When the fresh ranking differs, only the prices of the newly entered symbols are requested
+// after the ranks arrive, so the latency is close to the max of the two calls rather than their sum.
+func (h *Handlers) getRanksAndPrices(ctx context.Context, rankReq *rc.RankRequest) (*rc.RankResponse, *pc.PriceResponse, error) {
+	type priceResult struct {
+		resp *pc.PriceResponse
+		err  error
+	}
+
+	speculative := h.recent.get(rankReq.Start, int(rankReq.Limit))
+	specCh := make(chan priceResult, 1)
+	if len(speculative) > 0 {
+		go func() {
+			resp, err := h.pcClient.GetPrices(ctx, &pc.PriceRequest{List: speculative})
+			specCh <- priceResult{resp, err}
+		}()
+	}
+
+	rankResp, err := h.rcClient.GetRanks(ctx, rankReq)
+	if err != nil {
+		return nil, nil, err
+	}
+	h.logger.Info("rankResp", zap.Int("currencies number", len(rankResp.List)))
+	h.logger.Debug("rankResp", zap.Strings("currencies", rankResp.List))
+	h.recent.set(rankReq.Start, rankResp.List)
+
+	requested := make(map[string]bool, len(speculative))
+	for _, symbol := range speculative {
+		requested[symbol] = true
+	}
+	var missing []string
+	for _, symbol := range rankResp.List {
+		if !requested[symbol] {
+			missing = append(missing, symbol)
+		}
+	}
+
+	// the newly entered symbols are requested while the speculative request is in flight
+	missingCh := make(chan priceResult, 1)
+	if len(missing) > 0 && len(missing) < len(rankResp.List) {
+		go func() {
+			resp, err := h.pcClient.GetPrices(ctx, &pc.PriceRequest{List: missing})
+			missingCh <- priceResult{resp, err}
+		}()
+	}
+
+	if len(speculative) == 0 || len(missing) == len(rankResp.List) {
+		// nothing to reuse, the speculative request (if any) is left to finish on its own
+		speculativePrices.Add("miss", 1)
+		return h.getAllPrices(ctx, rankResp)
+	}
+
+	spec := <-specCh
+	if spec.err != nil {
+		h.logger.Warn("speculative prices request failed", zap.Error(spec.err))
+		speculativePrices.Add("miss", 1)
+		return h.getAllPrices(ctx, rankResp)
+	}
+
+	prices := spec.resp
+	if len(missing) == 0 {
+		speculativePrices.Add("hit", 1)
+		return rankResp, forSymbols(prices, rankResp.List), nil
+	}
+
+	res := <-missingCh
+	if res.err != nil {
+		return nil, nil, res.err
+	}
+	speculativePrices.Add("reconciled", 1)
+	h.logger.Info("reconciled speculative prices", zap.Int("new symbols", len(missing)))
+	for symbol, price := range res.resp.Prices {
+		prices.Prices[symbol] = price
+	}
+	for symbol, asOf := range res.resp.StaleAsOf {
+		if prices.StaleAsOf == nil {
+			prices.StaleAsOf = map[string]int64{}
+		}
+		prices.StaleAsOf[symbol] = asOf
+	}
+	prices.Errors = append(prices.Errors, res.resp.Errors...)
+	// the older of the two snapshots limits the freshness
+	prices.AsOf = min(prices.AsOf, res.resp.AsOf)
+	return rankResp, forSymbols(prices, rankResp.List), nil
+}
+
+// forSymbols drops the prices, the stale marks and the errors of the symbols which left the ranking,
+// so only the ranked ones make the response partial or stale
+func forSymbols(prices *pc.PriceResponse, list []string) *pc.PriceResponse {
+	ranked := make(map[string]bool, len(list))
+	for _, symbol := range list {
+		ranked[symbol] = true
+	}
+	for symbol := range prices.Prices {
+		if !ranked[symbol] {
+			delete(prices.Prices, symbol)
+		}
+	}
+	for symbol := range prices.StaleAsOf {
+		if !ranked[symbol] {
+			delete(prices.StaleAsOf, symbol)
+		}
+	}
+	errs := prices.Errors[:0]
+	for _, e := range prices.Errors {
+		if ranked[e.Symbol] {
+			errs = append(errs, e)
+		}
+	}
+	prices.Errors = errs
+	// the collector marks the response partial when a price failed, stale or not
+	prices.Partial = len(prices.Errors) > 0 || len(prices.StaleAsOf) > 0
+	prices.Stale = len(prices.StaleAsOf) > 0
+	return prices
+}
+
+func (h *Handlers) getAllPrices(ctx context.Context, rankResp *rc.RankResponse) (*rc.RankResponse, *pc.PriceResponse, error) {
+	priceResp, err := h.pcClient.GetPrices(ctx, &pc.PriceRequest{List: rankResp.List})
+	if err != nil {
+		return nil, nil, err
+	}
+	return rankResp, priceResp, nil
+}
+
+// getFilteredRanksAndPrices filters and sorts the retained listing. Sorted by the rank data, the page is
+// known before the prices and only its prices are requested; the price filters and the sorting by price
+// need the prices of all the scanned coins, so the scan is limited to the top ScanSize coins.
+func (h *Handlers) getFilteredRanksAndPrices(ctx context.Context, query topQuery) (*rc.RankResponse, *pc.PriceResponse, error) {
+	rankReq := &rc.RankRequest{Start: 1}
+	if query.pricedScan() {
+		rankReq.Limit = int32(h.config.ScanSize)
+	}
+	listing, err := h.rcClient.GetRanks(ctx, rankReq)
+	if err != nil {
+		return nil, nil, err
+	}
+	h.logger.Info("rankResp", zap.Int("currencies number", len(listing.List)))
+
+	rankResp := &rc.RankResponse{AsOf: listing.AsOf, Stale: listing.Stale}
+	for _, c := range listing.Coins {
+		if query.matchCoin(c) {
+			rankResp.Coins = append(rankResp.Coins, c)
+			rankResp.List = append(rankResp.List, c.Symbol)
+		}
+	}
+	if !query.pricedScan() {
+		rankResp = rankPage(rankResp, query.page(mergeCoins(rankResp, &pc.PriceResponse{})))
+	}
+	if len(rankResp.List) == 0 {
+		return rankResp, &pc.PriceResponse{AsOf: listing.AsOf}, nil
+	}
+	return h.getAllPrices(ctx, rankResp)
+}
+
+// rankPage returns the ranked coins of the page in its order
+func rankPage(rankResp *rc.RankResponse, page []coin) *rc.RankResponse {
+	byRank := make(map[int]*rc.Coin, len(rankResp.Coins))
+	for _, c := range rankResp.Coins {
+		byRank[int(c.Rank)] = c
+	}
+	resp := &rc.RankResponse{AsOf: rankResp.AsOf, Stale: rankResp.Stale}
+	for _, c := range page {
+		resp.Coins = append(resp.Coins, byRank[c.Rank])
+		resp.List = append(resp.List, c.Symbol)
+	}
+	return resp
+}
@@ -0,0 +1,219 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+
+	pc "github.com/awnzl/top_currency_checker/lib/proto/pricecollector"
+	rc "github.com/awnzl/top_currency_checker/lib/proto/rankcollector"
+)
+
+// rankings returns the next of its lists on each call, the last one is repeated
+type rankings struct {
+	fakeRanks
+	mu    sync.Mutex
+	lists [][]string
+}
+
+func (r *rankings) GetRanks(context.Context, *rc.RankRequest, ...grpc.CallOption) (*rc.RankResponse, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	list := r.lists[0]
+	if len(r.lists) > 1 {
+		r.lists = r.lists[1:]
+	}
+	return &rc.RankResponse{List: list, AsOf: time.Now().UnixMilli()}, nil
+}
+
+// failingPrices prices every symbol but the failing one, which gets an error
+type failingPrices struct {
+	fakePrices
+	failing string
+}
+
+func (f failingPrices) GetPrices(_ context.Context, req *pc.PriceRequest, _ ...grpc.CallOption) (*pc.PriceResponse, error) {
+	resp := &pc.PriceResponse{Prices: map[string]float64{}, AsOf: time.Now().UnixMilli()}
+	for _, symbol := range req.List {
+		if symbol == f.failing {
+			resp.Partial = true
+			resp.Errors = append(resp.Errors, &pc.SymbolError{Symbol: symbol, Code: "UPSTREAM_UNAVAILABLE"})
+			continue
+		}
+		resp.Prices[symbol] = 1
+	}
+	return resp, nil
+}
+
+// recordingPrices records the requested lists, the first request fails if failNext is set
+type recordingPrices struct {
+	failingPrices
+	failNext atomic.Bool
+	mu       sync.Mutex
+	lists    [][]string
+}
+
+func (r *recordingPrices) GetPrices(ctx context.Context, req *pc.PriceRequest, opts ...grpc.CallOption) (*pc.PriceResponse, error) {
+	r.mu.Lock()
+	r.lists = append(r.lists, req.List)
+	r.mu.Unlock()
+	if r.failNext.CompareAndSwap(true, false) {
+		return nil, errors.New("collector unavailable")
+	}
+	return r.failingPrices.GetPrices(ctx, req, opts...)
+}
+
+// requested returns the lists requested since the last call
+func (r *recordingPrices) requested() [][]string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	lists := r.lists
+	r.lists = nil
+	return lists
+}
+
+func speculativeCount(outcome string) int64 {
+	if v, ok := speculativePrices.Get(outcome).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+func TestSpeculativeOutcomes(t *testing.T) {
+	ranks := &rankings{lists: [][]string{{"A", "B", "C"}, {"A", "B", "C"}, {"A", "B", "D"}, {"X", "Y", "Z"}}}
+	prices := &recordingPrices{}
+	h := &Handlers{logger: zap.NewNop(), rcClient: ranks, pcClient: prices}
+	req := &rc.RankRequest{Start: 1, Limit: 3}
+
+	counts := func() map[string]int64 {
+		return map[string]int64{"hit": speculativeCount("hit"), "miss": speculativeCount("miss"), "reconciled": speculativeCount("reconciled")}
+	}
+	step := func(outcome string, list []string, requested ...[]string) {
+		t.Helper()
+		before := counts()
+		rankResp, priceResp, err := h.getRanksAndPrices(context.Background(), req)
+		require.NoError(t, err)
+		assert.Equal(t, list, rankResp.List)
+		want := map[string]float64{}
+		for _, symbol := range list {
+			want[symbol] = 1
+		}
+		assert.Equal(t, want, priceResp.Prices)
+		assert.False(t, priceResp.Partial)
+
+		after := counts()
+		for _, o := range []string{"hit", "miss", "reconciled"} {
+			delta := int64(0)
+			if o == outcome {
+				delta = 1
+			}
+			assert.Equal(t, delta, after[o]-before[o], o)
+		}
+		// the speculative request of a miss is left to finish on its own
+		var got [][]string
+		require.Eventually(t, func() bool {
+			got = append(got, prices.requested()...)
+			return len(got) >= len(requested)
+		}, time.Second, time.Millisecond)
+		assert.ElementsMatch(t, requested, got)
+	}
+
+	// nothing is known about the window, the ranked symbols are priced after the ranks
+	step("miss", []string{"A", "B", "C"}, []string{"A", "B", "C"})
+	// the same ranking, the speculative prices are used as they are
+	step("hit", []string{"A", "B", "C"}, []string{"A", "B", "C"})
+	// D entered the ranking, only its price is requested in addition
+	step("reconciled", []string{"A", "B", "D"}, []string{"A", "B", "C"}, []string{"D"})
+	// the whole ranking changed, the ranked symbols are priced after the ranks
+	step("miss", []string{"X", "Y", "Z"}, []string{"A", "B", "D"}, []string{"X", "Y", "Z"})
+	// the speculative request failed, the ranked symbols are priced after the ranks
+	prices.failNext.Store(true)
+	step("miss", []string{"X", "Y", "Z"}, []string{"X", "Y", "Z"}, []string{"X", "Y", "Z"})
+}
+
+func TestSpeculativePrices(t *testing.T) {
+	ranks := &rankings{lists: [][]string{{"A", "B", "C"}, {"A", "B", "D"}, {"A", "B", "C"}, {"A", "B"}}}
+	h := &Handlers{logger: zap.NewNop(), rcClient: ranks, pcClient: failingPrices{failing: "C"}}
+	req := &rc.RankRequest{Start: 1, Limit: 3}
+
+	rankResp, prices, err := h.getRanksAndPrices(context.Background(), req)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"A", "B", "C"}, rankResp.List)
+	assert.True(t, prices.Partial)
+	require.Len(t, prices.Errors, 1)
+
+	// C left the ranking, its error from the speculative request doesn't make the response partial
+	rankResp, prices, err = h.getRanksAndPrices(context.Background(), req)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"A", "B", "D"}, rankResp.List)
+	assert.Equal(t, map[string]float64{"A": 1, "B": 1, "D": 1}, prices.Prices)
+	assert.Empty(t, prices.Errors)
+	assert.False(t, prices.Partial)
+
+	// the speculative D is priced but not returned, the error of the ranked C is
+	_, prices, err = h.getRanksAndPrices(context.Background(), req)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]float64{"A": 1, "B": 1}, prices.Prices)
+	require.Len(t, prices.Errors, 1)
+	assert.Equal(t, "C", prices.Errors[0].Symbol)
+	assert.True(t, prices.Partial)
+
+	// the ranking shrank, all the speculative symbols are reused without C
+	rankResp, prices, err = h.getRanksAndPrices(context.Background(), req)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"A", "B"}, rankResp.List)
+	assert.Equal(t, map[string]float64{"A": 1, "B": 1}, prices.Prices)
+	assert.Empty(t, prices.Errors)
+	assert.False(t, prices.Partial)
+}
+
+// countingPrices counts the price requests and the requested symbols
+type countingPrices struct {
+	fakePrices
+	requests, symbols atomic.Int32
+}
+
+func (c *countingPrices) GetPrices(ctx context.Context, req *pc.PriceRequest, opts ...grpc.CallOption) (*pc.PriceResponse, error) {
+	c.requests.Add(1)
+	c.symbols.Add(int32(len(req.List)))
+	return c.fakePrices.GetPrices(ctx, req, opts...)
+}
+
+func TestScanPrices(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		target  string
+		symbols int32
+		body    string
+	}{
+		// the page is known from the rank data, its prices are requested only
+		{"sort by change", "/v1/top?sort=change&limit=1", 1, `[{"rank":1,"symbol":"BTC","price":60000}]`},
+		{"sort by change, second page", "/v1/top?sort=change&order=asc&offset=1&limit=1", 1, `[{"rank":3,"symbol":"XYZ","price":null}]`},
+		{"symbols", "/v1/top?symbols=ETH,XYZ", 2, `[{"rank":2,"symbol":"ETH","price":3000},{"rank":3,"symbol":"XYZ","price":null}]`},
+		{"empty page", "/v1/top?sort=change&offset=3", 0, `[]`},
+		// the prices of the top ScanSize coins are requested, the unpriced XYZ is beyond them
+		{"sort by price", "/v1/top?sort=price&order=asc", 2, `[{"rank":2,"symbol":"ETH","price":3000},{"rank":1,"symbol":"BTC","price":60000}]`},
+		{"price filter", "/v1/top?min_price=1000&limit=1", 2, `[{"rank":1,"symbol":"BTC","price":60000}]`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			prices := &countingPrices{}
+			h := newTestHandlers()
+			h.config.ScanSize, h.pcClient = 2, prices
+			rec := get(routerOf(h), tc.target, nil)
+			require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+			assert.JSONEq(t, tc.body, rec.Body.String())
+			assert.Equal(t, tc.symbols, prices.symbols.Load())
+			assert.Equal(t, min(tc.symbols, 1), prices.requests.Load())
+		})
+	}
+}
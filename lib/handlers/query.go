@@ -0,0 +1,273 @@
+package handlers
+
+import (
+	"cmp"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/awnzl/top_currency_checker/lib/apierror"
+	rc "github.com/awnzl/top_currency_checker/lib/proto/rankcollector"
+)
+
+const (
+	// MaxLimit is the max number of the coins returned at once
+	MaxLimit = 500
+	// MaxRank is the max rank the coins can be paged to
+	MaxRank = 5000
+	// MaxSymbols is the max number of the symbols in the symbols filter
+	MaxSymbols = 100
+
+	sortRank   = "rank"
+	sortPrice  = "price"
+	sortChange = "change"
+)
+
+// the error codes of the numeric parameters
+var paramCodes = map[string]apierror.Code{
+	"limit":          apierror.InvalidLimit,
+	"offset":         apierror.InvalidOffset,
+	"start":          apierror.InvalidOffset,
+	"min_price":      apierror.InvalidFilter,
+	"max_price":      apierror.InvalidFilter,
+	"min_market_cap": apierror.InvalidFilter,
+}
+
+var symbolRe = regexp.MustCompile(`^[A-Z0-9]{1,20}$`)
+
+// topQuery is the parsed query of the top coins list
+type topQuery struct {
+	version string // API version, see render
+	limit   int
+	offset  int // number of the coins skipped from the beginning of the (filtered, sorted) list
+	format  string
+	fields  []string // in the output order
+
+	symbols      []string
+	minPrice     *float64
+	maxPrice     *float64
+	minMarketCap *float64
+	sort         string
+	desc         bool
+}
+
+func parseTopQuery(r *http.Request, version string) (topQuery, error) {
+	var err error
+	values := r.URL.Query()
+	q := topQuery{version: version, limit: 100, format: formatJSON, sort: sortRank}
+
+	if q.limit, err = intParam(values, "limit", 100, 1, MaxLimit); err != nil {
+		return q, err
+	}
+
+	if values.Has("offset") && values.Has("start") {
+		return q, apierror.New(apierror.InvalidOffset, "invalid query, use either offset or start")
+	}
+	if q.offset, err = intParam(values, "offset", 0, 0, MaxRank-1); err != nil {
+		return q, err
+	}
+	if values.Has("start") {
+		start, err := intParam(values, "start", 1, 1, MaxRank)
+		if err != nil {
+			return q, err
+		}
+		q.offset = start - 1
+	}
+	if q.offset+q.limit > MaxRank {
+		return q, apierror.New(apierror.InvalidOffset, "invalid query, offset + limit must not exceed %d", MaxRank)
+	}
+
+	if format := strings.ToLower(values.Get("format")); format != "" {
+		if format != formatJSON && format != formatCSV {
+			return q, apierror.New(apierror.InvalidFormat, "invalid format value, use json or csv")
+		}
+		q.format = format
+	}
+
+	if q.fields, err = parseFields(values.Get("fields")); err != nil {
+		return q, err
+	}
+
+	if q.symbols, err = parseSymbols(values.Get("symbols")); err != nil {
+		return q, err
+	}
+
+	if q.minPrice, err = floatParam(values, "min_price"); err != nil {
+		return q, err
+	}
+	if q.maxPrice, err = floatParam(values, "max_price"); err != nil {
+		return q, err
+	}
+	if q.minPrice != nil && q.maxPrice != nil && *q.minPrice > *q.maxPrice {
+		return q, apierror.New(apierror.InvalidFilter, "invalid query, min_price is greater than max_price")
+	}
+	if q.minMarketCap, err = floatParam(values, "min_market_cap"); err != nil {
+		return q, err
+	}
+
+	if sort := strings.ToLower(values.Get("sort")); sort != "" {
+		if sort != sortRank && sort != sortPrice && sort != sortChange {
+			return q, apierror.New(apierror.InvalidSort, "invalid sort value, use rank, price or change")
+		}
+		q.sort = sort
+	}
+	// the ranks are sorted from the top, the prices and changes from the highest
+	q.desc = q.sort != sortRank
+	if order := strings.ToLower(values.Get("order")); order != "" {
+		if order != "asc" && order != "desc" {
+			return q, apierror.New(apierror.InvalidSort, "invalid order value, use asc or desc")
+		}
+		q.desc = order == "desc"
+	}
+
+	return q, nil
+}
+
+func parseSymbols(value string) ([]string, error) {
+	var symbols []string
+	seen := map[string]bool{}
+	for _, symbol := range strings.Split(strings.ToUpper(value), ",") {
+		if symbol = strings.TrimSpace(symbol); symbol == "" || seen[symbol] {
+			continue
+		}
+		if !symbolRe.MatchString(symbol) {
+			return nil, apierror.New(apierror.InvalidSymbol, "invalid symbols value: %q", symbol)
+		}
+		seen[symbol] = true
+		symbols = append(symbols, symbol)
+	}
+	if len(symbols) > MaxSymbols {
+		return nil, apierror.New(apierror.InvalidSymbol, "invalid symbols value, at most %d symbols are allowed", MaxSymbols)
+	}
+	return symbols, nil
+}
+
+func parseFields(value string) ([]string, error) {
+	var fields []string
+	requested := map[string]bool{}
+	for _, field := range strings.Split(strings.ToLower(value), ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			requested[field] = true
+		}
+	}
+	for _, f := range coinFields {
+		if (len(requested) == 0 && !f.optional) || requested[f.name] {
+			fields = append(fields, f.name)
+			delete(requested, f.name)
+		}
+	}
+	if len(requested) > 0 {
+		names := make([]string, 0, len(coinFields))
+		for _, f := range coinFields {
+			names = append(names, f.name)
+		}
+		return nil, apierror.New(apierror.InvalidFields, "invalid fields value, use %s", strings.Join(names, ", "))
+	}
+	return fields, nil
+}
+
+func intParam(values url.Values, name string, def, min, max int) (int, error) {
+	value := values.Get(name)
+	if value == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < min || n > max {
+		return 0, apierror.New(paramCodes[name], "invalid %s value, must be an integer from %d to %d", name, min, max)
+	}
+	return n, nil
+}
+
+func floatParam(values url.Values, name string) (*float64, error) {
+	value := values.Get(name)
+	if value == "" {
+		return nil, nil
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil || f < 0 {
+		return nil, apierror.New(paramCodes[name], "invalid %s value, must be a non-negative number", name)
+	}
+	return &f, nil
+}
+
+// scan is true when the whole retained listing has to be requested to filter or sort it
+func (q topQuery) scan() bool {
+	return len(q.symbols) > 0 || q.minPrice != nil || q.maxPrice != nil || q.minMarketCap != nil ||
+		q.sort != sortRank || q.desc
+}
+
+// pricedScan is true when the filters or the sorting need the prices of all the scanned coins
+func (q topQuery) pricedScan() bool {
+	return q.minPrice != nil || q.maxPrice != nil || q.sort == sortPrice
+}
+
+// cacheKey identifies the rendered response
+func (q topQuery) cacheKey() string {
+	f := func(v *float64) string {
+		if v == nil {
+			return ""
+		}
+		return strconv.FormatFloat(*v, 'g', -1, 64)
+	}
+	return fmt.Sprintf("%s|%d|%d|%s|%s|%s|%s|%s|%s|%s|%t",
+		q.version, q.limit, q.offset, q.format, strings.Join(q.fields, ","), strings.Join(q.symbols, ","),
+		f(q.minPrice), f(q.maxPrice), f(q.minMarketCap), q.sort, q.desc)
+}
+
+// matchCoin applies the filters known before the prices are requested
+func (q topQuery) matchCoin(c *rc.Coin) bool {
+	if len(q.symbols) > 0 && !slices.Contains(q.symbols, c.Symbol) {
+		return false
+	}
+	return q.minMarketCap == nil || c.MarketCap >= *q.minMarketCap
+}
+
+// page applies the price filters, sorts the coins and returns the requested page
+func (q topQuery) page(coins []coin) []coin {
+	filtered := make([]coin, 0, len(coins))
+	for _, c := range coins {
+		if (q.minPrice != nil || q.maxPrice != nil) && c.Price == nil {
+			continue
+		}
+		if (q.minPrice != nil && *c.Price < *q.minPrice) || (q.maxPrice != nil && *c.Price > *q.maxPrice) {
+			continue
+		}
+		filtered = append(filtered, c)
+	}
+
+	slices.SortStableFunc(filtered, func(a, b coin) int {
+		var res int
+		switch q.sort {
+		case sortPrice:
+			// the unknown prices are the lowest
+			pa, pb := math.Inf(-1), math.Inf(-1)
+			if a.Price != nil {
+				pa = *a.Price
+			}
+			if b.Price != nil {
+				pb = *b.Price
+			}
+			res = cmp.Compare(pa, pb)
+		case sortChange:
+			res = cmp.Compare(a.Change24h, b.Change24h)
+		default:
+			res = cmp.Compare(a.Rank, b.Rank)
+		}
+		if q.desc {
+			res = -res
+		}
+		if res == 0 {
+			// the ties are sorted by rank
+			res = cmp.Compare(a.Rank, b.Rank)
+		}
+		return res
+	})
+
+	from, to := min(q.offset, len(filtered)), min(q.offset+q.limit, len(filtered))
+	return filtered[from:to]
+}
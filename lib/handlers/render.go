@@ -0,0 +1,138 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+const (
+	formatJSON = "json"
+	formatCSV  = "csv"
+
+	// versionLegacy is the original API at /, its columns are the human readable names
+	versionLegacy = ""
+	// versionV1 is the API at /v1/, its columns are the stable snake_case query names
+	versionV1 = "v1"
+)
+
+// the fields of a coin in the output order: query name -> legacy column name,
+// the optional ones are returned only when requested with the fields parameter
+var coinFields = []struct {
+	name, column string
+	optional     bool
+}{
+	{"rank", "Rank", false},
+	{"symbol", "Symbol", false},
+	{"price", "Price USD", false},
+	{"market_cap", "Market Cap USD", true},
+	{"change_24h", "Change 24h %", true},
+	{"as_of", "As Of", true},
+	{"stale", "Stale", true},
+}
+
+type coin struct {
+	Rank      int
+	Symbol    string
+	Price     *float64 // nil if the price is unknown
+	MarketCap float64
+	Change24h float64
+	AsOf      time.Time // time the price was received
+	Stale     bool      // the rank or the price is taken from the last good snapshot
+}
+
+func (c coin) value(field string) any {
+	switch field {
+	case "rank":
+		return c.Rank
+	case "symbol":
+		return c.Symbol
+	case "market_cap":
+		return c.MarketCap
+	case "change_24h":
+		return c.Change24h
+	case "as_of":
+		return c.AsOf.UTC().Format(time.RFC3339)
+	case "stale":
+		return c.Stale
+	default:
+		return c.Price
+	}
+}
+
+// render returns the body and its content type, the column names depend on the API version
+func render(coins []coin, format string, fields []string, version string) ([]byte, string, error) {
+	columns := make(map[string]string, len(coinFields))
+	for _, f := range coinFields {
+		columns[f.name] = f.column
+		if version == versionV1 {
+			columns[f.name] = f.name
+		}
+	}
+
+	var buf bytes.Buffer
+	if format == formatCSV {
+		w := csv.NewWriter(&buf)
+		row := make([]string, len(fields))
+		for i, field := range fields {
+			row[i] = columns[field]
+		}
+		w.Write(row)
+		for _, c := range coins {
+			for i, field := range fields {
+				switch v := c.value(field).(type) {
+				case *float64:
+					row[i] = ""
+					if v != nil {
+						row[i] = strconv.FormatFloat(*v, 'f', -1, 64)
+					}
+				case float64:
+					row[i] = strconv.FormatFloat(v, 'f', -1, 64)
+				default:
+					row[i] = fmt.Sprint(v)
+				}
+			}
+			w.Write(row)
+		}
+		w.Flush()
+		return buf.Bytes(), "text/csv; charset=utf-8", w.Error()
+	}
+
+	if version == versionLegacy && len(coins) == 0 {
+		// the original API encodes the empty list as null
+		return []byte("null"), "application/json", nil
+	}
+
+	// the objects are written field by field to keep the order of the keys
+	buf.WriteByte('[')
+	for i, c := range coins {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.WriteByte('{')
+		for j, field := range fields {
+			if j > 0 {
+				buf.WriteByte(',')
+			}
+			key, _ := json.Marshal(columns[field])
+			v := c.value(field)
+			if p, ok := v.(*float64); ok && p == nil && version == versionLegacy {
+				// the original API has 0 for the unknown prices
+				v = 0.0
+			}
+			value, err := json.Marshal(v)
+			if err != nil {
+				return nil, "", err
+			}
+			buf.Write(key)
+			buf.WriteByte(':')
+			buf.Write(value)
+		}
+		buf.WriteByte('}')
+	}
+	buf.WriteByte(']')
+	return buf.Bytes(), "application/json", nil
+}
@@ -0,0 +1,92 @@
+package handlers
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	pc "github.com/awnzl/top_currency_checker/lib/proto/pricecollector"
+	rc "github.com/awnzl/top_currency_checker/lib/proto/rankcollector"
+)
+
+func TestRender(t *testing.T) {
+	coins := mergeCoins(
+		&rc.RankResponse{List: []string{"BTC", "ETH"}, AsOf: 1000},
+		&pc.PriceResponse{Prices: map[string]float64{"BTC": 6634.41}, AsOf: 2000},
+	)
+
+	q, err := parseTopQuery(httptest.NewRequest("GET", "/?limit=2", nil), versionLegacy)
+	assert.NoError(t, err)
+	body, contentType, err := render(coins, q.format, q.fields, q.version)
+	assert.NoError(t, err)
+	assert.Equal(t, "application/json", contentType)
+	assert.Equal(t, `[{"Rank":1,"Symbol":"BTC","Price USD":6634.41},{"Rank":2,"Symbol":"ETH","Price USD":0}]`, string(body))
+
+	q, err = parseTopQuery(httptest.NewRequest("GET", "/?format=csv&fields=price,symbol", nil), versionLegacy)
+	assert.NoError(t, err)
+	assert.Equal(t, "|100|0|csv|symbol,price|||||rank|false", q.cacheKey())
+	body, contentType, err = render(coins, q.format, q.fields, q.version)
+	assert.NoError(t, err)
+	assert.Equal(t, "text/csv; charset=utf-8", contentType)
+	assert.Equal(t, "Symbol,Price USD\nBTC,6634.41\nETH,\n", string(body))
+
+	q, err = parseTopQuery(httptest.NewRequest("GET", "/?fields=symbol,stale,as_of", nil), versionLegacy)
+	assert.NoError(t, err)
+	body, _, err = render(coins[:1], q.format, q.fields, q.version)
+	assert.NoError(t, err)
+	assert.Equal(t, `[{"Symbol":"BTC","As Of":"1970-01-01T00:00:02Z","Stale":false}]`, string(body))
+
+	_, err = parseTopQuery(httptest.NewRequest("GET", "/?fields=volume", nil), versionLegacy)
+	assert.Error(t, err)
+	_, err = parseTopQuery(httptest.NewRequest("GET", "/?format=xml", nil), versionLegacy)
+	assert.Error(t, err)
+}
+
+func TestTopQuery(t *testing.T) {
+	price := func(p float64) *float64 { return &p }
+	coins := []coin{
+		{Rank: 1, Symbol: "BTC", Price: price(60000), MarketCap: 1e12, Change24h: 1},
+		{Rank: 2, Symbol: "ETH", Price: price(3000), MarketCap: 4e11, Change24h: 5},
+		{Rank: 3, Symbol: "USDT", Price: price(1), MarketCap: 1e11, Change24h: 0},
+		{Rank: 4, Symbol: "XYZ", MarketCap: 1e10, Change24h: -3},
+	}
+	symbols := func(coins []coin) []string {
+		var res []string
+		for _, c := range coins {
+			res = append(res, c.Symbol)
+		}
+		return res
+	}
+
+	q, err := parseTopQuery(httptest.NewRequest("GET", "/?limit=20", nil), versionLegacy)
+	assert.NoError(t, err)
+	assert.False(t, q.scan())
+
+	q, err = parseTopQuery(httptest.NewRequest("GET", "/?sort=price&limit=2", nil), versionLegacy)
+	assert.NoError(t, err)
+	assert.True(t, q.scan())
+	assert.Equal(t, []string{"BTC", "ETH"}, symbols(q.page(coins)))
+
+	q, err = parseTopQuery(httptest.NewRequest("GET", "/?sort=change&order=asc&offset=1&limit=2", nil), versionLegacy)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"USDT", "BTC"}, symbols(q.page(coins)))
+
+	q, err = parseTopQuery(httptest.NewRequest("GET", "/?min_price=2&max_price=5000", nil), versionLegacy)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"ETH"}, symbols(q.page(coins)))
+
+	q, err = parseTopQuery(httptest.NewRequest("GET", "/?symbols=xyz,btc&min_market_cap=1e11", nil), versionLegacy)
+	assert.NoError(t, err)
+	assert.True(t, q.matchCoin(&rc.Coin{Symbol: "BTC", MarketCap: 1e12}))
+	assert.False(t, q.matchCoin(&rc.Coin{Symbol: "XYZ", MarketCap: 1e10}))
+	assert.False(t, q.matchCoin(&rc.Coin{Symbol: "ETH", MarketCap: 4e11}))
+
+	for _, query := range []string{
+		"limit=0", "limit=501", "limit=-1", "offset=-1", "offset=4990&limit=20", "offset=1&start=2",
+		"min_price=-1", "min_price=5&max_price=1", "sort=volume", "order=up", "symbols=B-TC",
+	} {
+		_, err = parseTopQuery(httptest.NewRequest("GET", "/?"+query, nil), versionLegacy)
+		assert.Error(t, err, query)
+	}
+}
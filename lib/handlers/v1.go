@@ -0,0 +1,84 @@
+package handlers
+
+import (
+	"context"
+	_ "embed"
+	"fmt"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/awnzl/top_currency_checker/lib/apierror"
+	pc "github.com/awnzl/top_currency_checker/lib/proto/pricecollector"
+)
+
+// openAPISpec is the OpenAPI 3 document of the v1 API
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+func (h *Handlers) openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(openAPISpec); err != nil {
+		h.logger.Error("write response", zap.Error(err))
+	}
+}
+
+// pricesHandler returns the prices of the requested symbols in the requested order
+func (h *Handlers) pricesHandler(w http.ResponseWriter, r *http.Request) {
+	symbols, err := parseSymbols(r.URL.Query().Get("symbols"))
+	if err != nil {
+		h.processError(r.Context(), err, w)
+		return
+	}
+	if len(symbols) == 0 {
+		h.processError(r.Context(), apierror.New(apierror.InvalidSymbol, "symbols is required"), w)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), h.config.Budget)
+	defer cancel()
+
+	resp, err := h.pcClient.GetPrices(ctx, &pc.PriceRequest{List: symbols})
+	if err != nil {
+		h.processError(ctx, err, w)
+		return
+	}
+
+	coins := make([]coin, 0, len(symbols))
+	oldest := time.UnixMilli(resp.AsOf)
+	for _, symbol := range symbols {
+		c := coin{Symbol: symbol, AsOf: time.UnixMilli(resp.AsOf)}
+		if p, ok := resp.Prices[symbol]; ok {
+			c.Price = &p
+		}
+		if asOf, ok := resp.StaleAsOf[symbol]; ok {
+			c.AsOf, c.Stale = time.UnixMilli(asOf), true
+			if c.AsOf.Before(oldest) {
+				oldest = c.AsOf
+			}
+		}
+		coins = append(coins, c)
+	}
+
+	body, contentType, err := render(coins, formatJSON, []string{"symbol", "price", "as_of", "stale"}, versionV1)
+	if err != nil {
+		h.processError(ctx, fmt.Errorf("render: %w", err), w)
+		return
+	}
+
+	if resp.Partial {
+		w.Header().Set(PartialHeader, "true")
+	}
+	if resp.Stale {
+		w.Header().Set(StaleHeader, "true")
+	}
+	w.Header().Set(AsOfHeader, oldest.UTC().Format(time.RFC3339))
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(body); err != nil {
+		h.logger.Error("write response", zap.Error(err))
+	}
+}
@@ -0,0 +1,218 @@
+package integration
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/awnzl/top_currency_checker/lib/apierror"
+	"github.com/awnzl/top_currency_checker/lib/fakeupstream"
+	"github.com/awnzl/top_currency_checker/lib/handlers"
+	"github.com/awnzl/top_currency_checker/lib/requester/chaos"
+)
+
+func symbols(coins []topCoin) []string {
+	list := make([]string, 0, len(coins))
+	for _, c := range coins {
+		list = append(list, c.Symbol)
+	}
+	return list
+}
+
+func TestTop(t *testing.T) {
+	s := newStack(t, time.Minute)
+
+	coins, resp := s.top(t, 10)
+	assert.Equal(t, s.expected(10), coins)
+	assert.Equal(t, "BTC", coins[0].Symbol)
+	assert.Empty(t, resp.Header.Get(handlers.StaleHeader))
+	assert.Empty(t, resp.Header.Get(handlers.PartialHeader))
+
+	resp, body := s.get(t, "/v1/coins/ETH")
+	require.Equal(t, http.StatusOK, resp.StatusCode, string(body))
+	assert.Contains(t, string(body), `"symbol":"ETH"`)
+
+	resp, body = s.get(t, "/v1/coins/NOPE")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.Equal(t, string(apierror.NotFound), apiError(t, body))
+}
+
+func TestRankReshuffle(t *testing.T) {
+	s := newStack(t, time.Minute)
+
+	before, _ := s.top(t, 10)
+	// the market steps until its top 10 is reordered
+	for i := 0; slices.Equal(symbols(before), symbols(s.expected(10))); i++ {
+		require.Less(t, i, 10000, "the ranks never swapped")
+		s.clock.Step(time.Second)
+	}
+
+	after, _ := s.top(t, 10)
+	assert.NotEqual(t, symbols(before), symbols(after))
+	// the prices of the newly ranked symbols are requested once the ranks arrive
+	assert.Equal(t, s.expected(10), after)
+}
+
+func TestMissingPrices(t *testing.T) {
+	s := newStack(t, time.Minute)
+	s.market.Unprice("ETH")
+
+	coins, resp := s.top(t, 5)
+	assert.Equal(t, s.expected(5), coins)
+	require.Equal(t, "ETH", coins[1].Symbol)
+	assert.Nil(t, coins[1].Price)
+	assert.NotNil(t, coins[0].Price)
+	assert.Empty(t, resp.Header.Get(handlers.PartialHeader))
+
+	resp, body := s.get(t, "/v1/coins/ETH")
+	require.Equal(t, http.StatusOK, resp.StatusCode, string(body))
+	assert.Contains(t, string(body), `"price":null`)
+}
+
+func TestUpstreamOutage(t *testing.T) {
+	s := newStack(t, 300*time.Millisecond)
+
+	// nothing is kept before the first good response
+	s.setFaults(fakeupstream.Faults{ServerError: 100})
+	resp, body := s.get(t, "/v1/top?limit=5")
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, string(apierror.UpstreamUnavailable), apiError(t, body))
+
+	s.setFaults(fakeupstream.Faults{})
+	good, _ := s.top(t, 5)
+
+	// the last good data is served while the upstream is down
+	s.setFaults(fakeupstream.Faults{ServerError: 100})
+	s.clock.Step(time.Minute)
+	coins, resp := s.top(t, 5)
+	assert.Equal(t, good, coins)
+	assert.Equal(t, "true", resp.Header.Get(handlers.StaleHeader))
+	assert.NotEmpty(t, resp.Header.Get(handlers.AsOfHeader))
+
+	// until it is too old
+	time.Sleep(400 * time.Millisecond)
+	resp, body = s.get(t, "/v1/top?limit=5")
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, string(apierror.StaleData), apiError(t, body))
+
+	// the malformed responses are failures too, the recovery is immediate
+	s.setFaults(fakeupstream.Faults{Malformed: 100})
+	resp, _ = s.get(t, "/v1/top?limit=5")
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	s.setFaults(fakeupstream.Faults{})
+	coins, resp = s.top(t, 5)
+	assert.Equal(t, s.expected(5), coins)
+	assert.Empty(t, resp.Header.Get(handlers.StaleHeader))
+}
+
+func TestUpstreamRateLimit(t *testing.T) {
+	s := newStack(t, time.Minute)
+	good, _ := s.top(t, 5)
+
+	// the rate limit errors take the only key out until the end of the minute
+	s.setFaults(fakeupstream.Faults{RateLimit: 100})
+	coins, resp := s.top(t, 5)
+	assert.Equal(t, good, coins)
+	assert.Equal(t, "true", resp.Header.Get(handlers.StaleHeader))
+	assert.NotNil(t, s.ranks.Keys().Status()[0].ExhaustedUntil)
+	assert.NotNil(t, s.prices.Keys().Status()[0].ExhaustedUntil)
+
+	// the exhausted key is not used again even when the upstream recovers
+	s.setFaults(fakeupstream.Faults{})
+	requests := s.upstream.requests.Load()
+	coins, resp = s.top(t, 5)
+	assert.Equal(t, good, coins)
+	assert.Equal(t, "true", resp.Header.Get(handlers.StaleHeader))
+	assert.Equal(t, requests, s.upstream.requests.Load())
+}
+
+func TestDeadline(t *testing.T) {
+	s := newStack(t, time.Minute)
+	s.setFaults(fakeupstream.Faults{Timeout: 100, TimeoutDelay: time.Minute})
+
+	start := time.Now()
+	resp, body := s.get(t, "/v1/top?limit=5")
+	assert.Equal(t, http.StatusGatewayTimeout, resp.StatusCode)
+	assert.Equal(t, string(apierror.Timeout), apiError(t, body))
+	assert.Less(t, time.Since(start), requestBudget+time.Second)
+
+	// the deadline is propagated, the upstream requests are not left hanging
+	assert.Eventually(t, func() bool { return s.upstream.inflight.Load() == 0 }, time.Second, 10*time.Millisecond)
+}
+
+func TestCancellation(t *testing.T) {
+	s := newStack(t, time.Minute)
+	s.setFaults(fakeupstream.Faults{Timeout: 100, TimeoutDelay: time.Minute})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.api.URL+"/v1/top?limit=5", nil)
+	require.NoError(t, err)
+	done := make(chan error, 1)
+	go func() {
+		resp, err := http.DefaultClient.Do(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+		done <- err
+	}()
+
+	require.Eventually(t, func() bool { return s.upstream.inflight.Load() > 0 }, time.Second, 5*time.Millisecond)
+	cancel()
+	select {
+	case err := <-done:
+		assert.True(t, errors.Is(err, context.Canceled), err)
+	case <-time.After(time.Second):
+		t.Fatal("the canceled request is still waiting")
+	}
+
+	// the shared upstream requests run to the request budget at most, not to the upstream's delay
+	assert.Eventually(t, func() bool { return s.upstream.inflight.Load() == 0 }, requestBudget+time.Second, 10*time.Millisecond)
+
+	// the stack serves again once the upstream answers
+	s.setFaults(fakeupstream.Faults{})
+	coins, _ := s.top(t, 5)
+	assert.Equal(t, s.expected(5), coins)
+}
+
+func TestInjectedFaults(t *testing.T) {
+	s := newStack(t, time.Minute)
+
+	// the requester drops the currencies from the price responses
+	s.prices.Faults().SetRules([]chaos.Rule{{Fault: chaos.FaultDropSymbols, Symbols: 3, Percent: 100}})
+	coins, _ := s.top(t, 10)
+	missing := 0
+	for _, c := range coins {
+		if c.Price == nil {
+			missing++
+		}
+	}
+	assert.Equal(t, 3, missing)
+	s.prices.Faults().SetRules(nil)
+
+	// the ranks fail with the injected connection errors and are served from the last good listing
+	good, _ := s.top(t, 10)
+	s.ranks.Faults().SetRules([]chaos.Rule{{Fault: chaos.FaultError, Percent: 100}})
+	requests := s.upstream.requests.Load()
+	coins, resp := s.top(t, 10)
+	assert.Equal(t, symbols(good), symbols(coins))
+	assert.Equal(t, "true", resp.Header.Get(handlers.StaleHeader))
+	assert.Equal(t, requests+1, s.upstream.requests.Load(), "only the prices reach the upstream")
+}
+
+func TestAdaptiveBatches(t *testing.T) {
+	s := newStack(t, time.Minute)
+	// the 20 symbols are about 90 long
+	s.setFaults(fakeupstream.Faults{FsymsMaxLen: 30})
+
+	// the batches rejected as too long are split until the upstream accepts them
+	coins, resp := s.top(t, 20)
+	assert.Equal(t, s.expected(20), coins)
+	assert.Empty(t, resp.Header.Get(handlers.PartialHeader))
+	assert.Less(t, s.prices.BatchSize(), 10)
+}
@@ -0,0 +1,208 @@
+// Package integration runs the collectors and the currency_checker API in process against the fake upstreams,
+// the scenarios assert on the HTTP output of the whole stack.
+package integration
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/awnzl/top_currency_checker/lib/fakeupstream"
+	"github.com/awnzl/top_currency_checker/lib/handlers"
+	"github.com/awnzl/top_currency_checker/lib/middleware"
+	pcproto "github.com/awnzl/top_currency_checker/lib/proto/pricecollector"
+	rcproto "github.com/awnzl/top_currency_checker/lib/proto/rankcollector"
+	reqconfig "github.com/awnzl/top_currency_checker/lib/requester/config"
+	"github.com/awnzl/top_currency_checker/lib/secrets"
+	"github.com/awnzl/top_currency_checker/lib/services/pricecollector"
+	"github.com/awnzl/top_currency_checker/lib/services/rankcollector"
+)
+
+const (
+	listingSize = 20
+	// the request budget of the API is shorter than the upstream request timeout, so the deadlines are the caller's
+	requestBudget = 500 * time.Millisecond
+)
+
+// clock is the manual clock of the market, the prices step only when it is moved
+type clock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *clock) Step(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// upstream is the fake CoinMarketCap and CryptoCompare server counting the requests it gets
+type upstream struct {
+	*fakeupstream.Server
+	requests atomic.Int64
+	inflight atomic.Int64
+}
+
+func (u *upstream) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u.requests.Add(1)
+		u.inflight.Add(1)
+		defer u.inflight.Add(-1)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// stack is the three services wired together, the collectors are reached over in-memory gRPC connections
+type stack struct {
+	clock    *clock
+	market   *fakeupstream.Market
+	upstream *upstream
+	ranks    *rankcollector.Server
+	prices   *pricecollector.Server
+	api      *httptest.Server
+}
+
+// newStack starts the stack, the collectors serve the kept data for maxStaleness after the upstream fails
+func newStack(t *testing.T, maxStaleness time.Duration) *stack {
+	t.Helper()
+	s := &stack{clock: &clock{now: time.Date(2024, 6, 3, 12, 0, 0, 0, time.UTC)}}
+
+	s.market = fakeupstream.NewMarket(1, 100, time.Second)
+	s.market.SetClock(s.clock.Now)
+	s.upstream = &upstream{Server: fakeupstream.New(s.market, fakeupstream.Faults{})}
+	upstreamRouter := mux.NewRouter()
+	s.upstream.Register(upstreamRouter)
+	upstreamSrv := httptest.NewServer(s.upstream.wrap(upstreamRouter))
+	t.Cleanup(upstreamSrv.Close)
+
+	// no retries and no local rate limit, so every API call reaches the upstream once
+	reqConf := reqconfig.Config{ReqTimeout: 1, FaultsEnabled: true}
+	keys := []secrets.Source{secrets.Literal("integration-api-key")}
+	s.ranks = rankcollector.New(rankcollector.Config{
+		APIKeys:      keys,
+		APIURL:       upstreamSrv.URL + fakeupstream.ListingsPath + "?",
+		ReqConfig:    reqConf,
+		MaxStaleness: maxStaleness,
+		ListingSize:  listingSize,
+	})
+	s.prices = pricecollector.New(pricecollector.Config{
+		APIKeys:      keys,
+		APIURL:       upstreamSrv.URL + "/data",
+		FSYMSLimit:   listingSize,
+		ReqConfig:    reqConf,
+		MaxStaleness: maxStaleness,
+	})
+	rcConn := serveGRPC(t, func(srv *grpc.Server) { rcproto.RegisterRankServiceServer(srv, s.ranks) })
+	pcConn := serveGRPC(t, func(srv *grpc.Server) { pcproto.RegisterPriceServiceServer(srv, s.prices) })
+
+	router := mux.NewRouter()
+	handlers.New(zap.NewNop(), handlers.Config{Budget: requestBudget}, pcConn, rcConn).
+		RegisterHandlers(router, middleware.RequestID, middleware.SetContentTypeJSON)
+	s.api = httptest.NewServer(router)
+	t.Cleanup(s.api.Close)
+	return s
+}
+
+// serveGRPC serves the service on an in-memory listener and returns the client connection to it
+func serveGRPC(t *testing.T, register func(*grpc.Server)) *grpc.ClientConn {
+	t.Helper()
+	listener := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer()
+	register(srv)
+	go srv.Serve(listener)
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func (s *stack) setFaults(faults fakeupstream.Faults) {
+	s.upstream.SetFaults(faults)
+}
+
+// get requests the API and returns the response with its body read
+func (s *stack) get(t *testing.T, uri string) (*http.Response, []byte) {
+	t.Helper()
+	resp, err := http.Get(s.api.URL + uri)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp, body
+}
+
+type topCoin struct {
+	Rank      int      `json:"rank"`
+	Symbol    string   `json:"symbol"`
+	Price     *float64 `json:"price"`
+	MarketCap float64  `json:"market_cap"`
+}
+
+// top requests the v1 top list, it must succeed
+func (s *stack) top(t *testing.T, limit int) ([]topCoin, *http.Response) {
+	t.Helper()
+	resp, body := s.get(t, "/v1/top?fields=rank,symbol,price,market_cap&limit="+strconv.Itoa(limit))
+	require.Equal(t, http.StatusOK, resp.StatusCode, string(body))
+	var coins []topCoin
+	require.NoError(t, json.Unmarshal(body, &coins))
+	return coins, resp
+}
+
+// expected returns the top of the market as the API renders it
+func (s *stack) expected(limit int) []topCoin {
+	listing := s.market.Listing(1, limit)
+	symbols := make([]string, 0, len(listing))
+	for _, c := range listing {
+		symbols = append(symbols, c.Symbol)
+	}
+	prices := s.market.Prices(symbols)
+	coins := make([]topCoin, 0, len(listing))
+	for _, c := range listing {
+		tc := topCoin{Rank: c.Rank, Symbol: c.Symbol, MarketCap: c.MarketCap()}
+		if price, ok := prices[c.Symbol]; ok {
+			tc.Price = &price
+		}
+		coins = append(coins, tc)
+	}
+	return coins
+}
+
+// apiError returns the code of the error envelope
+func apiError(t *testing.T, body []byte) string {
+	t.Helper()
+	var envelope struct {
+		Error struct {
+			Code string `json:"code"`
+		} `json:"error"`
+	}
+	require.NoError(t, json.Unmarshal(body, &envelope), string(body))
+	return envelope.Error.Code
+}
@@ -15,12 +15,57 @@ var logLevels = map[string]zapcore.Level{
 	"error": zap.ErrorLevel,
 }
 
-func NewZap(level string) *zap.Logger {
-	level = strings.ToLower(level)
+// Option changes the zap configuration built by NewZap
+type Option func(*zap.Config)
 
-	logLevel, ok := logLevels[level]
+// WithSampling logs the first `initial` entries with the same level and message
+// each second and then every `thereafter`-th entry
+func WithSampling(initial, thereafter int) Option {
+	return func(c *zap.Config) {
+		c.Sampling = &zap.SamplingConfig{
+			Initial:    initial,
+			Thereafter: thereafter,
+		}
+	}
+}
+
+// WithoutSampling disables sampling, every entry is logged
+func WithoutSampling() Option {
+	return func(c *zap.Config) {
+		c.Sampling = nil
+	}
+}
+
+// WithLevel makes the logger use the given atomic level, so it can be changed at runtime
+func WithLevel(lvl zap.AtomicLevel) Option {
+	return func(c *zap.Config) {
+		c.Level = lvl
+	}
+}
+
+// ParseLevel converts a level name (debug, info, warn, error) to the zap level
+func ParseLevel(level string) (zapcore.Level, error) {
+	logLevel, ok := logLevels[strings.ToLower(level)]
 	if !ok {
-		panic(fmt.Sprintf("unknown log level: %s", level))
+		return logLevel, fmt.Errorf("unknown log level: %s", level)
+	}
+	return logLevel, nil
+}
+
+// NewAtomicLevel returns a level which can be shared with NewZap through WithLevel.
+// zap.AtomicLevel is an http.Handler, so it can be served to change the level at runtime.
+func NewAtomicLevel(level string) (zap.AtomicLevel, error) {
+	logLevel, err := ParseLevel(level)
+	if err != nil {
+		return zap.AtomicLevel{}, err
+	}
+	return zap.NewAtomicLevelAt(logLevel), nil
+}
+
+func NewZap(level string, opts ...Option) *zap.Logger {
+	logLevel, err := ParseLevel(level)
+	if err != nil {
+		panic(err.Error())
 	}
 
 	zapConfig := zap.Config{
@@ -36,6 +81,10 @@ func NewZap(level string) *zap.Logger {
 		ErrorOutputPaths: []string{"stdout"},
 	}
 
+	for _, opt := range opts {
+		opt(&zapConfig)
+	}
+
 	log, err := zapConfig.Build()
 	if err != nil {
 		panic(err)
@@ -0,0 +1,195 @@
+package middleware
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+
+	"github.com/awnzl/top_currency_checker/lib/apierror"
+)
+
+const (
+	APIKeyHeader = "X-API-Key"
+	APIKeyParam  = "api_key"
+)
+
+type clientKey struct{}
+
+// ClientFromContext returns the name of the authenticated API key or an empty string when the authentication is disabled
+func ClientFromContext(ctx context.Context) string {
+	name, _ := ctx.Value(clientKey{}).(string)
+	return name
+}
+
+// WithClient returns the context of the request authenticated as the client
+func WithClient(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, clientKey{}, name)
+}
+
+// usage of the API keys by key name: requests, rejected_rate, rejected_daily
+var apiKeyUsage = expvar.NewMap("api_key_usage")
+
+// APIKey describes a client key and its quotas
+type APIKey struct {
+	Name       string  `mapstructure:"name"`
+	Key        string  `mapstructure:"key"`
+	Rate       float64 `mapstructure:"rate"`        // requests per second, 0 - unlimited
+	Burst      int     `mapstructure:"burst"`       // max requests at once, defaults to the rate
+	DailyLimit int     `mapstructure:"daily_limit"` // requests per UTC day, 0 - unlimited
+}
+
+// LoadAPIKeys reads the keys from the YAML file:
+//
+//	keys:
+//	  - name: dashboard
+//	    key: <secret>
+//	    rate: 5
+//	    burst: 10
+//	    daily_limit: 10000
+func LoadAPIKeys(path string) ([]APIKey, error) {
+	v := viper.New()
+	v.SetConfigFile(path)
+	if err := v.ReadInConfig(); err != nil {
+		return nil, fmt.Errorf("read api keys file %s: %w", path, err)
+	}
+
+	var keys []APIKey
+	if err := v.UnmarshalKey("keys", &keys); err != nil {
+		return nil, fmt.Errorf("parse api keys file %s: %w", path, err)
+	}
+
+	names := map[string]bool{}
+	secrets := map[string]bool{}
+	for i, k := range keys {
+		switch {
+		case k.Name == "":
+			return nil, fmt.Errorf("api key #%d: name is required", i)
+		case k.Key == "":
+			return nil, fmt.Errorf("api key %s: key is required", k.Name)
+		case names[k.Name]:
+			return nil, fmt.Errorf("api key %s: duplicated name", k.Name)
+		case secrets[k.Key]:
+			return nil, fmt.Errorf("api key %s: duplicated key", k.Name)
+		case k.Rate < 0 || k.Burst < 0 || k.DailyLimit < 0:
+			return nil, fmt.Errorf("api key %s: quotas must not be negative", k.Name)
+		}
+		names[k.Name] = true
+		secrets[k.Key] = true
+	}
+
+	return keys, nil
+}
+
+type client struct {
+	APIKey
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+	day    string
+	used   int
+}
+
+// allow takes a request from the client quotas, it returns the reason of rejection
+func (c *client) allow(now time.Time) (ok bool, reason string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.DailyLimit > 0 {
+		if day := now.UTC().Format(time.DateOnly); day != c.day {
+			c.day, c.used = day, 0
+		}
+		if c.used >= c.DailyLimit {
+			return false, "daily"
+		}
+	}
+
+	if c.Rate > 0 {
+		burst := float64(c.Burst)
+		if burst == 0 {
+			burst = max(c.Rate, 1)
+		}
+		// token bucket: refill with the rate since the last request
+		if c.last.IsZero() {
+			c.tokens = burst
+		} else {
+			c.tokens = min(burst, c.tokens+now.Sub(c.last).Seconds()*c.Rate)
+		}
+		c.last = now
+		if c.tokens < 1 {
+			return false, "rate"
+		}
+		c.tokens--
+	}
+
+	c.used++
+	return true, ""
+}
+
+type Auth struct {
+	logger  *zap.Logger
+	clients map[string]*client
+	now     func() time.Time
+}
+
+func NewAuth(log *zap.Logger, keys []APIKey) *Auth {
+	clients := make(map[string]*client, len(keys))
+	for _, k := range keys {
+		clients[k.Key] = &client{APIKey: k}
+	}
+	return &Auth{
+		logger:  log,
+		clients: clients,
+		now:     time.Now,
+	}
+}
+
+// writeError sends the error envelope of the rejected request
+func (a *Auth) writeError(w http.ResponseWriter, r *http.Request, httpStatus int, code apierror.Code, msg string) {
+	if err := apierror.Write(r.Context(), w, httpStatus, code, msg); err != nil {
+		a.logger.Error("write response", zap.Error(err))
+	}
+}
+
+// Authenticate rejects the requests without a known API key with 401
+// and the requests above the key quotas with 429
+func (a *Auth) Authenticate(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(APIKeyHeader)
+		if key == "" {
+			key = r.URL.Query().Get(APIKeyParam)
+		}
+		if key == "" {
+			a.writeError(w, r, http.StatusUnauthorized, apierror.Unauthorized, "missing api key")
+			return
+		}
+
+		c, ok := a.clients[key]
+		if !ok {
+			a.logger.Info("unknown api key", zap.String("Addr", r.RemoteAddr))
+			a.writeError(w, r, http.StatusUnauthorized, apierror.Unauthorized, "invalid api key")
+			return
+		}
+
+		if ok, reason := c.allow(a.now()); !ok {
+			apiKeyUsage.Add(c.Name+".rejected_"+reason, 1)
+			a.logger.Info("api key quota exceeded", zap.String("client", c.Name), zap.String("quota", reason))
+			code := apierror.QuotaExceeded
+			if reason == "rate" {
+				code = apierror.RateLimited
+				w.Header().Set("Retry-After", "1")
+			}
+			a.writeError(w, r, http.StatusTooManyRequests, code, reason+" quota exceeded")
+			return
+		}
+
+		apiKeyUsage.Add(c.Name+".requests", 1)
+		handler.ServeHTTP(w, r.WithContext(WithClient(r.Context(), c.Name)))
+	})
+}
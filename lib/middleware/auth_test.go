@@ -0,0 +1,58 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestAuthenticate(t *testing.T) {
+	auth := NewAuth(zap.NewNop(), []APIKey{
+		{Name: "limited", Key: "key1", Rate: 1, Burst: 2},
+		{Name: "daily", Key: "key2", DailyLimit: 1},
+	})
+	now := time.Date(2024, 10, 1, 23, 59, 58, 0, time.UTC)
+	auth.now = func() time.Time { return now }
+
+	var client string
+	handler := auth.Authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client = ClientFromContext(r.Context())
+		w.WriteHeader(http.StatusOK)
+	}))
+	request := func(header, query string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/?limit=10"+query, nil)
+		if header != "" {
+			r.Header.Set(APIKeyHeader, header)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	w := request("", "")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.JSONEq(t, `{"error":{"code":"UNAUTHORIZED","message":"missing api key","request_id":""}}`, w.Body.String())
+	assert.Equal(t, http.StatusUnauthorized, request("unknown", "").Code)
+
+	// burst of 2, then the rate of 1 per second
+	assert.Equal(t, http.StatusOK, request("key1", "").Code)
+	assert.Equal(t, http.StatusOK, request("", "&api_key=key1").Code)
+	assert.Equal(t, "limited", client)
+	w = request("key1", "")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.JSONEq(t, `{"error":{"code":"RATE_LIMITED","message":"rate quota exceeded","request_id":""}}`, w.Body.String())
+	now = now.Add(time.Second)
+	assert.Equal(t, http.StatusOK, request("key1", "").Code)
+
+	// the daily limit is reset on the next UTC day
+	assert.Equal(t, http.StatusOK, request("key2", "").Code)
+	w = request("key2", "")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Contains(t, w.Body.String(), `"code":"QUOTA_EXCEEDED"`)
+	now = now.Add(time.Second)
+	assert.Equal(t, http.StatusOK, request("key2", "").Code)
+}
@@ -2,8 +2,11 @@ package middleware
 
 import (
 	"net/http"
+	"net/url"
 
 	"go.uber.org/zap"
+
+	"github.com/awnzl/top_currency_checker/lib/requestid"
 )
 
 type Logger struct {
@@ -16,14 +19,40 @@ func NewMiddlewareLogger(log *zap.Logger) *Logger {
 
 func (l *Logger) Log(handler http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		l.logger.Info("Request", zap.String("URI", r.RequestURI), zap.String("Addr", r.RemoteAddr))
+		l.logger.Info("Request", zap.String("URI", redactURI(r.URL)), zap.String("Addr", r.RemoteAddr),
+			zap.String("RequestID", requestid.FromContext(r.Context())))
 		handler.ServeHTTP(w, r)
 	})
 }
 
+// RequestID takes the request id from the header or generates one, it is returned in the header
+// and in the error responses
+func RequestID(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestid.Header)
+		if !requestid.Valid(id) {
+			id = requestid.New()
+		}
+		w.Header().Set(requestid.Header, id)
+		handler.ServeHTTP(w, r.WithContext(requestid.WithContext(r.Context(), id)))
+	})
+}
+
 func SetContentTypeJSON(handler http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 		handler.ServeHTTP(w, r)
 	})
 }
+
+// hides the api key passed in the query
+func redactURI(u *url.URL) string {
+	query := u.Query()
+	if !query.Has(APIKeyParam) {
+		return u.RequestURI()
+	}
+	query.Set(APIKeyParam, "******")
+	redacted := *u
+	redacted.RawQuery = query.Encode()
+	return redacted.RequestURI()
+}
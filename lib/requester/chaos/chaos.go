@@ -0,0 +1,316 @@
+// Package chaos injects faults into the upstream requests, so the behavior of the stack with
+// misbehaving providers can be checked without waiting for the real outages.
+//
+// A rule is written as [host/]fault[=value]@percent, e.g. "latency=2s@10",
+// "min-api.cryptocompare.com/status=429@5", "error@1", "truncate@5" or "drop_symbols=2@20".
+// The rules without a host apply to every host, each matching rule fires independently at its rate.
+package chaos
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/awnzl/top_currency_checker/lib/secrets"
+)
+
+const (
+	// FaultLatency delays the request by the rule's duration
+	FaultLatency = "latency"
+	// FaultError fails the request as if the connection was reset
+	FaultError = "error"
+	// FaultStatus answers with the rule's status code instead of calling the upstream
+	FaultStatus = "status"
+	// FaultTruncate cuts the response body in half
+	FaultTruncate = "truncate"
+	// FaultDropSymbols removes the rule's number of currencies from the response, 1 by default
+	FaultDropSymbols = "drop_symbols"
+)
+
+// the injected faults by host and fault, e.g. "min-api.cryptocompare.com.latency"
+var injected = expvar.NewMap("upstream_faults")
+
+// InjectedError is returned for the requests failed by the error fault
+var InjectedError = errors.New("chaos: injected connection error")
+
+// Rule is a fault injected into the requests of the host at the rate
+type Rule struct {
+	// Host is the host of the upstream, empty is every host
+	Host    string
+	Fault   string
+	Percent float64
+	// Latency is the delay of the latency fault
+	Latency time.Duration
+	// Status is the status code of the status fault
+	Status int
+	// Symbols is the number of the currencies removed by the drop_symbols fault
+	Symbols int
+}
+
+// ParseRule parses the [host/]fault[=value]@percent rule
+func ParseRule(s string) (Rule, error) {
+	var r Rule
+	spec, percent, ok := strings.Cut(strings.TrimSpace(s), "@")
+	if !ok {
+		return r, fmt.Errorf("chaos: rule %q: the rate is missing, e.g. error@5", s)
+	}
+	p, err := strconv.ParseFloat(strings.TrimSuffix(percent, "%"), 64)
+	if err != nil || p <= 0 || p > 100 {
+		return r, fmt.Errorf("chaos: rule %q: the rate must be a percent from 0 to 100", s)
+	}
+	r.Percent = p
+	if host, fault, ok := strings.Cut(spec, "/"); ok {
+		r.Host, spec = host, fault
+	}
+	fault, value, hasValue := strings.Cut(spec, "=")
+	r.Fault = fault
+
+	switch fault {
+	case FaultLatency:
+		if r.Latency, err = time.ParseDuration(value); err != nil || r.Latency <= 0 {
+			return r, fmt.Errorf("chaos: rule %q: latency requires a positive duration, e.g. latency=2s@10", s)
+		}
+	case FaultStatus:
+		if r.Status, err = strconv.Atoi(value); err != nil || r.Status < 100 || r.Status > 599 {
+			return r, fmt.Errorf("chaos: rule %q: status requires an HTTP status code, e.g. status=503@10", s)
+		}
+	case FaultDropSymbols:
+		r.Symbols = 1
+		if hasValue {
+			if r.Symbols, err = strconv.Atoi(value); err != nil || r.Symbols < 1 {
+				return r, fmt.Errorf("chaos: rule %q: drop_symbols requires a positive number", s)
+			}
+		}
+	case FaultError, FaultTruncate:
+		if hasValue {
+			return r, fmt.Errorf("chaos: rule %q: %s takes no value", s, fault)
+		}
+	default:
+		return r, fmt.Errorf("chaos: rule %q: unknown fault %q, must be latency, error, status, truncate or drop_symbols", s, fault)
+	}
+	return r, nil
+}
+
+// ParseRules parses the rules, all the errors are returned at once
+func ParseRules(specs []string) ([]Rule, error) {
+	var rules []Rule
+	var errs []error
+	for _, s := range specs {
+		r, err := ParseRule(s)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		rules = append(rules, r)
+	}
+	return rules, errors.Join(errs...)
+}
+
+// String returns the rule in the form ParseRule reads
+func (r Rule) String() string {
+	s := r.Fault
+	switch r.Fault {
+	case FaultLatency:
+		s += "=" + r.Latency.String()
+	case FaultStatus:
+		s += "=" + strconv.Itoa(r.Status)
+	case FaultDropSymbols:
+		s += "=" + strconv.Itoa(r.Symbols)
+	}
+	if r.Host != "" {
+		s = r.Host + "/" + s
+	}
+	return s + "@" + strconv.FormatFloat(r.Percent, 'f', -1, 64)
+}
+
+// Transport injects the faults of the rules into the requests passed to the next transport
+type Transport struct {
+	next http.RoundTripper
+
+	mu    sync.RWMutex
+	rules []Rule
+	log   *log.Logger
+}
+
+// NewTransport returns the transport injecting the faults of the rules, no rules is no faults
+func NewTransport(next http.RoundTripper, rules []Rule) *Transport {
+	t := &Transport{
+		next: next,
+		log:  log.New(secrets.RedactWriter(os.Stdout), "Chaos: ", log.LstdFlags|log.Lshortfile),
+	}
+	t.SetRules(rules)
+	return t
+}
+
+// SetRules replaces the rules at runtime
+func (t *Transport) SetRules(rules []Rule) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(rules) > 0 {
+		t.log.Printf("Fault injection enabled: %v\n", rules)
+	} else if len(t.rules) > 0 {
+		t.log.Println("Fault injection disabled")
+	}
+	t.rules = slices.Clone(rules)
+}
+
+// Rules returns the current rules
+func (t *Transport) Rules() []Rule {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return slices.Clone(t.rules)
+}
+
+// draw returns the rules of the host firing for this request
+func (t *Transport) draw(host string) []Rule {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	var fired []Rule
+	for _, r := range t.rules {
+		if (r.Host == "" || r.Host == host) && rand.Float64()*100 < r.Percent {
+			fired = append(fired, r)
+		}
+	}
+	return fired
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := req.URL.Hostname()
+	fired := t.draw(host)
+	if len(fired) == 0 {
+		return t.next.RoundTrip(req)
+	}
+	for _, r := range fired {
+		injected.Add(host+"."+r.Fault, 1)
+		t.log.Printf("Injecting %v into %s %s\n", r, req.Method, secrets.Redact(req.URL.String()))
+	}
+
+	// the faults preventing the upstream call go first
+	for _, r := range fired {
+		switch r.Fault {
+		case FaultLatency:
+			select {
+			case <-time.After(r.Latency):
+			case <-req.Context().Done():
+				return nil, req.Context().Err()
+			}
+		case FaultError:
+			return nil, InjectedError
+		case FaultStatus:
+			body := http.StatusText(r.Status)
+			return &http.Response{
+				Status:        fmt.Sprintf("%d %s", r.Status, body),
+				StatusCode:    r.Status,
+				Proto:         "HTTP/1.1",
+				ProtoMajor:    1,
+				ProtoMinor:    1,
+				Header:        http.Header{"Content-Type": {"text/plain; charset=utf-8"}},
+				Body:          io.NopCloser(strings.NewReader(body)),
+				ContentLength: int64(len(body)),
+				Request:       req,
+			}, nil
+		}
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("chaos: read the response: %w", err)
+	}
+	for _, r := range fired {
+		switch r.Fault {
+		case FaultDropSymbols:
+			body = dropSymbols(body, r.Symbols)
+		case FaultTruncate:
+			body = body[:len(body)/2]
+		}
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Del("Content-Length")
+	return resp, nil
+}
+
+// dropSymbols removes n random currencies from the JSON response: the items of the "data" list
+// (CoinMarketCap) or the keys of the object (CryptoCompare). The other bodies are returned as is.
+func dropSymbols(body []byte, n int) []byte {
+	var obj map[string]json.RawMessage
+	if json.Unmarshal(body, &obj) != nil {
+		return body
+	}
+	if raw, ok := obj["data"]; ok {
+		var data []json.RawMessage
+		if json.Unmarshal(raw, &data) != nil {
+			return body
+		}
+		for i := 0; i < n && len(data) > 0; i++ {
+			j := rand.IntN(len(data))
+			data = slices.Delete(data, j, j+1)
+		}
+		obj["data"], _ = json.Marshal(data)
+	} else {
+		// the error responses have no currencies to drop
+		if _, ok := obj["Response"]; ok {
+			return body
+		}
+		keys := make([]string, 0, len(obj))
+		for k := range obj {
+			keys = append(keys, k)
+		}
+		slices.Sort(keys)
+		for i := 0; i < n && len(keys) > 0; i++ {
+			j := rand.IntN(len(keys))
+			delete(obj, keys[j])
+			keys = slices.Delete(keys, j, j+1)
+		}
+	}
+	b, err := json.Marshal(obj)
+	if err != nil {
+		return body
+	}
+	return b
+}
+
+type rulesJSON struct {
+	Rules []string `json:"rules"`
+}
+
+// ServeHTTP serves the rules as JSON, PUT {"rules":["latency=2s@10"]} replaces them
+func (t *Transport) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPut {
+		var body rulesJSON
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, fmt.Sprintf("invalid body: %v", err), http.StatusBadRequest)
+			return
+		}
+		rules, err := ParseRules(body.Rules)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		t.SetRules(rules)
+	}
+
+	resp := rulesJSON{Rules: []string{}}
+	for _, rule := range t.Rules() {
+		resp.Rules = append(resp.Rules, rule.String())
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,132 @@
+package chaos
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRule(t *testing.T) {
+	for spec, want := range map[string]Rule{
+		"latency=2s@10": {Fault: FaultLatency, Latency: 2 * time.Second, Percent: 10},
+		"min-api.cryptocompare.com/status=429@5%": {Host: "min-api.cryptocompare.com", Fault: FaultStatus, Status: 429, Percent: 5},
+		"error@0.5":       {Fault: FaultError, Percent: 0.5},
+		"truncate@100":    {Fault: FaultTruncate, Percent: 100},
+		"drop_symbols@20": {Fault: FaultDropSymbols, Symbols: 1, Percent: 20},
+	} {
+		r, err := ParseRule(spec)
+		require.NoError(t, err, spec)
+		assert.Equal(t, want, r, spec)
+		again, err := ParseRule(r.String())
+		require.NoError(t, err, r.String())
+		assert.Equal(t, r, again)
+	}
+
+	for _, spec := range []string{"error", "error@0", "error@101", "latency@5", "status=42@5", "error=1@5", "slow@5", "drop_symbols=0@5"} {
+		_, err := ParseRule(spec)
+		assert.Error(t, err, spec)
+	}
+}
+
+type upstream string
+
+func (u upstream) RoundTrip(req *http.Request) (*http.Response, error) {
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       io.NopCloser(strings.NewReader(string(u))),
+		Request:    req,
+	}, nil
+}
+
+func roundTrip(t *testing.T, tr http.RoundTripper, uri string) (*http.Response, string, error) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, uri, nil)
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		return nil, "", err
+	}
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp, string(body), nil
+}
+
+func TestTransport(t *testing.T) {
+	prices := upstream(`{"BTC":{"USD":1},"ETH":{"USD":2},"SOL":{"USD":3}}`)
+	tr := NewTransport(prices, nil)
+
+	_, body, err := roundTrip(t, tr, "https://prices.test/data")
+	require.NoError(t, err)
+	assert.Equal(t, string(prices), body)
+
+	tr.SetRules([]Rule{{Host: "prices.test", Fault: FaultError, Percent: 100}})
+	_, _, err = roundTrip(t, tr, "https://prices.test/data")
+	assert.True(t, errors.Is(err, InjectedError))
+	_, _, err = roundTrip(t, tr, "https://ranks.test/data")
+	assert.NoError(t, err, "the rule of another host")
+
+	tr.SetRules([]Rule{{Fault: FaultStatus, Status: http.StatusServiceUnavailable, Percent: 100}})
+	resp, _, err := roundTrip(t, tr, "https://prices.test/data")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+
+	tr.SetRules([]Rule{{Fault: FaultTruncate, Percent: 100}})
+	_, body, err = roundTrip(t, tr, "https://prices.test/data")
+	require.NoError(t, err)
+	assert.False(t, json.Valid([]byte(body)))
+
+	tr.SetRules([]Rule{{Fault: FaultDropSymbols, Symbols: 2, Percent: 100}})
+	_, body, err = roundTrip(t, tr, "https://prices.test/data")
+	require.NoError(t, err)
+	var left map[string]any
+	require.NoError(t, json.Unmarshal([]byte(body), &left))
+	assert.Len(t, left, 1)
+
+	ranks := upstream(`{"status":{"error_code":0},"data":[{"symbol":"BTC"},{"symbol":"ETH"}]}`)
+	tr = NewTransport(ranks, []Rule{{Fault: FaultDropSymbols, Symbols: 1, Percent: 100}})
+	_, body, err = roundTrip(t, tr, "https://ranks.test/listings")
+	require.NoError(t, err)
+	var listing struct {
+		Data []any `json:"data"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(body), &listing))
+	assert.Len(t, listing.Data, 1)
+
+	tr.SetRules([]Rule{{Fault: FaultLatency, Latency: time.Minute, Percent: 100}})
+	req := httptest.NewRequest(http.MethodGet, "https://ranks.test/listings", nil)
+	ctx, cancel := context.WithTimeout(req.Context(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = tr.RoundTrip(req.WithContext(ctx))
+	assert.Error(t, err)
+	assert.Less(t, time.Since(start), time.Second, "the latency ends with the request")
+}
+
+func TestServeHTTP(t *testing.T) {
+	tr := NewTransport(upstream(`{}`), nil)
+
+	w := httptest.NewRecorder()
+	tr.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/upstream/faults", bytes.NewBufferString(`{"rules":["error@5","latency=1s@10"]}`)))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"rules":["error@5","latency=1s@10"]}`, w.Body.String())
+	assert.Len(t, tr.Rules(), 2)
+
+	w = httptest.NewRecorder()
+	tr.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/upstream/faults", bytes.NewBufferString(`{"rules":["slow@5"]}`)))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Len(t, tr.Rules(), 2, "the invalid rules are rejected")
+
+	w = httptest.NewRecorder()
+	tr.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/upstream/faults", bytes.NewBufferString(`{"rules":[]}`)))
+	assert.JSONEq(t, `{"rules":[]}`, w.Body.String())
+}
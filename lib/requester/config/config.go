@@ -1,39 +1,87 @@
 package config
 
 import (
-	"log"
-
-	"github.com/spf13/viper"
+	"github.com/awnzl/top_currency_checker/lib/config"
+	"github.com/awnzl/top_currency_checker/lib/requester/chaos"
+	"github.com/awnzl/top_currency_checker/lib/requester/fixtures"
 )
 
 type Config struct {
 	ReqTimeout int // seconds
 	RateLimit  int // seconds
 	RetryNum   int
+	// FixturesMode records the upstream exchanges to FixturesDir or replays them from it, empty is off
+	FixturesMode string
+	FixturesDir  string
+	// FaultsEnabled installs the fault injection of the upstream requests and its admin endpoint
+	FaultsEnabled bool
+	// Faults are injected into the upstream requests, see the chaos package
+	Faults []chaos.Rule
 }
 
-func InitConfig(configPath string) {
-	viper.SetConfigFile(configPath)
-	viper.AutomaticEnv()
-
-	viper.SetDefault("request.timeout", 5)
-	viper.BindEnv("request.timeout", "REQUEST_TIMEOUT")
+// Define registers the requester options in the service config loader
+func Define(l *config.Loader) {
+	l.Define("request.timeout", 5, "request-timeout", "upstream request timeout, seconds", "REQUEST_TIMEOUT")
+	l.Define("request.rate_limit", 30, "request-rate-limit", "minimal interval between the same upstream requests, seconds", "REQUEST_RATE_LIMIT")
+	l.Define("request.retry_num", 5, "request-retry-num", "number of retries of a failed upstream request", "REQUEST_RETRY_NUM")
+	l.Define("request.fixtures.mode", "", "request-fixtures-mode", "record the upstream exchanges to the fixtures dir or replay them: record, replay; empty is off", "REQUEST_FIXTURES_MODE")
+	l.Define("request.fixtures.dir", "./fixtures", "request-fixtures-dir", "directory of the recorded upstream exchanges", "REQUEST_FIXTURES_DIR")
+	l.Define("faults.enabled", false, "faults", "install the fault injection of the upstream requests and the admin endpoint changing it, for the tests", "FAULTS_ENABLED")
+	l.Define("request.faults", []string{}, "request-faults", "faults injected into the upstream requests: [host/]fault[=value]@percent, e.g. latency=2s@10", "REQUEST_FAULTS")
+}
 
-	viper.SetDefault("request.rate_limit", 30)
-	viper.BindEnv("request.rate_limit", "REQUEST_RATE_LIMIT")
+// Read reads and validates the requester options, the errors are recorded in the loader
+func Read(l *config.Loader) Config {
+	c := Config{
+		ReqTimeout: l.Int("request.timeout"),
+		RateLimit:  l.Int("request.rate_limit"),
+		RetryNum:   l.Int("request.retry_num"),
 
-	viper.SetDefault("request.retry_num", 5)
-	viper.BindEnv("request.retry_num", "REQUEST_RETRY_NUM")
+		FixturesMode: l.String("request.fixtures.mode"),
+		FixturesDir:  l.String("request.fixtures.dir"),
 
-	if err := viper.ReadInConfig(); err != nil {
-		log.Printf("Error reading config file: %v", err)
+		FaultsEnabled: l.Bool("faults.enabled"),
+	}
+	for _, spec := range l.Strings("request.faults") {
+		rule, err := chaos.ParseRule(spec)
+		if err != nil {
+			l.Invalid("request.faults", err.Error())
+			continue
+		}
+		c.Faults = append(c.Faults, rule)
+	}
+	l.Check(c.FaultsEnabled || len(c.Faults) == 0, "request.faults", "requires faults.enabled")
+	l.Check(c.ReqTimeout > 0, "request.timeout", "must be positive")
+	l.Check(c.RateLimit >= 0, "request.rate_limit", "must not be negative")
+	l.Check(c.RetryNum >= 0, "request.retry_num", "must not be negative")
+	l.Check(c.FixturesMode == "" || c.FixturesMode == fixtures.ModeRecord || c.FixturesMode == fixtures.ModeReplay,
+		"request.fixtures.mode", "must be record, replay or empty")
+	l.Check(c.FixturesMode == "" || c.FixturesDir != "", "request.fixtures.dir", "is required with request.fixtures.mode")
+	if c.FixturesMode == fixtures.ModeReplay {
+		l.CheckFile("request.fixtures.dir", c.FixturesDir)
 	}
+	return c
 }
 
-func GetConfig() Config {
-	return Config{
-		ReqTimeout: viper.GetInt("request.timeout"),
-		RateLimit:  viper.GetInt("request.rate_limit"),
-		RetryNum:   viper.GetInt("request.retry_num"),
+// Budget is the number of the upstream credits each API key may use, 0 is unlimited
+type Budget struct {
+	Monthly int
+	Minute  int
+}
+
+// DefineBudget registers the API key budget options in the service config loader
+func DefineBudget(l *config.Loader) {
+	l.Define("api.key_budget.monthly", 0, "api-key-monthly-credits", "upstream credits each API key may use per calendar month, 0 is unlimited", "API_KEY_MONTHLY_CREDITS")
+	l.Define("api.key_budget.minute", 0, "api-key-minute-credits", "upstream credits each API key may use per minute, 0 is unlimited", "API_KEY_MINUTE_CREDITS")
+}
+
+// ReadBudget reads and validates the API key budget, the errors are recorded in the loader
+func ReadBudget(l *config.Loader) Budget {
+	b := Budget{
+		Monthly: l.Int("api.key_budget.monthly"),
+		Minute:  l.Int("api.key_budget.minute"),
 	}
-}
\ No newline at end of file
+	l.Check(b.Monthly >= 0, "api.key_budget.monthly", "must not be negative")
+	l.Check(b.Minute >= 0, "api.key_budget.minute", "must not be negative")
+	return b
+}
@@ -0,0 +1,183 @@
+// Package fixtures records the upstream exchanges to golden files and replays them, so the
+// collectors can be tested and demoed offline.
+//
+// Each exchange is a JSON file in the directory, named after the request path and a hash of
+// the method and the URL. The API keys are not recorded: the key headers are dropped, the key
+// query parameters are removed from the URLs and the known secret values are redacted.
+package fixtures
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/awnzl/top_currency_checker/lib/secrets"
+)
+
+const (
+	ModeRecord = "record"
+	ModeReplay = "replay"
+)
+
+// the query parameters carrying the API keys
+var keyParams = []string{"api_key", "apikey", "CMC_PRO_API_KEY"}
+
+// Exchange is the recorded request and response
+type Exchange struct {
+	Request struct {
+		Method string `json:"method"`
+		URL    string `json:"url"`
+	} `json:"request"`
+	Response struct {
+		Status int         `json:"status"`
+		Header http.Header `json:"header,omitempty"`
+		// Body is the JSON body as is, the other bodies are kept in BodyText
+		Body     json.RawMessage `json:"body,omitempty"`
+		BodyText string          `json:"body_text,omitempty"`
+	} `json:"response"`
+}
+
+// Transport returns the transport of the mode, the default one if the mode is empty
+func Transport(mode, dir string) http.RoundTripper {
+	switch mode {
+	case ModeRecord:
+		return &Recorder{Dir: dir, Next: http.DefaultTransport}
+	case ModeReplay:
+		return &Replayer{Dir: dir}
+	}
+	return http.DefaultTransport
+}
+
+// scrubURL returns the URL without the key parameters and with the query sorted
+func scrubURL(u *url.URL) string {
+	scrubbed := *u
+	query := scrubbed.Query()
+	for _, p := range keyParams {
+		query.Del(p)
+	}
+	scrubbed.RawQuery = query.Encode()
+	return secrets.Redact(scrubbed.String())
+}
+
+// File returns the name of the golden file of the request
+func File(req *http.Request) string {
+	sum := sha256.Sum256([]byte(req.Method + " " + scrubURL(req.URL)))
+	name := strings.Trim(path.Base(req.URL.Path), "/.")
+	if name == "" {
+		name = "root"
+	}
+	return fmt.Sprintf("%s_%s_%s.json", req.Method, name, hex.EncodeToString(sum[:4]))
+}
+
+// Recorder passes the requests to the next transport and writes the exchanges to the directory
+type Recorder struct {
+	Dir  string
+	Next http.RoundTripper
+}
+
+func (r *Recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := r.Next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("fixtures: read the response: %w", err)
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	var ex Exchange
+	ex.Request.Method = req.Method
+	ex.Request.URL = scrubURL(req.URL)
+	ex.Response.Status = resp.StatusCode
+	if ct := resp.Header.Get("Content-Type"); ct != "" {
+		ex.Response.Header = http.Header{"Content-Type": {ct}}
+	}
+	scrubbed := secrets.Redact(string(body))
+	if json.Valid([]byte(scrubbed)) {
+		ex.Response.Body = json.RawMessage(scrubbed)
+	} else {
+		ex.Response.BodyText = scrubbed
+	}
+	if err := write(filepath.Join(r.Dir, File(req)), ex); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// write replaces the file at once, so the concurrent replays never read a partial one
+func write(file string, ex Exchange) error {
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(ex); err != nil {
+		return fmt.Errorf("fixtures: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+		return fmt.Errorf("fixtures: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(file), ".recording-*")
+	if err != nil {
+		return fmt.Errorf("fixtures: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b.Bytes()); err != nil {
+		tmp.Close()
+		return fmt.Errorf("fixtures: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("fixtures: %w", err)
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+// Replayer serves the recorded exchanges, the requests without a recording fail
+type Replayer struct {
+	Dir string
+}
+
+func (r *Replayer) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := req.Context().Err(); err != nil {
+		return nil, err
+	}
+	file := filepath.Join(r.Dir, File(req))
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("fixtures: no recording of %s %s: %w", req.Method, scrubURL(req.URL), err)
+	}
+	var ex Exchange
+	if err := json.Unmarshal(b, &ex); err != nil {
+		return nil, fmt.Errorf("fixtures: %s: %w", file, err)
+	}
+
+	body := []byte(ex.Response.BodyText)
+	if len(ex.Response.Body) > 0 {
+		body = ex.Response.Body
+	}
+	header := ex.Response.Header
+	if header == nil {
+		header = http.Header{}
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", ex.Response.Status, http.StatusText(ex.Response.Status)),
+		StatusCode:    ex.Response.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}, nil
+}
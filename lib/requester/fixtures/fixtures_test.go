@@ -0,0 +1,65 @@
+package fixtures
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/awnzl/top_currency_checker/lib/secrets"
+)
+
+type upstream struct{}
+
+func (upstream) RoundTrip(req *http.Request) (*http.Response, error) {
+	// the upstreams may echo the key
+	body := `{"key":"` + req.URL.Query().Get("api_key") + `","price":1.5}`
+	return &http.Response{
+		StatusCode: http.StatusTooManyRequests,
+		Header:     http.Header{"Content-Type": {"application/json"}, "Set-Cookie": {"session=1"}},
+		Body:       io.NopCloser(bytes.NewBufferString(body)),
+	}, nil
+}
+
+func TestRecordReplay(t *testing.T) {
+	dir := t.TempDir()
+	secrets.Literal("recorded-secret-key")
+
+	req, err := http.NewRequest(http.MethodGet, "https://upstream/data/price?fsyms=BTC&api_key=recorded-secret-key", nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Apikey recorded-secret-key")
+	resp, err := (&Recorder{Dir: dir, Next: upstream{}}).RoundTrip(req)
+	require.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	assert.Contains(t, string(body), "recorded-secret-key", "the caller gets the response as is")
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	assert.Equal(t, "GET_price_", filepath.Base(files[0])[:10])
+	recorded, err := os.ReadFile(files[0])
+	require.NoError(t, err)
+	assert.NotContains(t, string(recorded), "recorded-secret-key")
+	assert.NotContains(t, string(recorded), "Set-Cookie")
+	assert.Contains(t, string(recorded), `"url": "https://upstream/data/price?fsyms=BTC"`)
+
+	// the replay matches the request with another key
+	req, err = http.NewRequest(http.MethodGet, "https://upstream/data/price?api_key=other&fsyms=BTC", nil)
+	require.NoError(t, err)
+	resp, err = (&Replayer{Dir: dir}).RoundTrip(req)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	body, _ = io.ReadAll(resp.Body)
+	assert.JSONEq(t, `{"key":"******","price":1.5}`, string(body))
+
+	req, err = http.NewRequest(http.MethodGet, "https://upstream/data/price?fsyms=ETH", nil)
+	require.NoError(t, err)
+	_, err = (&Replayer{Dir: dir}).RoundTrip(req)
+	assert.ErrorContains(t, err, "no recording of GET https://upstream/data/price?fsyms=ETH")
+}
@@ -0,0 +1,286 @@
+package requester
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/awnzl/top_currency_checker/lib/coalesce"
+	"github.com/awnzl/top_currency_checker/lib/requester/config"
+	"github.com/awnzl/top_currency_checker/lib/secrets"
+)
+
+var KeysExhaustedError = errors.New("all API keys are out of credits")
+
+// the state of the key pools per provider
+var keyPools = expvar.NewMap("upstream_keys")
+
+// KeyProvider describes how the upstream takes the API keys and reports the exhausted ones
+type KeyProvider struct {
+	// Name is the name of the pool in the metrics
+	Name string
+	// SetKey sets the key on the request
+	SetKey func(req *http.Request, key string)
+	// QuotaError reports whether the response says that the key is out of credits, and until when
+	QuotaError func(data []byte, now time.Time) (time.Time, bool)
+}
+
+// KeyPool tracks the credits used by the API keys. The requests use one key until it runs out
+// of its budget or the upstream reports a quota error, then the next one.
+type KeyPool struct {
+	provider KeyProvider
+
+	mu      sync.Mutex
+	sources []secrets.Source
+	budget  config.Budget
+	// the usage is tracked per key value, so a rotated key starts with its own counters
+	usage map[string]*keyUsage
+	// index of the key used first
+	current int
+	now     func() time.Time
+}
+
+type keyUsage struct {
+	month, minute     time.Time
+	monthly, minutely int
+	exhaustedUntil    time.Time
+}
+
+// roll resets the counters of the periods which are over
+func (u *keyUsage) roll(now time.Time) {
+	if month := PeriodStart(now, "month"); !month.Equal(u.month) {
+		u.month, u.monthly = month, 0
+	}
+	if minute := PeriodStart(now, "minute"); !minute.Equal(u.minute) {
+		u.minute, u.minutely = minute, 0
+	}
+}
+
+type poolKey struct {
+	value string
+	id    string
+}
+
+// KeyStatus is the usage of a key served by the admin endpoint and in the metrics,
+// the key is identified by a short hash of its value
+type KeyStatus struct {
+	Key             string     `json:"key"`
+	Active          bool       `json:"active"`
+	UsedMonth       int        `json:"used_month"`
+	RemainingMonth  *int       `json:"remaining_month,omitempty"`
+	UsedMinute      int        `json:"used_minute"`
+	RemainingMinute *int       `json:"remaining_minute,omitempty"`
+	ExhaustedUntil  *time.Time `json:"exhausted_until,omitempty"`
+	Error           string     `json:"error,omitempty"`
+}
+
+// NewKeyPool returns the pool of the keys and publishes its state in the upstream_keys metrics
+func NewKeyPool(provider KeyProvider, sources []secrets.Source, budget config.Budget) *KeyPool {
+	p := &KeyPool{
+		provider: provider,
+		sources:  sources,
+		budget:   budget,
+		usage:    make(map[string]*keyUsage),
+		now:      time.Now,
+	}
+	keyPools.Set(provider.Name, expvar.Func(func() any { return p.Status() }))
+	return p
+}
+
+// SetKeys changes the keys and the budget at runtime, the usage of the kept keys is preserved
+func (p *KeyPool) SetKeys(sources []secrets.Source, budget config.Budget) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sources, p.budget = sources, budget
+	p.current = 0
+}
+
+func keyID(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:4])
+}
+
+func (p *KeyPool) usageOf(id string, now time.Time) *keyUsage {
+	u, ok := p.usage[id]
+	if !ok {
+		u = &keyUsage{}
+		p.usage[id] = u
+	}
+	u.roll(now)
+	return u
+}
+
+func (p *KeyPool) fits(u *keyUsage, credits int, now time.Time) bool {
+	if now.Before(u.exhaustedUntil) {
+		return false
+	}
+	if p.budget.Monthly > 0 && u.monthly+credits > p.budget.Monthly {
+		return false
+	}
+	return p.budget.Minute <= 0 || u.minutely+credits <= p.budget.Minute
+}
+
+// acquire returns the first key, starting from the current one, with the credits left and charges them
+func (p *KeyPool) acquire(credits int) (poolKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.now()
+	var lastErr error
+	for i := range p.sources {
+		idx := (p.current + i) % len(p.sources)
+		value, err := p.sources[idx].Value()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		id := keyID(value)
+		u := p.usageOf(id, now)
+		if !p.fits(u, credits, now) {
+			continue
+		}
+		u.monthly += credits
+		u.minutely += credits
+		p.current = idx
+		return poolKey{value: value, id: id}, nil
+	}
+	if lastErr != nil {
+		return poolKey{}, fmt.Errorf("%w, last key error: %w", KeysExhaustedError, lastErr)
+	}
+	return poolKey{}, KeysExhaustedError
+}
+
+// exhaust marks the key as out of credits until the time and moves to the next key
+func (p *KeyPool) exhaust(key poolKey, until time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.usageOf(key.id, p.now()).exhaustedUntil = until
+	if len(p.sources) > 0 {
+		p.current = (p.current + 1) % len(p.sources)
+	}
+}
+
+// UsedMonth returns the credits used by all the keys, including the replaced ones, in the current month
+func (p *KeyPool) UsedMonth() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	used := 0
+	for _, u := range p.usage {
+		u.roll(p.now())
+		used += u.monthly
+	}
+	return used
+}
+
+// Status returns the usage of the keys in the pool order
+func (p *KeyPool) Status() []KeyStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.now()
+	res := make([]KeyStatus, 0, len(p.sources))
+	for idx, src := range p.sources {
+		value, err := src.Value()
+		if err != nil {
+			res = append(res, KeyStatus{Error: secrets.Redact(err.Error())})
+			continue
+		}
+		id := keyID(value)
+		u := p.usageOf(id, now)
+		st := KeyStatus{
+			Key:        id,
+			Active:     idx == p.current,
+			UsedMonth:  u.monthly,
+			UsedMinute: u.minutely,
+		}
+		if p.budget.Monthly > 0 {
+			remaining := max(p.budget.Monthly-u.monthly, 0)
+			st.RemainingMonth = &remaining
+		}
+		if p.budget.Minute > 0 {
+			remaining := max(p.budget.Minute-u.minutely, 0)
+			st.RemainingMinute = &remaining
+		}
+		if now.Before(u.exhaustedUntil) {
+			until := u.exhaustedUntil
+			st.ExhaustedUntil = &until
+		}
+		res = append(res, st)
+	}
+	return res
+}
+
+// ServeHTTP serves the status of the keys as JSON
+func (p *KeyPool) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p.Status())
+}
+
+// GetDataWithKey requests the data as GetData, with a key of the pool charged with the credits.
+// When the upstream reports that the key is out of credits, the request is repeated with the next key.
+func (r *Requester) GetDataWithKey(req *http.Request, pool *KeyPool, credits int) ([]byte, error) {
+	return coalesce.Do(req.Context(), r.flights, req.Method+" "+req.URL.String(), func(ctx context.Context) ([]byte, error) {
+		if err := r.checkRateLimit(req); err != nil {
+			return nil, err
+		}
+		for {
+			key, err := pool.acquire(credits)
+			if err != nil {
+				return nil, err
+			}
+			keyed := req.Clone(ctx)
+			pool.provider.SetKey(keyed, key.value)
+			data, err := r.requestWithRetry(keyed)
+			if err != nil {
+				return nil, err
+			}
+			until, ok := pool.provider.QuotaError(data, pool.now())
+			if !ok {
+				return data, nil
+			}
+			r.log.Printf("API key %s of %s is out of credits until %s, switching to the next key", key.id, pool.provider.Name, until.Format(time.RFC3339))
+			pool.exhaust(key, until)
+		}
+	})
+}
+
+// PeriodStart returns the start of the UTC second, minute, hour, day or month of the time
+func PeriodStart(t time.Time, period string) time.Time {
+	t = t.UTC()
+	switch period {
+	case "second":
+		return t.Truncate(time.Second)
+	case "minute":
+		return t.Truncate(time.Minute)
+	case "hour":
+		return t.Truncate(time.Hour)
+	case "day":
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	case "month":
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	}
+	panic("requester: unknown period " + period)
+}
+
+// PeriodEnd returns the start of the next UTC second, minute, hour, day or month of the time
+func PeriodEnd(t time.Time, period string) time.Time {
+	start := PeriodStart(t, period)
+	switch period {
+	case "second":
+		return start.Add(time.Second)
+	case "minute":
+		return start.Add(time.Minute)
+	case "hour":
+		return start.Add(time.Hour)
+	case "day":
+		return start.AddDate(0, 0, 1)
+	}
+	return start.AddDate(0, 1, 0)
+}
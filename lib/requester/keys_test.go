@@ -0,0 +1,105 @@
+package requester
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/awnzl/top_currency_checker/lib/requester/config"
+	"github.com/awnzl/top_currency_checker/lib/requester/mocks"
+	"github.com/awnzl/top_currency_checker/lib/secrets"
+)
+
+var testKeys = KeyProvider{
+	Name: "test",
+	SetKey: func(req *http.Request, key string) {
+		req.Header.Set("X-Key", key)
+	},
+	QuotaError: func(data []byte, now time.Time) (time.Time, bool) {
+		return PeriodEnd(now, "day"), string(data) == "quota"
+	},
+}
+
+func TestKeyPoolBudget(t *testing.T) {
+	now := time.Date(2024, 5, 31, 23, 59, 30, 0, time.UTC)
+	pool := NewKeyPool(testKeys, []secrets.Source{secrets.Literal("first-key"), secrets.Literal("second-key")},
+		config.Budget{Monthly: 5, Minute: 3})
+	pool.now = func() time.Time { return now }
+
+	var used []string
+	for i := 0; i < 2; i++ {
+		key, err := pool.acquire(2)
+		require.NoError(t, err)
+		used = append(used, key.value)
+	}
+	// 2 credits per minute fit in each key's minute budget of 3
+	assert.Equal(t, []string{"first-key", "second-key"}, used)
+	_, err := pool.acquire(2)
+	assert.True(t, errors.Is(err, KeysExhaustedError), err)
+
+	// the minute and the month roll over, the pool stays with the last used key
+	now = now.Add(time.Minute)
+	key, err := pool.acquire(3)
+	require.NoError(t, err)
+	assert.Equal(t, "second-key", key.value)
+
+	status := pool.Status()
+	require.Len(t, status, 2)
+	assert.Equal(t, keyID("first-key"), status[0].Key)
+	assert.False(t, status[0].Active)
+	assert.Equal(t, 0, status[0].UsedMonth)
+	assert.True(t, status[1].Active)
+	assert.Equal(t, 3, status[1].UsedMonth)
+	assert.Equal(t, 2, *status[1].RemainingMonth)
+	assert.Equal(t, 0, *status[1].RemainingMinute)
+}
+
+func TestGetDataWithKeyRotation(t *testing.T) {
+	c := gomock.NewController(t)
+	defer c.Finish()
+
+	var keys []string
+	mockClient := mocks.NewMockclientAPI(c)
+	mockClient.EXPECT().Do(gomock.Any()).DoAndReturn(
+		func(req *http.Request) (*http.Response, error) {
+			key := req.Header.Get("X-Key")
+			keys = append(keys, key)
+			body := "data"
+			if key == "first-key" {
+				body = "quota"
+			}
+			return &http.Response{Body: io.NopCloser(bytes.NewBufferString(body))}, nil
+		},
+	).Times(3)
+
+	r := New(config.Config{ReqTimeout: 1})
+	r.client = mockClient
+	pool := NewKeyPool(testKeys, []secrets.Source{secrets.Literal("first-key"), secrets.Literal("second-key")}, config.Budget{})
+
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, "http://upstream/data?a=1", nil)
+	require.NoError(t, err)
+	data, err := r.GetDataWithKey(req, pool, 1)
+	require.NoError(t, err)
+	assert.Equal(t, "data", string(data))
+	assert.Equal(t, []string{"first-key", "second-key"}, keys)
+	assert.Empty(t, req.Header.Get("X-Key"), "the caller's request is not changed")
+
+	// the exhausted key is skipped by the following requests
+	req, err = http.NewRequestWithContext(context.Background(), http.MethodGet, "http://upstream/data?a=2", nil)
+	require.NoError(t, err)
+	_, err = r.GetDataWithKey(req, pool, 1)
+	require.NoError(t, err)
+	assert.Equal(t, "second-key", keys[2])
+
+	status := pool.Status()
+	assert.NotNil(t, status[0].ExhaustedUntil)
+	assert.True(t, status[1].Active)
+}
@@ -2,19 +2,25 @@ package requester
 
 import (
 	"context"
-	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
+	"slices"
 	"sync"
 	"time"
 
+	"github.com/awnzl/top_currency_checker/lib/coalesce"
+	"github.com/awnzl/top_currency_checker/lib/requester/chaos"
 	"github.com/awnzl/top_currency_checker/lib/requester/config"
+	"github.com/awnzl/top_currency_checker/lib/requester/fixtures"
+	"github.com/awnzl/top_currency_checker/lib/secrets"
+	"github.com/awnzl/top_currency_checker/lib/upstream"
 )
 
-var RateLimitError = errors.New("rate limit exceeded")
+// RateLimitError is returned when the provider rate limits the requests, see upstream
+var RateLimitError = upstream.RateLimitError
 
 type clientAPI interface {
 	Do(req *http.Request) (*http.Response, error)
@@ -23,21 +29,54 @@ type clientAPI interface {
 type Requester struct {
 	config     config.Config
 	client     clientAPI
+	faults     *chaos.Transport
 	limitCache map[string]time.Time
 	mu         sync.Mutex
+	flights    *coalesce.Group
 	log        *log.Logger
 }
 
 func New(config config.Config) Requester {
+	transport := fixtures.Transport(config.FixturesMode, config.FixturesDir)
+	// the faults are injected only if they are enabled, production requests don't pass the chaos transport
+	var faults *chaos.Transport
+	if config.FaultsEnabled {
+		faults = chaos.NewTransport(transport, config.Faults)
+		transport = faults
+	}
 	return Requester{
-		config: config,
-		client: &http.Client{},
+		config:     config,
+		client:     &http.Client{Transport: transport},
+		faults:     faults,
 		limitCache: make(map[string]time.Time),
-		mu: sync.Mutex{},
-		log: log.New(os.Stdout, "Requester: ", log.LstdFlags | log.Lshortfile),
+		mu:         sync.Mutex{},
+		flights:    coalesce.New("upstream"),
+		log:        log.New(secrets.RedactWriter(os.Stdout), "Requester: ", log.LstdFlags|log.Lshortfile),
 	}
 }
 
+// SetConfig changes the requester configuration at runtime, it is used by the following requests
+func (r *Requester) SetConfig(config config.Config) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// the rules set on the admin endpoint are kept until the configured ones change
+	if r.faults != nil && !slices.Equal(r.config.Faults, config.Faults) {
+		r.faults.SetRules(config.Faults)
+	}
+	r.config = config
+}
+
+// Faults returns the fault injection of the upstream requests, it serves the rules; nil if it is not enabled
+func (r *Requester) Faults() *chaos.Transport {
+	return r.faults
+}
+
+func (r *Requester) getConfig() config.Config {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.config
+}
+
 func (r *Requester) checkRateLimit(req *http.Request) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
@@ -52,17 +91,21 @@ func (r *Requester) checkRateLimit(req *http.Request) error {
 	return nil
 }
 
+// GetData requests the data with retries. The concurrent requests of the same URL share one upstream request.
 func (r *Requester) GetData(req *http.Request) ([]byte, error) {
-	if err := r.checkRateLimit(req); err != nil {
-		return nil, err
-	}
-	return r.requestWithRetry(req)
+	return coalesce.Do(req.Context(), r.flights, req.Method+" "+req.URL.String(), func(ctx context.Context) ([]byte, error) {
+		if err := r.checkRateLimit(req); err != nil {
+			return nil, err
+		}
+		return r.requestWithRetry(req.WithContext(ctx))
+	})
 }
 
 func (r *Requester) requestWithRetry(req *http.Request) (data []byte, err error) {
 	incomingCtx := req.Context()
+	conf := r.getConfig()
 	worker := func() ([]byte, error) {
-		ctx, cancel := context.WithTimeout(incomingCtx, time.Duration(r.config.ReqTimeout) * time.Second)
+		ctx, cancel := context.WithTimeout(incomingCtx, time.Duration(conf.ReqTimeout)*time.Second)
 		defer cancel()
 		req = req.WithContext(ctx)
 
@@ -79,16 +122,23 @@ func (r *Requester) requestWithRetry(req *http.Request) (data []byte, err error)
 		return data, nil
 	}
 
-	for i := 0; i <= r.config.RetryNum; i++ {
+	for i := 0; i <= conf.RetryNum; i++ {
 		select {
 		case <-incomingCtx.Done():
-			return nil, fmt.Errorf("request canceled: %w", req.Context().Err())
+			return nil, fmt.Errorf("request canceled: %w", incomingCtx.Err())
 		default:
 			if data, err = worker(); err == nil {
 				return data, nil
 			}
 			r.log.Printf("Request is failed, attempt #%d, error: %v", i, err.Error())
-			time.Sleep(time.Duration(300) * time.Millisecond)
+		}
+		if i == conf.RetryNum {
+			break
+		}
+		select {
+		case <-incomingCtx.Done():
+			return nil, fmt.Errorf("request canceled: %w, last error: %v", incomingCtx.Err(), err)
+		case <-time.After(time.Duration(300) * time.Millisecond):
 		}
 	}
 
@@ -0,0 +1,38 @@
+// Package requestid identifies the HTTP requests in the logs and the error responses
+package requestid
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"regexp"
+)
+
+// Header carries the request id, the clients can set their own one
+const Header = "X-Request-ID"
+
+var validRe = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+type ctxKey struct{}
+
+// New returns a random request id
+func New() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Valid reports whether the id received from a client can be used as is
+func Valid(id string) bool {
+	return validRe.MatchString(id)
+}
+
+func WithContext(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, ctxKey{}, id)
+}
+
+// FromContext returns the request id or an empty string
+func FromContext(ctx context.Context) string {
+	id, _ := ctx.Value(ctxKey{}).(string)
+	return id
+}
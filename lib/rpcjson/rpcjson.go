@@ -0,0 +1,210 @@
+// Package rpcjson serves the unary RPCs of a gRPC service as HTTP/JSON, it is meant for debugging with curl
+// on the internal admin ports. Every method is served Connect-style at POST /<package>.<Service>/<Method>
+// with the JSON request in the body; the methods annotated with (httpapi.http).get are also served at GET <path>
+// with the request fields in the query parameters.
+package rpcjson
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+
+	"github.com/awnzl/top_currency_checker/lib/apierror"
+	"github.com/awnzl/top_currency_checker/lib/proto/httpapi"
+)
+
+var marshalOptions = protojson.MarshalOptions{EmitUnpopulated: true}
+
+// Register adds the routes of the service implemented by srv, it is registered the same way as on grpc.Server
+func Register(router *mux.Router, desc *grpc.ServiceDesc, srv any) error {
+	d, err := protoregistry.GlobalFiles.FindDescriptorByName(protoreflect.FullName(desc.ServiceName))
+	if err != nil {
+		return fmt.Errorf("find service %s: %w", desc.ServiceName, err)
+	}
+	sd, ok := d.(protoreflect.ServiceDescriptor)
+	if !ok {
+		return fmt.Errorf("%s is not a service", desc.ServiceName)
+	}
+
+	for _, m := range desc.Methods {
+		md := sd.Methods().ByName(protoreflect.Name(m.MethodName))
+		if md == nil {
+			return fmt.Errorf("find method %s.%s", desc.ServiceName, m.MethodName)
+		}
+		reqType, err := protoregistry.GlobalTypes.FindMessageByName(md.Input().FullName())
+		if err != nil {
+			return fmt.Errorf("find request type of %s.%s: %w", desc.ServiceName, m.MethodName, err)
+		}
+		mt := method{srv: srv, handler: m.Handler, reqType: reqType}
+
+		router.HandleFunc("/"+desc.ServiceName+"/"+m.MethodName, mt.servePost).Methods(http.MethodPost)
+		if rule, ok := proto.GetExtension(md.Options(), httpapi.E_Http).(*httpapi.HttpRule); ok && rule.GetGet() != "" {
+			router.HandleFunc(rule.GetGet(), mt.serveGet).Methods(http.MethodGet)
+		}
+	}
+	return nil
+}
+
+type method struct {
+	srv     any
+	handler func(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error)
+	reqType protoreflect.MessageType
+}
+
+func (m method) servePost(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, r, status.Errorf(codes.InvalidArgument, "read body: %v", err))
+		return
+	}
+	m.call(w, r, func(req proto.Message) error {
+		if len(body) == 0 {
+			return nil
+		}
+		return protojson.Unmarshal(body, req)
+	})
+}
+
+func (m method) serveGet(w http.ResponseWriter, r *http.Request) {
+	m.call(w, r, func(req proto.Message) error {
+		return fromQuery(req.ProtoReflect(), r.URL.Query())
+	})
+}
+
+func (m method) call(w http.ResponseWriter, r *http.Request, decode func(proto.Message) error) {
+	dec := func(v any) error {
+		if err := decode(v.(proto.Message)); err != nil {
+			return status.Errorf(codes.InvalidArgument, "decode request: %v", err)
+		}
+		return nil
+	}
+	// the generated handler allocates the request of its type and decodes it with dec
+	resp, err := m.handler(m.srv, r.Context(), dec, nil)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	b, err := marshalOptions.Marshal(resp.(proto.Message))
+	if err != nil {
+		writeError(w, r, status.Errorf(codes.Internal, "encode response: %v", err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(b); err != nil {
+		log.Println("rpcjson: write response:", err)
+	}
+}
+
+// fromQuery sets the scalar fields of the message by their proto or JSON names,
+// the repeated fields take the repeated parameters or comma separated values
+func fromQuery(msg protoreflect.Message, values map[string][]string) error {
+	fields := msg.Descriptor().Fields()
+	for name, vals := range values {
+		fd := fields.ByName(protoreflect.Name(name))
+		if fd == nil {
+			fd = fields.ByJSONName(name)
+		}
+		if fd == nil {
+			return fmt.Errorf("unknown field %q", name)
+		}
+		if fd.IsMap() || fd.Kind() == protoreflect.MessageKind || fd.Kind() == protoreflect.GroupKind {
+			return fmt.Errorf("field %q can't be set in the query, use POST", name)
+		}
+
+		if fd.IsList() {
+			list := msg.Mutable(fd).List()
+			for _, val := range vals {
+				for _, item := range strings.Split(val, ",") {
+					v, err := parseScalar(fd, item)
+					if err != nil {
+						return err
+					}
+					list.Append(v)
+				}
+			}
+			continue
+		}
+		v, err := parseScalar(fd, vals[len(vals)-1])
+		if err != nil {
+			return err
+		}
+		msg.Set(fd, v)
+	}
+	return nil
+}
+
+func parseScalar(fd protoreflect.FieldDescriptor, s string) (protoreflect.Value, error) {
+	var v protoreflect.Value
+	var err error
+	switch fd.Kind() {
+	case protoreflect.StringKind:
+		v = protoreflect.ValueOfString(s)
+	case protoreflect.BoolKind:
+		var b bool
+		b, err = strconv.ParseBool(s)
+		v = protoreflect.ValueOfBool(b)
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind:
+		var n int64
+		n, err = strconv.ParseInt(s, 10, 32)
+		v = protoreflect.ValueOfInt32(int32(n))
+	case protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		var n int64
+		n, err = strconv.ParseInt(s, 10, 64)
+		v = protoreflect.ValueOfInt64(n)
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind:
+		var n uint64
+		n, err = strconv.ParseUint(s, 10, 32)
+		v = protoreflect.ValueOfUint32(uint32(n))
+	case protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		var n uint64
+		n, err = strconv.ParseUint(s, 10, 64)
+		v = protoreflect.ValueOfUint64(n)
+	case protoreflect.FloatKind:
+		var f float64
+		f, err = strconv.ParseFloat(s, 32)
+		v = protoreflect.ValueOfFloat32(float32(f))
+	case protoreflect.DoubleKind:
+		var f float64
+		f, err = strconv.ParseFloat(s, 64)
+		v = protoreflect.ValueOfFloat64(f)
+	case protoreflect.EnumKind:
+		ev := fd.Enum().Values().ByName(protoreflect.Name(s))
+		if ev == nil {
+			return v, fmt.Errorf("invalid %s value %q", fd.Name(), s)
+		}
+		v = protoreflect.ValueOfEnum(ev.Number())
+	default:
+		return v, fmt.Errorf("field %q can't be set in the query, use POST", fd.Name())
+	}
+	if err != nil {
+		return v, fmt.Errorf("invalid %s value %q", fd.Name(), s)
+	}
+	return v, nil
+}
+
+// writeError sends the error envelope of the API with the status message, the admin port is internal
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	st := status.Convert(err)
+	if st.Code() == codes.Canceled {
+		return
+	}
+	code, httpStatus, _ := apierror.FromError(err)
+	if err := apierror.Write(r.Context(), w, httpStatus, code, st.Message()); err != nil {
+		log.Println("rpcjson: write response:", err)
+	}
+}
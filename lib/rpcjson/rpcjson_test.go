@@ -0,0 +1,60 @@
+package rpcjson
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+
+	"github.com/awnzl/top_currency_checker/lib/apierror"
+	pc "github.com/awnzl/top_currency_checker/lib/proto/pricecollector"
+)
+
+type prices struct {
+	pc.UnimplementedPriceServiceServer
+}
+
+func (prices) GetPrices(_ context.Context, req *pc.PriceRequest) (*pc.PriceResponse, error) {
+	resp := &pc.PriceResponse{Prices: map[string]float64{}, AsOf: 1000}
+	for i, symbol := range req.List {
+		resp.Prices[symbol] = float64(i + 1)
+	}
+	return resp, nil
+}
+
+func (prices) GetCoin(_ context.Context, req *pc.CoinPriceRequest) (*pc.CoinPriceResponse, error) {
+	return nil, apierror.Status(codes.NotFound, apierror.NotFound, "no price for %s", req.Symbol)
+}
+
+func TestRegister(t *testing.T) {
+	router := mux.NewRouter()
+	require.NoError(t, Register(router, &pc.PriceService_ServiceDesc, prices{}))
+
+	serve := func(method, uri, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, uri, strings.NewReader(body)))
+		return w
+	}
+
+	// the annotated GET route takes the repeated field from the query
+	w := serve(http.MethodGet, "/rpc/prices?List=BTC,ETH&List=XRP", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"Prices":{"BTC":1,"ETH":2,"XRP":3},"Partial":false,"AsOf":"1000","Stale":false,"StaleAsOf":{},"Errors":[]}`, w.Body.String())
+
+	w = serve(http.MethodPost, "/pricecollector.PriceService/GetPrices", `{"List":["BTC"]}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"Prices":{"BTC":1}`)
+
+	w = serve(http.MethodGet, "/rpc/price?Symbol=XYZ", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Contains(t, w.Body.String(), `"code":"NOT_FOUND","message":"no price for XYZ"`)
+
+	assert.Equal(t, http.StatusBadRequest, serve(http.MethodGet, "/rpc/prices?Unknown=1", "").Code)
+	assert.Equal(t, http.StatusBadRequest, serve(http.MethodPost, "/pricecollector.PriceService/GetPrices", `{"List":`).Code)
+}
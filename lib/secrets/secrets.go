@@ -0,0 +1,191 @@
+// Package secrets provides the provider API keys from pluggable sources and redacts their values
+// from the logs and the errors.
+//
+// A secret reference is either the literal value or "<scheme>:<argument>":
+//
+//	file:/run/secrets/cmc_api_key  the trimmed file content, re-read when the file changes
+//	env:CMC_API_KEY                the env variable, read on every use
+//
+// More schemes, e.g. a vault client, are added with Register.
+package secrets
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const redacted = "******"
+
+// Source provides the current value of a secret, the value can change at runtime
+type Source interface {
+	Value() (string, error)
+}
+
+var (
+	schemesMu sync.RWMutex
+	schemes   = map[string]func(arg string) Source{
+		"file": File,
+		"env":  Env,
+	}
+)
+
+// Register adds the scheme of the references, open must not block, the errors are returned by Value
+func Register(scheme string, open func(arg string) Source) {
+	schemesMu.Lock()
+	defer schemesMu.Unlock()
+	schemes[scheme] = open
+}
+
+// Open returns the source of the reference, the values without a known scheme are literals
+func Open(ref string) Source {
+	if scheme, arg, ok := strings.Cut(ref, ":"); ok {
+		schemesMu.RLock()
+		open, ok := schemes[scheme]
+		schemesMu.RUnlock()
+		if ok {
+			return open(arg)
+		}
+	}
+	return Literal(ref)
+}
+
+// Literal returns the source of the fixed value
+func Literal(value string) Source {
+	remember(value)
+	return literal(value)
+}
+
+type literal string
+
+func (l literal) Value() (string, error) {
+	return string(l), nil
+}
+
+// Env returns the source reading the env variable
+func Env(name string) Source {
+	return env(name)
+}
+
+type env string
+
+func (e env) Value() (string, error) {
+	value := os.Getenv(string(e))
+	if value == "" {
+		return "", fmt.Errorf("secret env %s is not set", string(e))
+	}
+	remember(value)
+	return value, nil
+}
+
+// the files are checked for the changes at most once per interval
+var checkInterval = time.Second
+
+// File returns the source reading the file, Docker and Kubernetes secrets style
+func File(path string) Source {
+	return &file{path: path}
+}
+
+type file struct {
+	path string
+
+	mu      sync.Mutex
+	checked time.Time
+	modTime time.Time
+	value   string
+}
+
+func (f *file) Value() (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.value != "" && time.Since(f.checked) < checkInterval {
+		return f.value, nil
+	}
+	f.checked = time.Now()
+
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return f.keep(fmt.Errorf("secret file: %w", err))
+	}
+	if info.ModTime().Equal(f.modTime) && f.value != "" {
+		return f.value, nil
+	}
+	b, err := os.ReadFile(f.path)
+	if err != nil {
+		return f.keep(fmt.Errorf("secret file: %w", err))
+	}
+	value := strings.TrimSpace(string(b))
+	if value == "" {
+		return f.keep(fmt.Errorf("secret file %s is empty", f.path))
+	}
+	remember(value)
+	f.value, f.modTime = value, info.ModTime()
+	return value, nil
+}
+
+// keep returns the last good value if there is one, a file being rotated may be missing or empty for a moment
+func (f *file) keep(err error) (string, error) {
+	if f.value != "" {
+		return f.value, nil
+	}
+	return "", err
+}
+
+// the secret values seen, the old ones are kept after a rotation since they can still appear
+// in the messages of the requests in flight
+var (
+	knownMu sync.RWMutex
+	known   []string
+)
+
+const maxKnown = 32
+
+// the short values would redact the unrelated text
+const minRedactedLen = 6
+
+func remember(value string) {
+	if len(value) < minRedactedLen {
+		return
+	}
+	knownMu.Lock()
+	defer knownMu.Unlock()
+	for _, v := range known {
+		if v == value {
+			return
+		}
+	}
+	known = append(known, value)
+	if len(known) > maxKnown {
+		known = known[1:]
+	}
+}
+
+// Redact replaces the secret values in the text
+func Redact(s string) string {
+	knownMu.RLock()
+	defer knownMu.RUnlock()
+	for _, v := range known {
+		s = strings.ReplaceAll(s, v, redacted)
+	}
+	return s
+}
+
+// RedactWriter returns the writer which redacts the secret values, it is meant for the loggers
+// writing a line at once
+func RedactWriter(w io.Writer) io.Writer {
+	return redactWriter{w}
+}
+
+type redactWriter struct {
+	w io.Writer
+}
+
+func (r redactWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(r.w, Redact(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,71 @@
+package secrets
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileRotation(t *testing.T) {
+	checkInterval = 0
+	t.Cleanup(func() { checkInterval = time.Second })
+
+	path := filepath.Join(t.TempDir(), "api_key")
+	require.NoError(t, os.WriteFile(path, []byte("first-secret-key\n"), 0o600))
+	src := Open("file:" + path)
+
+	value, err := src.Value()
+	require.NoError(t, err)
+	assert.Equal(t, "first-secret-key", value)
+
+	require.NoError(t, os.WriteFile(path, []byte("second-secret-key"), 0o600))
+	require.NoError(t, os.Chtimes(path, time.Now(), time.Now().Add(time.Minute)))
+	value, err = src.Value()
+	require.NoError(t, err)
+	assert.Equal(t, "second-secret-key", value)
+
+	// the last good key is kept while the file is missing
+	require.NoError(t, os.Remove(path))
+	value, err = src.Value()
+	require.NoError(t, err)
+	assert.Equal(t, "second-secret-key", value)
+
+	_, err = Open("file:" + path + ".missing").Value()
+	assert.Error(t, err)
+}
+
+func TestOpen(t *testing.T) {
+	t.Setenv("SECRETS_TEST_KEY", "env-secret-key")
+	value, err := Open("env:SECRETS_TEST_KEY").Value()
+	require.NoError(t, err)
+	assert.Equal(t, "env-secret-key", value)
+
+	_, err = Open("env:SECRETS_TEST_UNSET").Value()
+	assert.Error(t, err)
+
+	Register("test", func(arg string) Source { return Literal("registered-" + arg) })
+	value, err = Open("test:key").Value()
+	require.NoError(t, err)
+	assert.Equal(t, "registered-key", value)
+
+	// the unknown schemes are a part of the literal value
+	value, err = Open("abc:def-literal").Value()
+	require.NoError(t, err)
+	assert.Equal(t, "abc:def-literal", value)
+}
+
+func TestRedact(t *testing.T) {
+	Literal("redacted-secret-key")
+	Literal("abc")
+
+	var buf bytes.Buffer
+	logger := log.New(RedactWriter(&buf), "", 0)
+	logger.Printf("GET https://example.com/?api_key=redacted-secret-key failed, abc")
+	assert.Equal(t, "GET https://example.com/?api_key=****** failed, abc\n", buf.String())
+}
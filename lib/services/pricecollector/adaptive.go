@@ -0,0 +1,147 @@
+package pricecollector
+
+import (
+	"errors"
+	"expvar"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// growAfter is the number of the full batches succeeding in a row before the batch size grows
+	growAfter = 20
+	// ceilingTTL is how long the size of the last rejected batch is not probed again
+	ceilingTTL = 10 * time.Minute
+)
+
+// the batch requests: their number, failures, rejections as too long and the current size. The latency of
+// the answered ones is latency_ms_sum over latency_ms_le_inf, latency_ms_le_N is the number answered within N ms
+var batchStats = expvar.NewMap("price_batches")
+
+var latencyBuckets = []int64{50, 100, 250, 500, 1000, 2500, 5000}
+
+// errTooLong is the upstream's rejection of a batch as too long
+var errTooLong = errors.New("the batch is too long")
+
+// tooLong reports whether the upstream's answer rejects the request as too long: CryptoCompare's
+// "fsyms length is higher than maxlength" or the 414, 413 and 431 pages of the proxies in front of it
+func tooLong(answer string) bool {
+	answer = strings.ToLower(answer)
+	for _, s := range []string{"higher than maxlength", "too long", "too large"} {
+		if strings.Contains(answer, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// sizer learns the largest batch the upstream accepts within the configured bounds. The size is
+// halved when a batch is rejected as too long, and grows by an eighth after growAfter full batches
+// succeed in a row, up to below the last rejected size for ceilingTTL and up to the max after it.
+type sizer struct {
+	mu       sync.Mutex
+	min, max int
+	size     int
+	streak   int
+	// ceiling is the size of the last batch rejected as too long, 0 is none
+	ceiling      int
+	ceilingUntil time.Time
+}
+
+// sizerReport is the current batch size and its bounds
+type sizerReport struct {
+	Size    int `json:"size"`
+	Min     int `json:"min"`
+	Max     int `json:"max"`
+	Ceiling int `json:"ceiling,omitempty"`
+}
+
+// setBounds changes the bounds, the size starts at the max and is kept within them
+func (z *sizer) setBounds(lo, hi int) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	z.min, z.max = min(lo, hi), hi
+	if z.size == 0 {
+		z.size = hi
+	}
+	z.size = max(z.min, min(z.size, z.max))
+}
+
+// current returns the batch size
+func (z *sizer) current() int {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	return z.size
+}
+
+// observe learns from the result of a batch of n symbols and returns the old and the new size.
+// Only the successes and the rejections as too long are learned from, the other failures say nothing about the size.
+func (z *sizer) observe(n int, err error, now time.Time) (int, int) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	old := z.size
+	if z.ceiling > 0 && now.After(z.ceilingUntil) {
+		z.ceiling = 0
+	}
+
+	switch {
+	case errors.Is(err, errTooLong):
+		z.streak = 0
+		z.ceiling, z.ceilingUntil = n, now.Add(ceilingTTL)
+		z.size = max(z.min, min(z.size, n/2))
+	case err != nil:
+	case n >= z.size:
+		// the last batches of a call are shorter, they don't prove the size
+		z.streak++
+		if z.streak < growAfter {
+			break
+		}
+		z.streak = 0
+		limit := z.max
+		if z.ceiling > 0 {
+			limit = min(limit, z.ceiling-1)
+		}
+		z.size = max(z.size, min(limit, z.size+max(1, z.size/8)))
+	}
+	return old, z.size
+}
+
+// report returns the current size and the bounds
+func (z *sizer) report() sizerReport {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	return sizerReport{Size: z.size, Min: z.min, Max: z.max, Ceiling: z.ceiling}
+}
+
+// countBatch adds the batch to the stats
+func countBatch(latency time.Duration, err error) {
+	batchStats.Add("requests", 1)
+	if err != nil {
+		batchStats.Add("failures", 1)
+		if errors.Is(err, errTooLong) {
+			batchStats.Add("rejected_too_long", 1)
+		}
+		return
+	}
+	ms := latency.Milliseconds()
+	batchStats.Add("latency_ms_sum", ms)
+	for _, le := range latencyBuckets {
+		if ms <= le {
+			batchStats.Add("latency_ms_le_"+strconv.FormatInt(le, 10), 1)
+		}
+	}
+	batchStats.Add("latency_ms_le_inf", 1)
+}
+
+// the batch size of one server is published per process
+var publishSize sync.Once
+
+// PublishBatchSize serves the batch size of the server and its bounds in /debug/vars (price_batches.size),
+// only the first server of the process is published
+func (s *Server) PublishBatchSize() {
+	publishSize.Do(func() {
+		batchStats.Set("size", expvar.Func(func() any { return s.sizer.report() }))
+	})
+}
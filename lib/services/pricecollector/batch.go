@@ -0,0 +1,46 @@
+package pricecollector
+
+import (
+	"net/url"
+	"strings"
+)
+
+// batches splits the symbols into the price requests of at most maxCount symbols whose escaped,
+// comma separated fsyms are at most maxLen long. The order is kept, the empty and the repeated
+// symbols are skipped. A symbol longer than maxLen makes a batch of its own, the upstream rejects it.
+func batches(symbols []string, maxCount, maxLen int) [][]string {
+	var res [][]string
+	var batch []string
+	length := 0
+	seen := make(map[string]bool, len(symbols))
+	for _, s := range symbols {
+		if s == "" || seen[s] {
+			continue
+		}
+		seen[s] = true
+
+		n := len(url.QueryEscape(s))
+		if len(batch) > 0 && (len(batch) == maxCount || length+1+n > maxLen) {
+			res = append(res, batch)
+			batch, length = nil, 0
+		}
+		if len(batch) > 0 {
+			length++ // the comma
+		}
+		batch = append(batch, s)
+		length += n
+	}
+	if len(batch) > 0 {
+		res = append(res, batch)
+	}
+	return res
+}
+
+// fsyms returns the fsyms parameter of the batch, the symbols are escaped and the commas are kept
+func fsyms(batch []string) string {
+	escaped := make([]string, 0, len(batch))
+	for _, s := range batch {
+		escaped = append(escaped, url.QueryEscape(s))
+	}
+	return strings.Join(escaped, ",")
+}
@@ -1,150 +1,380 @@
 package pricecollector
 
 import (
+	"cmp"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"maps"
 	"net/http"
 	"os"
+	"slices"
 	"strings"
+	"sync/atomic"
 	"time"
 
-	"golang.org/x/sync/errgroup"
+	"google.golang.org/grpc/codes"
 
+	"github.com/awnzl/top_currency_checker/lib/apierror"
+	"github.com/awnzl/top_currency_checker/lib/budget"
+	budgetconfig "github.com/awnzl/top_currency_checker/lib/budget/config"
+	"github.com/awnzl/top_currency_checker/lib/coalesce"
 	pc "github.com/awnzl/top_currency_checker/lib/proto/pricecollector"
 	"github.com/awnzl/top_currency_checker/lib/requester"
+	"github.com/awnzl/top_currency_checker/lib/requester/chaos"
 	"github.com/awnzl/top_currency_checker/lib/requester/config"
+	"github.com/awnzl/top_currency_checker/lib/secrets"
 )
 
 type Config struct {
-	APIKey     string
-	APIURL     string
+	// APIKeys are the CryptoCompare keys. Every batch takes the first key within its KeyBudget,
+	// so a spent key hands over to the next one; the sources are read per batch
+	APIKeys   []secrets.Source
+	KeyBudget config.Budget
+	APIURL    string
+	// FSYMSLimit is the max number of symbols of one request, 0 is 50. The batch size starts at it and is
+	// shrunk down to FSYMSMinLimit when the upstream rejects the batches as too long, see sizer
 	FSYMSLimit int
-	ReqConfig  config.Config
+	// FSYMSMinLimit is the min number of symbols of one request the batch size is shrunk to, 0 is 1
+	FSYMSMinLimit int
+	// FSYMSMaxLen is the max length of the comma separated symbols of one request, 0 is the CryptoCompare's 300
+	FSYMSMaxLen int
+	// Concurrency is the max number of the requests of one call in flight, 0 is 4
+	Concurrency int
+	ReqConfig   config.Config
+	// MaxStaleness is the max age of the last good prices served when the upstream fails, 0 disables it
+	MaxStaleness time.Duration
+	// Budget is the background polling of the recently requested prices and its credit allowance
+	Budget budgetconfig.Config
 }
 
+const (
+	// the symbols requested within this time are refreshed by the background poller
+	trackedFor = time.Hour
+
+	defaultFSYMSLimit  = 50
+	defaultFSYMSMaxLen = 300
+	defaultConcurrency = 4
+)
+
 type Server struct {
 	pc.PriceServiceServer
-	requester  requester.Requester
-	apiKey     string
-	apiURL     string
-	fsymsLimit int
-	log        *log.Logger
+	requester    requester.Requester
+	keys         *requester.KeyPool
+	planner      *budget.Planner
+	apiURL       string
+	sizer        sizer
+	fsymsMaxLen  atomic.Int64
+	concurrency  atomic.Int64
+	flights      *coalesce.Group
+	snapshot     snapshot
+	maxStaleness atomic.Int64
+	log          *log.Logger
 }
 
 func New(conf Config) *Server {
-	return &Server{
-		requester:  requester.New(conf.ReqConfig),
-		apiKey:     conf.APIKey,
-		apiURL:     conf.APIURL,
-		fsymsLimit: conf.FSYMSLimit,
-		log:        log.New(os.Stdout, "PriceCollector: ", log.LstdFlags | log.Lshortfile),
+	s := &Server{
+		requester: requester.New(conf.ReqConfig),
+		apiURL:    conf.APIURL,
+		keys:      requester.NewKeyPool(cryptoCompareKeys, conf.APIKeys, conf.KeyBudget),
+		flights:   coalesce.New("price_rpc"),
+		log:       log.New(secrets.RedactWriter(os.Stdout), "PriceCollector: ", log.LstdFlags|log.Lshortfile),
 	}
+	s.planner = budget.New(cryptoCompareKeys.Name, conf.Budget, s.keys.UsedMonth)
+	s.storeBatching(conf)
+	s.maxStaleness.Store(int64(conf.MaxStaleness))
+	return s
+}
+
+// ApplyConfig changes the API keys, the credit budget, the request options, the batching and the max staleness at runtime
+func (s *Server) ApplyConfig(conf Config) {
+	s.keys.SetKeys(conf.APIKeys, conf.KeyBudget)
+	s.planner.SetConfig(conf.Budget)
+	s.requester.SetConfig(conf.ReqConfig)
+	s.storeBatching(conf)
+	s.maxStaleness.Store(int64(conf.MaxStaleness))
+}
+
+// storeBatching stores the batch size bounds, length and concurrency, the zero ones are the defaults
+func (s *Server) storeBatching(conf Config) {
+	s.sizer.setBounds(cmp.Or(conf.FSYMSMinLimit, 1), cmp.Or(conf.FSYMSLimit, defaultFSYMSLimit))
+	s.fsymsMaxLen.Store(int64(cmp.Or(conf.FSYMSMaxLen, defaultFSYMSMaxLen)))
+	s.concurrency.Store(int64(cmp.Or(conf.Concurrency, defaultConcurrency)))
+}
+
+// Poll refreshes the prices of the recently requested symbols in the background at the intervals planned
+// within the credit budget, until the context is done. It returns at once if the polling is disabled.
+func (s *Server) Poll(ctx context.Context) {
+	s.planner.Run(ctx,
+		func() int {
+			// one call per batch of symbols
+			coins := s.snapshot.tracked(time.Now().Add(-trackedFor))
+			return len(batches(coins, s.sizer.current(), int(s.fsymsMaxLen.Load())))
+		},
+		func(ctx context.Context) {
+			coins := s.snapshot.tracked(time.Now().Add(-trackedFor))
+			if len(coins) == 0 {
+				return
+			}
+			prices, failed := s.getPrices(ctx, coins)
+			s.snapshot.update(prices, time.Now())
+			if len(failed) > 0 {
+				s.log.Printf("Polling the prices failed, %d of %d received\n", len(prices), len(coins))
+			}
+		},
+	)
+}
+
+// Budget returns the planner of the refreshes of the tracked prices, a call is counted per batch
+func (s *Server) Budget() *budget.Planner {
+	return s.planner
 }
 
 // Service handler for the GetPrices RPC call
 func (s *Server) GetPrices(ctx context.Context, req *pc.PriceRequest) (*pc.PriceResponse, error) {
-	now := time.Now()
-	// get prices for the available coins
-	prices, err := s.getPrices(req.List)
-	s.log.Println("Prices requesting time:", time.Since(now))
-	s.log.Println("Currencies data len:", len(prices))
+	// the concurrent requests of the same symbols share one set of the upstream requests
+	symbols := slices.Clone(req.List)
+	slices.Sort(symbols)
+	key := strings.Join(symbols, ",")
+
+	resp, err := coalesce.Do(ctx, s.flights, key, func(ctx context.Context) (*pc.PriceResponse, error) {
+		return s.collectPrices(ctx, req.List)
+	})
+	if err != nil {
+		// collectPrices returns statuses, only the cancellation of the shared call is left to convert
+		return nil, apierror.UpstreamStatus(err)
+	}
+	return resp, nil
+}
+
+// Service handler for the GetCoin RPC call
+func (s *Server) GetCoin(ctx context.Context, req *pc.CoinPriceRequest) (*pc.CoinPriceResponse, error) {
+	symbol := strings.ToUpper(req.Symbol)
+	if symbol == "" {
+		return nil, apierror.Status(codes.InvalidArgument, apierror.InvalidSymbol, "symbol is required")
+	}
+
+	resp, err := s.GetPrices(ctx, &pc.PriceRequest{List: []string{symbol}})
 	if err != nil {
 		return nil, err
 	}
 
-	return &pc.PriceResponse{Prices: prices}, nil
+	price, ok := resp.Prices[symbol]
+	if !ok {
+		return nil, apierror.Status(codes.NotFound, apierror.NotFound, "no price for %s", symbol)
+	}
+	asOf, stale := resp.StaleAsOf[symbol]
+	if !stale {
+		asOf = resp.AsOf
+	}
+	return &pc.CoinPriceResponse{Symbol: symbol, Price: price, AsOf: asOf, Stale: stale}, nil
 }
 
-func (s *Server) getPrices(coins []string) (map[string]float64, error) {
-	allCoinsPrices := map[string]float64{}
-	pricesCh, errCh := s.requestPrices(coins)
+// collectPrices returns the prices of the coins, the missing ones filled from the snapshot or listed in Errors.
+// It fails only when no price is received or kept, with the status of the first failed batch.
+func (s *Server) collectPrices(ctx context.Context, coins []string) (*pc.PriceResponse, error) {
+	now := time.Now()
+	s.snapshot.touch(coins, now)
+	// no batch is sent when every coin was priced within the planned interval, one missing coin refreshes all
+	if prices, asOf, ok := s.snapshot.fresh(coins, s.planner.Fresh()); ok {
+		return &pc.PriceResponse{Prices: prices, AsOf: asOf.UnixMilli()}, nil
+	}
+
+	fetchCtx, cancel := partialResultContext(ctx)
+	defer cancel()
 
-	for prices := range pricesCh {
-		for coin, price := range prices {
-			allCoinsPrices[coin] = price
+	// get prices for the available coins
+	prices, failed := s.getPrices(fetchCtx, coins)
+	s.log.Println("Prices requesting time:", time.Since(now))
+	s.log.Println("Currencies data len:", len(prices))
+
+	asOf := time.Now()
+	s.snapshot.update(prices, asOf)
+	if len(failed) == 0 {
+		return &pc.PriceResponse{Prices: prices, AsOf: asOf.UnixMilli()}, nil
+	}
+	if ctx.Err() != nil {
+		return nil, apierror.UpstreamStatus(ctx.Err())
+	}
+
+	// the missing prices are taken from the last good ones
+	filled := s.snapshot.fill(prices, coins, time.Duration(s.maxStaleness.Load()))
+	deadline := fetchCtx.Err() == context.DeadlineExceeded
+	if len(prices) == 0 && !deadline {
+		err := failed[firstFailed(coins, failed)]
+		if !errors.Is(err, requester.RateLimitError) && s.snapshot.has(coins) {
+			s.log.Println("The kept prices are too old to serve, the upstream failed:", err)
+			return nil, apierror.Status(codes.Unavailable, apierror.StaleData, "the upstream failed and the kept prices are too old")
 		}
+		return nil, apierror.UpstreamStatus(err)
 	}
 
-	select {
-	case err := <-errCh:
-		if err != nil {
-			return nil, err
+	// the successful batches are returned with the errors of the symbols without any price
+	resp := &pc.PriceResponse{Prices: prices, Partial: true, AsOf: asOf.UnixMilli(), Stale: len(filled) > 0}
+	if len(filled) > 0 {
+		resp.StaleAsOf = make(map[string]int64, len(filled))
+		for coin, t := range filled {
+			resp.StaleAsOf[coin] = t.UnixMilli()
+		}
+	}
+	for _, coin := range slices.Sorted(maps.Keys(failed)) {
+		if _, ok := filled[coin]; ok {
+			continue
 		}
-	default:
+		code, _, msg := apierror.FromError(apierror.UpstreamStatus(failed[coin]))
+		resp.Errors = append(resp.Errors, &pc.SymbolError{Symbol: coin, Code: string(code), Message: msg})
 	}
+	// if the caller's deadline is close, reply with the prices received so far
+	s.log.Printf("Returning %d of %d prices, %d of them stale, %d failed\n", len(prices), len(coins), len(filled), len(resp.Errors))
+	return resp, nil
+}
 
-	return allCoinsPrices, nil
+// firstFailed returns the first of the coins which failed
+func firstFailed(coins []string, failed map[string]error) string {
+	for _, coin := range coins {
+		if _, ok := failed[coin]; ok {
+			return coin
+		}
+	}
+	return ""
 }
 
-func (s *Server) requestPrices(coins []string) (<-chan map[string]float64, <-chan error) {
-	// https://min-api.cryptocompare.com/data/pricemulti?fsyms=BTC,ETH&tsyms=USD&api_key=INSERT-YOUR-API-KEY-HERE
-	pricesCh := make(chan map[string]float64)
-	errGroup, ctx := errgroup.WithContext(context.Background())
-	fullPartsNum := len(coins) / s.fsymsLimit
+// partialResultContext returns a context which expires a bit before the caller's deadline,
+// leaving the time to send the partial result back
+func partialResultContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return context.WithCancel(ctx)
+	}
+	margin := min(time.Until(deadline)/10, 500*time.Millisecond)
+	return context.WithDeadline(ctx, deadline.Add(-margin))
+}
 
-	for idx, i := 0, 0; i <= fullPartsNum; i++ {
-		coinsToRequest := ""
-		for ; idx < len(coins); {
-			coinsToRequest += coins[idx]+","
-			idx++
-			if idx % s.fsymsLimit == 0 {
-				coinsToRequest = strings.TrimRight(coinsToRequest, ",")
-				break
-			}
-		}
-		if coinsToRequest == "" {
-			continue
-		}
+// getPrices requests the prices in batches, at most the configured number of them in flight.
+// The prices of the successful batches are returned with the errors of the symbols of the failed ones.
+func (s *Server) getPrices(ctx context.Context, coins []string) (map[string]float64, map[string]error) {
+	type result struct {
+		prices map[string]float64
+		failed map[string]error
+	}
 
-		errGroup.Go(func() error {
-			var bts []byte
-			var err error
-			uri := s.apiURL + "/pricemulti?fsyms=" + coinsToRequest
-			bts, err = s.RequestGet(ctx, uri + "&tsyms=USD&api_key=" + s.apiKey)
-			if err != nil {
-				return fmt.Errorf("requesting prices: uri: %v, error: %v", uri, err)
+	parts := batches(coins, s.sizer.current(), int(s.fsymsMaxLen.Load()))
+	results := make(chan result, len(parts))
+	inFlight := make(chan struct{}, s.concurrency.Load())
+	for _, batch := range parts {
+		go func() {
+			select {
+			case inFlight <- struct{}{}:
+				defer func() { <-inFlight }()
+			case <-ctx.Done():
+				results <- result{failed: failedBatch(batch, fmt.Errorf("not requested: %w", ctx.Err()))}
+				return
 			}
-			prices, err := s.unmarshalPrices(bts)
-			if err != nil {
-				return fmt.Errorf("unmarshaling prices: uri: %v, error: %v", uri, err)
+			prices, failed := s.requestSplitting(ctx, batch)
+			results <- result{prices, failed}
+		}()
+	}
+
+	prices := map[string]float64{}
+	var failed map[string]error
+	for range parts {
+		res := <-results
+		maps.Copy(prices, res.prices)
+		if len(res.failed) > 0 {
+			if failed == nil {
+				failed = make(map[string]error, len(res.failed))
 			}
+			maps.Copy(failed, res.failed)
+		}
+	}
+	return prices, failed
+}
 
-			select {
-			case pricesCh <- prices:
-			case <-ctx.Done():
-				return fmt.Errorf("context done: %v", ctx.Err())
+// requestSplitting requests the batch. The batch rejected as too long is split at the shrunk batch size
+// and its parts are requested in turn, until it can't be split any more.
+func (s *Server) requestSplitting(ctx context.Context, batch []string) (map[string]float64, map[string]error) {
+	prices, err := s.requestBatch(ctx, batch)
+	if err == nil {
+		return prices, nil
+	}
+	if errors.Is(err, errTooLong) && ctx.Err() == nil {
+		if parts := batches(batch, s.sizer.current(), int(s.fsymsMaxLen.Load())); len(parts) > 1 {
+			prices := map[string]float64{}
+			failed := map[string]error{}
+			for _, part := range parts {
+				p, f := s.requestSplitting(ctx, part)
+				maps.Copy(prices, p)
+				maps.Copy(failed, f)
 			}
+			return prices, failed
+		}
+	}
+	s.log.Printf("The batch of %d symbols failed: %v\n", len(batch), err)
+	return nil, failedBatch(batch, err)
+}
 
-			return nil
-		})
+// failedBatch returns the error of every symbol of the batch
+func failedBatch(batch []string, err error) map[string]error {
+	failed := make(map[string]error, len(batch))
+	for _, coin := range batch {
+		failed[coin] = err
 	}
+	return failed
+}
 
-	errCh := make(chan error, 1)
-	go func() {
-		if err := errGroup.Wait(); err != nil {
-			s.log.Println("errGroup received an error:", err.Error())
-			errCh <- err
+// requestBatch returns the prices of the batch, the symbols unknown to the upstream are missing
+func (s *Server) requestBatch(ctx context.Context, batch []string) (map[string]float64, error) {
+	// https://min-api.cryptocompare.com/data/pricemulti?fsyms=BTC,ETH&tsyms=USD
+	// the key is sent in the Authorization header, so it is not a part of the URLs logged or used as the cache keys
+	uri := s.apiURL + "/pricemulti?fsyms=" + fsyms(batch)
+	start := time.Now()
+	bts, err := s.RequestGet(ctx, uri+"&tsyms=USD")
+	if err != nil {
+		err = fmt.Errorf("requesting prices: uri: %v, error: %w", uri, err)
+	}
+	var prices map[string]float64
+	if err == nil {
+		if prices, err = s.unmarshalPrices(bts); err != nil {
+			err = fmt.Errorf("unmarshaling prices: uri: %v, error: %w", uri, err)
 		}
-		close(errCh)
-		close(pricesCh)
-	}()
+	}
 
-	return pricesCh, errCh
+	countBatch(time.Since(start), err)
+	if old, size := s.sizer.observe(len(batch), err, time.Now()); size != old {
+		s.log.Printf("The batch size is changed from %d to %d\n", old, size)
+	}
+	return prices, err
 }
 
+// ccInvalidParam is the Type of the CryptoCompare errors rejecting a request parameter, named by ParamWithError
+const ccInvalidParam = 2
+
 func (s *Server) unmarshalPrices(bts []byte) (map[string]float64, error) {
 	var errResp struct {
-		Response   string `json:"Response"` // Response status: Success, Error
-		Message    string `json:"Message"` // A message if Response=Error
+		Response       string `json:"Response"`       // Response status: Success, Error
+		Message        string `json:"Message"`        // A message if Response=Error
+		Type           int    `json:"Type"`           // Error type: 2 for an invalid parameter, 99 for the rate limit
+		ParamWithError string `json:"ParamWithError"` // The invalid parameter
 	}
 	// handle error response
 	err := json.Unmarshal(bts, &errResp)
 	if err != nil {
+		// the proxies answer the too long requests with their own pages
+		if tooLong(string(bts)) {
+			return nil, fmt.Errorf("%w, the answer is not JSON: %w", errTooLong, err)
+		}
 		return nil, err
 	}
 	if errResp.Response == "Error" {
+		if tooLong(errResp.Message) {
+			return nil, fmt.Errorf("getting prices: %w: %v", errTooLong, errResp.Message)
+		}
+		// a batch of the untracked symbols only is answered with the invalid fsyms, they just have no prices
+		if errResp.Type == ccInvalidParam && errResp.ParamWithError == "fsyms" {
+			return map[string]float64{}, nil
+		}
 		return nil, fmt.Errorf("getting prices: %v", errResp.Message)
 	}
 
@@ -170,5 +400,51 @@ func (s *Server) RequestGet(ctx context.Context, uri string) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	return s.requester.GetData(req)
+	// CryptoCompare counts the calls, one per batch of symbols
+	return s.requester.GetDataWithKey(req, s.keys, 1)
+}
+
+// Keys returns the pool of the CryptoCompare keys, each batch is one call of their monthly allowance
+func (s *Server) Keys() *requester.KeyPool {
+	return s.keys
+}
+
+// BatchSize returns the current max number of symbols of one request, it is learned from the upstream's rejections
+func (s *Server) BatchSize() int {
+	return s.sizer.current()
+}
+
+// Faults returns the fault injection of the batch requests, nil unless faults.enabled is set
+func (s *Server) Faults() *chaos.Transport {
+	return s.requester.Faults()
+}
+
+var cryptoCompareKeys = requester.KeyProvider{
+	Name: "cryptocompare",
+	SetKey: func(req *http.Request, key string) {
+		req.Header.Set("Authorization", "Apikey "+key)
+	},
+	QuotaError: func(bts []byte, now time.Time) (time.Time, bool) {
+		// {"Response":"Error","Message":"You are over your rate limit please upgrade your account!","Type":99,
+		// "RateLimit":{"calls_made":{"second":1,"minute":3,...,"month":250001},"max_calls":{...,"month":250000}}}
+		var resp struct {
+			Response  string `json:"Response"`
+			Type      int    `json:"Type"`
+			RateLimit struct {
+				CallsMade map[string]int `json:"calls_made"`
+				MaxCalls  map[string]int `json:"max_calls"`
+			} `json:"RateLimit"`
+		}
+		if json.Unmarshal(bts, &resp) != nil || resp.Response != "Error" || resp.Type != 99 {
+			return time.Time{}, false
+		}
+		// the key is exhausted until the end of the longest period over the limit
+		for _, period := range []string{"month", "day", "hour", "minute", "second"} {
+			limit, ok := resp.RateLimit.MaxCalls[period]
+			if ok && limit > 0 && resp.RateLimit.CallsMade[period] >= limit {
+				return requester.PeriodEnd(now, period), true
+			}
+		}
+		return requester.PeriodEnd(now, "minute"), true
+	},
 }
@@ -0,0 +1,174 @@
+package pricecollector
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pc "github.com/awnzl/top_currency_checker/lib/proto/pricecollector"
+	"github.com/awnzl/top_currency_checker/lib/requester"
+	"github.com/awnzl/top_currency_checker/lib/requester/config"
+	"github.com/awnzl/top_currency_checker/lib/requester/fixtures"
+	"github.com/awnzl/top_currency_checker/lib/secrets"
+)
+
+// newTestServer returns the server replaying the exchanges recorded in testdata,
+// re-record them with request.fixtures.mode=record and a real key
+func newTestServer() *Server {
+	return New(Config{
+		APIKeys:      []secrets.Source{secrets.Literal("test-api-key")},
+		APIURL:       "https://min-api.cryptocompare.com/data",
+		FSYMSLimit:   2,
+		ReqConfig:    config.Config{ReqTimeout: 1, FixturesMode: fixtures.ModeReplay, FixturesDir: "testdata"},
+		MaxStaleness: time.Minute,
+	})
+}
+
+func TestGetPrices(t *testing.T) {
+	srv := newTestServer()
+
+	// two batches: BTC,ETH and SOL
+	resp, err := srv.GetPrices(context.Background(), &pc.PriceRequest{List: []string{"BTC", "ETH", "SOL"}})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]float64{"BTC": 68951.2, "ETH": 3780.95, "SOL": 164.91}, resp.Prices)
+	assert.False(t, resp.Partial)
+	assert.Equal(t, 2, srv.Keys().UsedMonth())
+
+	coin, err := srv.GetCoin(context.Background(), &pc.CoinPriceRequest{Symbol: "sol"})
+	require.NoError(t, err)
+	assert.Equal(t, "SOL", coin.Symbol)
+	assert.Equal(t, 164.91, coin.Price)
+}
+
+func TestQuotaError(t *testing.T) {
+	srv := newTestServer()
+
+	// the recorded response says the month's calls are used up
+	_, err := srv.GetPrices(context.Background(), &pc.PriceRequest{List: []string{"DOGE"}})
+	assert.Equal(t, codes.Unavailable, status.Code(err), err)
+
+	keys := srv.Keys().Status()
+	require.Len(t, keys, 1)
+	require.NotNil(t, keys[0].ExhaustedUntil)
+	assert.Equal(t, requester.PeriodEnd(time.Now(), "month"), *keys[0].ExhaustedUntil)
+}
+
+func TestBatches(t *testing.T) {
+	assert.Equal(t, [][]string{{"BTC", "ETH"}, {"SOL"}}, batches([]string{"BTC", "ETH", "SOL"}, 2, 300))
+	assert.Equal(t, [][]string{{"BTC", "ETH", "SOL"}}, batches([]string{"BTC", "", "ETH", "BTC", "SOL"}, 5, 300))
+	// "BTC,ETH" is 7 long, the escaped "A&B" is 5
+	assert.Equal(t, [][]string{{"BTC", "ETH"}, {"SOL"}}, batches([]string{"BTC", "ETH", "SOL"}, 5, 8))
+	assert.Equal(t, [][]string{{"BTC"}, {"A&B"}}, batches([]string{"BTC", "A&B"}, 5, 8))
+	assert.Equal(t, [][]string{{"LONGSYMBOL"}, {"BTC"}}, batches([]string{"LONGSYMBOL", "BTC"}, 5, 4))
+	assert.Empty(t, batches(nil, 5, 300))
+	assert.Equal(t, "BTC,A%26B", fsyms([]string{"BTC", "A&B"}))
+}
+
+func TestPartialFailure(t *testing.T) {
+	srv := newTestServer()
+
+	// the batch of XRP has no recording, the prices of the other batch are returned
+	resp, err := srv.GetPrices(context.Background(), &pc.PriceRequest{List: []string{"BTC", "ETH", "XRP"}})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]float64{"BTC": 68951.2, "ETH": 3780.95}, resp.Prices)
+	assert.True(t, resp.Partial)
+	assert.False(t, resp.Stale)
+	require.Len(t, resp.Errors, 1)
+	assert.Equal(t, "XRP", resp.Errors[0].Symbol)
+	assert.Equal(t, "UPSTREAM_UNAVAILABLE", resp.Errors[0].Code)
+
+	// all the batches failed
+	_, err = srv.GetPrices(context.Background(), &pc.PriceRequest{List: []string{"XRP"}})
+	assert.Equal(t, codes.Unavailable, status.Code(err), err)
+}
+
+func TestSizer(t *testing.T) {
+	var z sizer
+	z.setBounds(2, 16)
+	assert.Equal(t, 16, z.current())
+	now := time.Now()
+
+	// the rejected batch halves the size, the other failures don't change it
+	old, size := z.observe(16, fmt.Errorf("getting prices: %w", errTooLong), now)
+	assert.Equal(t, []int{16, 8}, []int{old, size})
+	z.observe(8, errors.New("connection reset"), now)
+	assert.Equal(t, 8, z.current())
+
+	// the size grows after the full batches succeed in a row, the shorter ones don't count
+	for range growAfter - 1 {
+		z.observe(8, nil, now)
+		z.observe(3, nil, now)
+	}
+	assert.Equal(t, 8, z.current())
+	z.observe(8, nil, now)
+	assert.Equal(t, 9, z.current())
+
+	// up to below the rejected size until it is probed again
+	for range 20 * growAfter {
+		z.observe(z.current(), nil, now)
+	}
+	assert.Equal(t, 15, z.current())
+	for range growAfter {
+		z.observe(z.current(), nil, now.Add(ceilingTTL+time.Second))
+	}
+	assert.Equal(t, 16, z.current())
+
+	// within the bounds
+	z.observe(3, errTooLong, now)
+	assert.Equal(t, 2, z.current())
+	z.setBounds(4, 8)
+	assert.Equal(t, 4, z.current())
+}
+
+func TestPublishBatchSize(t *testing.T) {
+	first := newTestServer()
+	first.PublishBatchSize()
+	// the servers created later don't replace the published one
+	second := New(Config{FSYMSLimit: 7})
+	second.PublishBatchSize()
+
+	var report sizerReport
+	require.NoError(t, json.Unmarshal([]byte(batchStats.Get("size").String()), &report))
+	assert.Equal(t, first.BatchSize(), report.Size)
+	assert.Equal(t, 2, report.Max)
+}
+
+func TestTooLong(t *testing.T) {
+	srv := newTestServer()
+
+	_, err := srv.unmarshalPrices([]byte(`{"Response":"Error","Message":"fsyms param is invalid. (fsyms length is higher than maxlength: 300)","Type":2,"ParamWithError":"fsyms"}`))
+	assert.ErrorIs(t, err, errTooLong)
+	_, err = srv.unmarshalPrices([]byte("<html><head><title>414 Request-URI Too Large</title></head></html>"))
+	assert.ErrorIs(t, err, errTooLong)
+	_, err = srv.unmarshalPrices([]byte(`{"BTC":{"USD":1}`))
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, errTooLong)
+}
+
+func TestUnknownSymbols(t *testing.T) {
+	srv := newTestServer()
+
+	// the batch of XYZ is answered with the invalid fsyms, XYZ has no price and the response is complete
+	resp, err := srv.GetPrices(context.Background(), &pc.PriceRequest{List: []string{"BTC", "ETH", "XYZ"}})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]float64{"BTC": 68951.2, "ETH": 3780.95}, resp.Prices)
+	assert.False(t, resp.Partial)
+	assert.Empty(t, resp.Errors)
+
+	_, err = srv.GetCoin(context.Background(), &pc.CoinPriceRequest{Symbol: "XYZ"})
+	assert.Equal(t, codes.NotFound, status.Code(err), err)
+
+	// the other errors fail the batch
+	_, err = srv.unmarshalPrices([]byte(`{"Response":"Error","Message":"tsyms param is invalid.","Type":2,"ParamWithError":"tsyms"}`))
+	assert.ErrorContains(t, err, "tsyms param is invalid")
+	_, err = srv.unmarshalPrices([]byte(`{"Response":"Error","Message":"cccagg_or_exchange market does not exist for this coin pair (XYZ-USD)"}`))
+	assert.Error(t, err)
+}
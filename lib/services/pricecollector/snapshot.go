@@ -0,0 +1,112 @@
+package pricecollector
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+type pricePoint struct {
+	price float64
+	asOf  time.Time
+}
+
+// snapshot keeps the last good price of each symbol, they are served when the upstream fails
+type snapshot struct {
+	mu     sync.RWMutex
+	prices map[string]pricePoint
+	// the last time each symbol was requested, the background poller refreshes the recent ones
+	requested map[string]time.Time
+}
+
+func (s *snapshot) update(prices map[string]float64, asOf time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.prices == nil {
+		s.prices = make(map[string]pricePoint, len(prices))
+	}
+	for coin, price := range prices {
+		s.prices[coin] = pricePoint{price: price, asOf: asOf}
+	}
+}
+
+// fill adds the kept prices not older than maxStaleness for the coins missing in prices.
+// It returns the filled coins and the time of their prices.
+func (s *snapshot) fill(prices map[string]float64, coins []string, maxStaleness time.Duration) map[string]time.Time {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	filled := map[string]time.Time{}
+	for _, coin := range coins {
+		if _, ok := prices[coin]; ok {
+			continue
+		}
+		if point, ok := s.prices[coin]; ok && time.Since(point.asOf) <= maxStaleness {
+			prices[coin] = point.price
+			filled[coin] = point.asOf
+		}
+	}
+	return filled
+}
+
+// has reports whether any price of the coins is kept, regardless of its age
+func (s *snapshot) has(coins []string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, coin := range coins {
+		if _, ok := s.prices[coin]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// touch records the request of the coins
+func (s *snapshot) touch(coins []string, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.requested == nil {
+		s.requested = make(map[string]time.Time, len(coins))
+	}
+	for _, coin := range coins {
+		s.requested[coin] = now
+	}
+}
+
+// tracked returns the coins requested since the time, the older ones are forgotten
+func (s *snapshot) tracked(since time.Time) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	coins := make([]string, 0, len(s.requested))
+	for coin, t := range s.requested {
+		if t.Before(since) {
+			delete(s.requested, coin)
+			continue
+		}
+		coins = append(coins, coin)
+	}
+	slices.Sort(coins)
+	return coins
+}
+
+// fresh returns the prices of all the coins and the time of the oldest one if they are younger than maxAge
+func (s *snapshot) fresh(coins []string, maxAge time.Duration) (map[string]float64, time.Time, bool) {
+	if len(coins) == 0 || maxAge <= 0 {
+		return nil, time.Time{}, false
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	prices := make(map[string]float64, len(coins))
+	var asOf time.Time
+	for _, coin := range coins {
+		point, ok := s.prices[coin]
+		if !ok || time.Since(point.asOf) >= maxAge {
+			return nil, time.Time{}, false
+		}
+		prices[coin] = point.price
+		if asOf.IsZero() || point.asOf.Before(asOf) {
+			asOf = point.asOf
+		}
+	}
+	return prices, asOf, true
+}
@@ -0,0 +1,83 @@
+package pricecollector
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/awnzl/top_currency_checker/lib/apierror"
+	pc "github.com/awnzl/top_currency_checker/lib/proto/pricecollector"
+)
+
+func TestSnapshot(t *testing.T) {
+	var s snapshot
+	now := time.Now()
+	s.update(map[string]float64{"BTC": 1, "ETH": 2}, now.Add(-10*time.Second))
+	s.update(map[string]float64{"ETH": 3}, now)
+
+	// only the missing prices are filled, with the kept ones not older than the max staleness
+	prices := map[string]float64{"SOL": 4}
+	filled := s.fill(prices, []string{"BTC", "ETH", "SOL", "XRP"}, time.Minute)
+	assert.Equal(t, map[string]float64{"BTC": 1, "ETH": 3, "SOL": 4}, prices)
+	assert.Equal(t, map[string]time.Time{"BTC": now.Add(-10 * time.Second), "ETH": now}, filled)
+	prices = map[string]float64{}
+	filled = s.fill(prices, []string{"BTC", "ETH"}, 5*time.Second)
+	assert.Equal(t, map[string]float64{"ETH": 3}, prices)
+	assert.Equal(t, map[string]time.Time{"ETH": now}, filled)
+
+	assert.True(t, s.has([]string{"XRP", "BTC"}))
+	assert.False(t, s.has([]string{"XRP"}))
+
+	// all the prices have to be younger than the max age, the time of the oldest is returned
+	prices, asOf, ok := s.fresh([]string{"BTC", "ETH"}, time.Minute)
+	require.True(t, ok)
+	assert.Equal(t, map[string]float64{"BTC": 1, "ETH": 3}, prices)
+	assert.Equal(t, now.Add(-10*time.Second), asOf)
+	_, _, ok = s.fresh([]string{"BTC", "ETH"}, 5*time.Second)
+	assert.False(t, ok)
+	_, _, ok = s.fresh([]string{"BTC", "XRP"}, time.Minute)
+	assert.False(t, ok)
+	_, _, ok = s.fresh([]string{"BTC"}, 0)
+	assert.False(t, ok, "no polling")
+
+	// the coins not requested since the time are forgotten
+	s.touch([]string{"BTC", "ETH"}, now.Add(-time.Hour))
+	s.touch([]string{"SOL", "BTC"}, now)
+	assert.Equal(t, []string{"BTC", "SOL"}, s.tracked(now.Add(-time.Minute)))
+	assert.Equal(t, []string{"BTC", "SOL"}, s.tracked(now.Add(-2*time.Hour)), "ETH is forgotten")
+}
+
+func TestStaleFallback(t *testing.T) {
+	srv := newTestServer()
+	keptAt := time.Now().Add(-10 * time.Second)
+	srv.snapshot.update(map[string]float64{"XRP": 0.5}, keptAt)
+
+	// the batch of XRP has no recording, its last good price is served with its time
+	resp, err := srv.GetPrices(context.Background(), &pc.PriceRequest{List: []string{"BTC", "ETH", "XRP"}})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]float64{"BTC": 68951.2, "ETH": 3780.95, "XRP": 0.5}, resp.Prices)
+	assert.True(t, resp.Stale)
+	assert.Equal(t, map[string]int64{"XRP": keptAt.UnixMilli()}, resp.StaleAsOf)
+	assert.Empty(t, resp.Errors)
+
+	// all the batches failed, the kept prices are served
+	resp, err = srv.GetPrices(context.Background(), &pc.PriceRequest{List: []string{"XRP"}})
+	require.NoError(t, err)
+	assert.True(t, resp.Stale)
+	coin, err := srv.GetCoin(context.Background(), &pc.CoinPriceRequest{Symbol: "XRP"})
+	require.NoError(t, err)
+	assert.True(t, coin.Stale)
+	assert.Equal(t, keptAt.UnixMilli(), coin.AsOf)
+
+	// the prices older than the max staleness are not served
+	srv.snapshot.update(map[string]float64{"XRP": 0.5}, time.Now().Add(-2*time.Minute))
+	_, err = srv.GetPrices(context.Background(), &pc.PriceRequest{List: []string{"XRP"}})
+	code, _, _ := apierror.FromError(err)
+	assert.Equal(t, codes.Unavailable, status.Code(err), err)
+	assert.Equal(t, apierror.StaleData, code)
+}
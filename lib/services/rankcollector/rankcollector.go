@@ -3,73 +3,297 @@ package rankcollector
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 
+	"google.golang.org/grpc/codes"
+
+	"github.com/awnzl/top_currency_checker/lib/apierror"
+	"github.com/awnzl/top_currency_checker/lib/budget"
+	budgetconfig "github.com/awnzl/top_currency_checker/lib/budget/config"
+	"github.com/awnzl/top_currency_checker/lib/coalesce"
 	rc "github.com/awnzl/top_currency_checker/lib/proto/rankcollector"
 	"github.com/awnzl/top_currency_checker/lib/requester"
+	"github.com/awnzl/top_currency_checker/lib/requester/chaos"
 	"github.com/awnzl/top_currency_checker/lib/requester/config"
+	"github.com/awnzl/top_currency_checker/lib/secrets"
 )
 
-const uriParamFormat = "start=1&limit=%d&convert=USD"
+const (
+	uriParamFormat = "start=1&limit=%d&convert=USD"
+	// the max number of the listings CoinMarketCap returns at once
+	maxListingSize = 5000
+	// the number of the listings charged as one credit
+	creditListings = 200
+)
 
 type Config struct {
-	APIKey     string
-	APIURL     string
-	ReqConfig  config.Config
+	// APIKeys are the CoinMarketCap keys, the first one with the credits left of its KeyBudget is sent.
+	// A listing request reads its key from the source, a rotated key file is picked up by the next refresh
+	APIKeys   []secrets.Source
+	KeyBudget config.Budget
+	APIURL    string
+	ReqConfig config.Config
+	// MaxStaleness is the max age of the last good list served when the upstream fails, 0 disables it
+	MaxStaleness time.Duration
+	// ListingSize is the number of the top currencies requested and retained, the windows within it share the requests
+	ListingSize int
+	// Budget is the background polling of the listing and its credit allowance
+	Budget budgetconfig.Config
 }
 
 type Server struct {
 	rc.RankServiceServer
-	requester requester.Requester
-	apiKey string
-	apiURL string
+	requester    requester.Requester
+	keys         *requester.KeyPool
+	planner      *budget.Planner
+	apiURL       string
+	flights      *coalesce.Group
+	snapshot     snapshot
+	maxStaleness atomic.Int64
+	listingSize  atomic.Int64
+	log          *log.Logger
 }
 
 func New(conf Config) *Server {
-	return &Server{
+	srv := &Server{
 		requester: requester.New(conf.ReqConfig),
-		apiKey:    conf.APIKey,
 		apiURL:    conf.APIURL,
+		keys:      requester.NewKeyPool(cmcKeys, conf.APIKeys, conf.KeyBudget),
+		flights:   coalesce.New("rank_rpc"),
+		log:       log.New(secrets.RedactWriter(os.Stdout), "RankCollector: ", log.LstdFlags|log.Lshortfile),
 	}
+	srv.planner = budget.New(cmcKeys.Name, conf.Budget, srv.keys.UsedMonth)
+	srv.maxStaleness.Store(int64(conf.MaxStaleness))
+	srv.listingSize.Store(int64(conf.ListingSize))
+	return srv
+}
+
+// ApplyConfig changes the API keys, the credit budget, the request options, the max staleness and the listing size at runtime
+func (srv *Server) ApplyConfig(conf Config) {
+	srv.keys.SetKeys(conf.APIKeys, conf.KeyBudget)
+	srv.planner.SetConfig(conf.Budget)
+	srv.requester.SetConfig(conf.ReqConfig)
+	srv.maxStaleness.Store(int64(conf.MaxStaleness))
+	srv.listingSize.Store(int64(conf.ListingSize))
+}
+
+// Poll refreshes the retained listing in the background at the intervals planned within the credit budget,
+// until the context is done. It returns at once if the polling is disabled.
+func (srv *Server) Poll(ctx context.Context) {
+	srv.planner.Run(ctx,
+		func() int { return credits(int(srv.listingSize.Load())) },
+		func(ctx context.Context) {
+			if _, err := srv.collectRanks(ctx, int(srv.listingSize.Load())); err != nil {
+				srv.log.Println("Polling the listing failed:", err)
+			}
+		},
+	)
+}
+
+// Budget returns the planner of the listing refreshes, the credits are counted per 200 listings
+func (srv *Server) Budget() *budget.Planner {
+	return srv.planner
 }
 
 // Service handler for the GetRanks RPC call
 func (srv *Server) GetRanks(ctx context.Context, req *rc.RankRequest) (*rc.RankResponse, error) {
+	if req.Limit < 0 {
+		return nil, apierror.Status(codes.InvalidArgument, apierror.InvalidLimit, "invalid window: limit %d", req.Limit)
+	}
+	if req.Start < 0 {
+		return nil, apierror.Status(codes.InvalidArgument, apierror.InvalidOffset, "invalid window: start %d", req.Start)
+	}
+	start := max(int(req.Start), 1)
+	listingSize := int(srv.listingSize.Load())
+	end := listingSize
+	if req.Limit > 0 {
+		end = start + int(req.Limit) - 1
+	}
+	if end > maxListingSize {
+		return nil, apierror.Status(codes.OutOfRange, apierror.InvalidOffset, "invalid window: the max rank is %d", maxListingSize)
+	}
+
+	// the retained listing is requested, so the windows within it share one upstream request
+	need := max(end, listingSize)
+	resp, err := coalesce.Do(ctx, srv.flights, strconv.Itoa(need), func(ctx context.Context) (*rc.RankResponse, error) {
+		return srv.getListing(ctx, need)
+	})
+	if err != nil {
+		// the shared listing request failed or this caller is gone, either is returned as a status
+		return nil, apierror.UpstreamStatus(err)
+	}
+	return window(resp, start, end), nil
+}
+
+// Service handler for the GetCoin RPC call
+func (srv *Server) GetCoin(ctx context.Context, req *rc.CoinRequest) (*rc.CoinResponse, error) {
+	if req.Symbol == "" && req.ID == 0 {
+		return nil, apierror.Status(codes.InvalidArgument, apierror.InvalidSymbol, "either symbol or id is required")
+	}
+
+	listingSize := int(srv.listingSize.Load())
+	listing, err := coalesce.Do(ctx, srv.flights, strconv.Itoa(listingSize), func(ctx context.Context) (*rc.RankResponse, error) {
+		return srv.getListing(ctx, listingSize)
+	})
+	if err != nil {
+		return nil, apierror.UpstreamStatus(err)
+	}
+
+	// the listing is ordered by rank, so the top ranked currency is found for the duplicated symbols
+	for _, c := range listing.Coins {
+		if (req.ID != 0 && c.ID == req.ID) || (req.ID == 0 && strings.EqualFold(c.Symbol, req.Symbol)) {
+			return &rc.CoinResponse{Coin: c, AsOf: listing.AsOf, Stale: listing.Stale}, nil
+		}
+	}
+	return nil, apierror.Status(codes.NotFound, apierror.NotFound, "currency is not in the top %d", len(listing.Coins))
+}
+
+// getListing returns the top need currencies or the last good listing if the upstream fails.
+// A kept listing older than the max staleness is refused with StaleData rather than the upstream error.
+func (srv *Server) getListing(ctx context.Context, need int) (*rc.RankResponse, error) {
+	// the polled listing is served while it is younger than the polling interval
+	if coins, asOf, ok := srv.snapshot.fresh(need, srv.planner.Fresh()); ok {
+		return &rc.RankResponse{List: symbols(coins), Coins: coins, AsOf: asOf.UnixMilli()}, nil
+	}
+
+	resp, err := srv.collectRanks(ctx, need)
+	if err == nil {
+		return resp, nil
+	}
+
+	maxStaleness := time.Duration(srv.maxStaleness.Load())
+	coins, asOf, ok := srv.snapshot.get(maxStaleness)
+	if !ok {
+		if !asOf.IsZero() && !errors.Is(err, requester.RateLimitError) && ctx.Err() == nil {
+			srv.log.Printf("The ranks of %v are too old to serve, the upstream failed: %v\n", asOf, err)
+			return nil, apierror.Status(codes.Unavailable, apierror.StaleData, "the upstream failed and the ranks of %v are too old", asOf)
+		}
+		return nil, apierror.UpstreamStatus(err)
+	}
+	// the local rate limit is not a failure, the snapshot is as fresh as allowed
+	stale := !errors.Is(err, requester.RateLimitError)
+	if stale {
+		srv.log.Printf("Serving the ranks of %v, the upstream failed: %v\n", asOf, err)
+	}
+	return &rc.RankResponse{List: symbols(coins), Coins: coins, AsOf: asOf.UnixMilli(), Stale: stale}, nil
+}
+
+// window returns the currencies ranked from start to end (inclusive) of the listing,
+// it is empty when start is past end or the listing
+func window(listing *rc.RankResponse, start, end int) *rc.RankResponse {
+	to := min(end, len(listing.Coins))
+	from := min(start-1, to)
+	return &rc.RankResponse{
+		List:  listing.List[from:to],
+		Coins: listing.Coins[from:to],
+		AsOf:  listing.AsOf,
+		Stale: listing.Stale,
+	}
+}
+
+func symbols(coins []*rc.Coin) []string {
+	list := make([]string, 0, len(coins))
+	for _, c := range coins {
+		list = append(list, c.Symbol)
+	}
+	return list
+}
+
+func (srv *Server) collectRanks(ctx context.Context, limit int) (*rc.RankResponse, error) {
 	// this endpoint returns cryptocurrencies in order of CoinMarketCap's market cap rank
-	uri := fmt.Sprintf(srv.apiURL+uriParamFormat, req.Limit)
+	uri := fmt.Sprintf(srv.apiURL+uriParamFormat, limit)
 
-	bts, err := srv.requestData(ctx, uri)
+	bts, err := srv.requestData(ctx, uri, credits(limit))
 	if err != nil {
 		return nil, err
 	}
 
-	data, err := srv.extractRanks(bts)
+	coins, err := srv.extractRanks(bts)
 	if err != nil {
 		return nil, err
 	}
 
-	return &rc.RankResponse{List: data}, nil
+	now := time.Now()
+	srv.snapshot.update(coins, now, time.Duration(srv.maxStaleness.Load()))
+	return &rc.RankResponse{List: symbols(coins), Coins: coins, AsOf: now.UnixMilli()}, nil
+}
+
+// Keys returns the pool of the CoinMarketCap keys, each listing request spends their credits
+func (srv *Server) Keys() *requester.KeyPool {
+	return srv.keys
+}
+
+// Faults returns the fault injection of the listing requests, nil unless the requester was created with FaultsEnabled
+func (srv *Server) Faults() *chaos.Transport {
+	return srv.requester.Faults()
+}
+
+// credits returns the CoinMarketCap credits of the listing request, one per 200 currencies
+func credits(limit int) int {
+	return (limit + creditListings - 1) / creditListings
+}
+
+var cmcKeys = requester.KeyProvider{
+	Name: "coinmarketcap",
+	SetKey: func(req *http.Request, key string) {
+		req.Header.Set("X-CMC_PRO_API_KEY", key)
+	},
+	QuotaError: func(bts []byte, now time.Time) (time.Time, bool) {
+		var resp struct {
+			Status struct {
+				ErrCode int `json:"error_code"`
+			} `json:"status"`
+		}
+		if json.Unmarshal(bts, &resp) != nil {
+			return time.Time{}, false
+		}
+		// the plan's minute, daily and monthly limits
+		switch resp.Status.ErrCode {
+		case 1008:
+			return requester.PeriodEnd(now, "minute"), true
+		case 1009:
+			return requester.PeriodEnd(now, "day"), true
+		case 1010:
+			return requester.PeriodEnd(now, "month"), true
+		}
+		return time.Time{}, false
+	},
 }
 
-func (srv *Server) requestData(ctx context.Context, uri string) ([]byte, error) {
+func (srv *Server) requestData(ctx context.Context, uri string, credits int) ([]byte, error) {
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
 	if err != nil {
 		return nil, fmt.Errorf("create a request: %w", err)
 	}
-	req.Header.Add("X-CMC_PRO_API_KEY", srv.apiKey)
 
-	return srv.requester.GetData(req)
+	return srv.requester.GetDataWithKey(req, srv.keys, credits)
 }
 
-func (srv *Server) extractRanks(bts []byte) ([]string, error) {
+func (srv *Server) extractRanks(bts []byte) ([]*rc.Coin, error) {
 	type responseData struct {
 		Data []struct { // If no errors, the response will contain an array of objects
-			Symbol string `json:"symbol"`
+			ID      int64  `json:"id"`
+			Name    string `json:"name"`
+			Symbol  string `json:"symbol"`
+			CMCRank int32  `json:"cmc_rank"`
+			Quote   struct {
+				USD struct {
+					MarketCap        float64 `json:"market_cap"`
+					PercentChange24h float64 `json:"percent_change_24h"`
+				} `json:"USD"`
+			} `json:"quote"`
 		} `json:"data"`
 		Status struct { // If there is an error, the response will contain an object with error details
-			ErrCode int `json:"error_code"`
-			ErrMsg string `json:"error_message"`
+			ErrCode int    `json:"error_code"`
+			ErrMsg  string `json:"error_message"`
 		} `json:"status"`
 	}
 
@@ -82,10 +306,21 @@ func (srv *Server) extractRanks(bts []byte) ([]string, error) {
 		return nil, fmt.Errorf("request error: %v", resp.Status.ErrMsg)
 	}
 
-	data := []string{}
-	for _, each := range resp.Data {
-		data = append(data, each.Symbol)
+	coins := make([]*rc.Coin, 0, len(resp.Data))
+	for i, each := range resp.Data {
+		rank := each.CMCRank
+		if rank == 0 {
+			rank = int32(i + 1)
+		}
+		coins = append(coins, &rc.Coin{
+			Symbol:           each.Symbol,
+			Rank:             rank,
+			Name:             each.Name,
+			ID:               each.ID,
+			MarketCap:        each.Quote.USD.MarketCap,
+			PercentChange24H: each.Quote.USD.PercentChange24h,
+		})
 	}
 
-	return data, nil
+	return coins, nil
 }
@@ -0,0 +1,91 @@
+package rankcollector
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	rc "github.com/awnzl/top_currency_checker/lib/proto/rankcollector"
+	"github.com/awnzl/top_currency_checker/lib/requester/config"
+	"github.com/awnzl/top_currency_checker/lib/requester/fixtures"
+	"github.com/awnzl/top_currency_checker/lib/secrets"
+)
+
+// newTestServer returns the server replaying the exchanges recorded in testdata,
+// re-record them with request.fixtures.mode=record and a real key
+func newTestServer() *Server {
+	return New(Config{
+		APIKeys:      []secrets.Source{secrets.Literal("test-api-key")},
+		APIURL:       "https://pro-api.coinmarketcap.com/v1/cryptocurrency/listings/latest?",
+		ReqConfig:    config.Config{ReqTimeout: 1, FixturesMode: fixtures.ModeReplay, FixturesDir: "testdata"},
+		MaxStaleness: time.Minute,
+		ListingSize:  5,
+	})
+}
+
+func TestGetRanks(t *testing.T) {
+	srv := newTestServer()
+
+	resp, err := srv.GetRanks(context.Background(), &rc.RankRequest{Start: 2, Limit: 2})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"ETH", "USDT"}, resp.List)
+	assert.Equal(t, int32(2), resp.Coins[0].Rank)
+	assert.Equal(t, int64(1027), resp.Coins[0].ID)
+	assert.Equal(t, "Tether USDt", resp.Coins[1].Name)
+	assert.InDelta(t, -0.42, resp.Coins[0].PercentChange24H, 1e-9)
+	assert.False(t, resp.Stale)
+
+	// the window beyond the recorded listing has no recording, the kept listing is served
+	resp, err = srv.GetRanks(context.Background(), &rc.RankRequest{Start: 1, Limit: 10})
+	require.NoError(t, err)
+	assert.Len(t, resp.List, 5)
+	assert.True(t, resp.Stale)
+
+	_, err = srv.GetRanks(context.Background(), &rc.RankRequest{Start: 4990, Limit: 20})
+	assert.Equal(t, codes.OutOfRange, status.Code(err), err)
+
+	// one credit per 200 listings, charged for the failed request too
+	assert.Equal(t, 2, srv.Keys().UsedMonth())
+}
+
+func TestWindow(t *testing.T) {
+	var coins []*rc.Coin
+	for i := 1; i <= 10; i++ {
+		coins = append(coins, &rc.Coin{Symbol: fmt.Sprint("C", i), Rank: int32(i)})
+	}
+	listing := &rc.RankResponse{List: symbols(coins), Coins: coins}
+
+	assert.Equal(t, []string{"C2", "C3"}, window(listing, 2, 3).List)
+	assert.Equal(t, []string{"C9", "C10"}, window(listing, 9, 20).List)
+	assert.Empty(t, window(listing, 11, 20).List)
+	// the kept listing is longer than the listing size, the window without a limit ends before its start
+	assert.Empty(t, window(listing, 9, 5).List)
+	assert.Empty(t, window(listing, 9, 5).Coins)
+
+	srv := newTestServer()
+	resp, err := srv.GetRanks(context.Background(), &rc.RankRequest{Start: 8})
+	require.NoError(t, err)
+	assert.Empty(t, resp.List)
+}
+
+func TestGetCoin(t *testing.T) {
+	srv := newTestServer()
+
+	resp, err := srv.GetCoin(context.Background(), &rc.CoinRequest{ID: 5426})
+	require.NoError(t, err)
+	assert.Equal(t, "SOL", resp.Coin.Symbol)
+	assert.Equal(t, int32(5), resp.Coin.Rank)
+
+	resp, err = srv.GetCoin(context.Background(), &rc.CoinRequest{Symbol: "bnb"})
+	require.NoError(t, err)
+	assert.Equal(t, int64(1839), resp.Coin.ID)
+
+	_, err = srv.GetCoin(context.Background(), &rc.CoinRequest{Symbol: "DOGE"})
+	assert.Equal(t, codes.NotFound, status.Code(err), err)
+}
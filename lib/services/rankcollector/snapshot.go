@@ -0,0 +1,45 @@
+package rankcollector
+
+import (
+	"sync"
+	"time"
+
+	rc "github.com/awnzl/top_currency_checker/lib/proto/rankcollector"
+)
+
+// snapshot is the last good listing, it is served when the upstream fails
+type snapshot struct {
+	mu    sync.RWMutex
+	coins []*rc.Coin
+	asOf  time.Time
+}
+
+// update stores the listing unless a longer one is kept and is still usable
+func (s *snapshot) update(coins []*rc.Coin, asOf time.Time, maxStaleness time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(coins) >= len(s.coins) || time.Since(s.asOf) > maxStaleness {
+		s.coins, s.asOf = coins, asOf
+	}
+}
+
+// get returns the listing if it is not older than maxStaleness,
+// the time of a too old listing is returned too, it is zero if there is no listing
+func (s *snapshot) get(maxStaleness time.Duration) ([]*rc.Coin, time.Time, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if len(s.coins) == 0 || time.Since(s.asOf) > maxStaleness {
+		return nil, s.asOf, false
+	}
+	return s.coins, s.asOf, true
+}
+
+// fresh returns the listing of at least need currencies if it is younger than maxAge
+func (s *snapshot) fresh(need int, maxAge time.Duration) ([]*rc.Coin, time.Time, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if len(s.coins) < need || time.Since(s.asOf) >= maxAge {
+		return nil, time.Time{}, false
+	}
+	return s.coins, s.asOf, true
+}
@@ -0,0 +1,96 @@
+package rankcollector
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/awnzl/top_currency_checker/lib/apierror"
+	rc "github.com/awnzl/top_currency_checker/lib/proto/rankcollector"
+)
+
+func listing(n int) []*rc.Coin {
+	coins := make([]*rc.Coin, 0, n)
+	for i := 1; i <= n; i++ {
+		coins = append(coins, &rc.Coin{Symbol: fmt.Sprint("C", i), Rank: int32(i)})
+	}
+	return coins
+}
+
+func TestSnapshot(t *testing.T) {
+	var s snapshot
+	_, asOf, ok := s.get(time.Minute)
+	assert.False(t, ok)
+	assert.True(t, asOf.IsZero(), "no listing is kept")
+
+	now := time.Now()
+	s.update(listing(5), now.Add(-10*time.Second), time.Minute)
+	coins, asOf, ok := s.get(time.Minute)
+	require.True(t, ok)
+	assert.Len(t, coins, 5)
+	assert.Equal(t, now.Add(-10*time.Second), asOf)
+
+	// the listing older than the max staleness is not served, its time is returned
+	_, asOf, ok = s.get(5 * time.Second)
+	assert.False(t, ok)
+	assert.Equal(t, now.Add(-10*time.Second), asOf)
+
+	// the shorter listing doesn't replace the usable longer one, it replaces the too old one
+	s.update(listing(3), now, time.Minute)
+	coins, _, _ = s.get(time.Minute)
+	assert.Len(t, coins, 5)
+	s.update(listing(3), now, 5*time.Second)
+	coins, asOf, _ = s.get(time.Minute)
+	assert.Len(t, coins, 3)
+	assert.Equal(t, now, asOf)
+
+	// the fresh listing has to be long enough and younger than the max age
+	_, _, ok = s.fresh(3, time.Minute)
+	assert.True(t, ok)
+	_, _, ok = s.fresh(4, time.Minute)
+	assert.False(t, ok)
+	s.update(listing(3), now.Add(-time.Minute), time.Minute)
+	_, _, ok = s.fresh(3, time.Minute)
+	assert.False(t, ok)
+	_, _, ok = s.fresh(3, 0)
+	assert.False(t, ok, "no polling")
+}
+
+func TestStaleFallback(t *testing.T) {
+	srv := newTestServer()
+
+	// no listing is kept yet, the failure is returned
+	_, err := srv.GetRanks(context.Background(), &rc.RankRequest{Start: 1, Limit: 10})
+	code, _, _ := apierror.FromError(err)
+	assert.Equal(t, codes.Unavailable, status.Code(err), err)
+	assert.Equal(t, apierror.UpstreamUnavailable, code)
+
+	fresh, err := srv.GetRanks(context.Background(), &rc.RankRequest{Start: 1, Limit: 5})
+	require.NoError(t, err)
+	require.False(t, fresh.Stale)
+
+	// the listing beyond the recording fails, the last good one is served with its time
+	resp, err := srv.GetRanks(context.Background(), &rc.RankRequest{Start: 2, Limit: 10})
+	require.NoError(t, err)
+	assert.True(t, resp.Stale)
+	assert.Equal(t, fresh.AsOf, resp.AsOf)
+	assert.Equal(t, fresh.List[1:], resp.List)
+
+	coin, err := srv.GetCoin(context.Background(), &rc.CoinRequest{Symbol: "BTC"})
+	require.NoError(t, err)
+	assert.False(t, coin.Stale, "the retained listing is fresh")
+
+	// the listing older than the max staleness is not served
+	srv.maxStaleness.Store(int64(time.Nanosecond))
+	time.Sleep(time.Millisecond)
+	_, err = srv.GetRanks(context.Background(), &rc.RankRequest{Start: 1, Limit: 10})
+	code, _, _ = apierror.FromError(err)
+	assert.Equal(t, codes.Unavailable, status.Code(err), err)
+	assert.Equal(t, apierror.StaleData, code)
+}
@@ -0,0 +1,190 @@
+// Package tlsconfig builds the TLS configurations of the servers and the clients.
+// The certificates and the CAs are reloaded when their files change, so they can be rotated
+// without a restart; a broken rotation keeps the last good ones in use.
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// the files are checked for the changes at most once per interval, on the handshakes
+var checkInterval = time.Second
+
+// Files are the PEM files of a TLS peer, all are optional for a client
+type Files struct {
+	CertFile string
+	KeyFile  string
+	// CAFile verifies the peer: the client certificates on a server, which enables mTLS,
+	// and the server certificate on a client instead of the system roots
+	CAFile string
+}
+
+// Server returns the server configuration, the client certificates are required and verified if the CA is set
+func Server(files Files, logf func(format string, args ...any)) (*tls.Config, error) {
+	if files.CertFile == "" || files.KeyFile == "" {
+		return nil, errors.New("server certificate and key are required")
+	}
+	r := &reloader{files: files, logf: logf}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+
+	conf := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			cert, _ := r.current()
+			return cert, nil
+		},
+	}
+	if files.CAFile != "" {
+		// ClientCAs can't be changed after the start, so the chain is verified with the current CAs
+		conf.ClientAuth = tls.RequireAnyClientCert
+		conf.VerifyConnection = func(cs tls.ConnectionState) error {
+			_, pool := r.current()
+			return verify(cs, pool, "", x509.ExtKeyUsageClientAuth)
+		}
+	}
+	return conf, nil
+}
+
+// Client returns the client configuration, the certificate is sent if it is set (mTLS).
+// serverName is the name verified in the server certificate, by default it is the dialed host name;
+// it is required to dial an IP address with the CA set, the dialed address is not known to the verification.
+func Client(files Files, serverName string, logf func(format string, args ...any)) (*tls.Config, error) {
+	if (files.CertFile == "") != (files.KeyFile == "") {
+		return nil, errors.New("client certificate and key must be set together")
+	}
+	r := &reloader{files: files, logf: logf}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+
+	conf := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: serverName,
+	}
+	if files.CertFile != "" {
+		conf.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, _ := r.current()
+			return cert, nil
+		}
+	}
+	if files.CAFile != "" {
+		// RootCAs can't be changed after the start, so the default verification is skipped
+		// and the chain is verified with the current CAs
+		conf.InsecureSkipVerify = true
+		conf.VerifyConnection = func(cs tls.ConnectionState) error {
+			// the name sent in SNI, it is empty for the IP addresses
+			name := serverName
+			if name == "" {
+				name = cs.ServerName
+			}
+			if name == "" {
+				return errors.New("tls: no server name to verify, set it to dial an IP address")
+			}
+			_, pool := r.current()
+			return verify(cs, pool, name, x509.ExtKeyUsageServerAuth)
+		}
+	}
+	return conf, nil
+}
+
+// verify does the same verification of the peer chain as the default one
+func verify(cs tls.ConnectionState, pool *x509.CertPool, dnsName string, usage x509.ExtKeyUsage) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("tls: no peer certificate")
+	}
+	opts := x509.VerifyOptions{
+		Roots:         pool,
+		DNSName:       dnsName,
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{usage},
+	}
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := cs.PeerCertificates[0].Verify(opts)
+	return err
+}
+
+// reloader keeps the certificate and the CA pool loaded from the files
+type reloader struct {
+	files Files
+	logf  func(format string, args ...any)
+
+	mu       sync.Mutex
+	checked  time.Time
+	modTimes [3]time.Time
+	cert     *tls.Certificate
+	pool     *x509.CertPool
+}
+
+// current returns the certificate and the pool, reloading them if the files changed
+func (r *reloader) current() (*tls.Certificate, *x509.CertPool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if time.Since(r.checked) >= checkInterval {
+		r.checked = time.Now()
+		if modTimes := r.stat(); modTimes != r.modTimes {
+			if err := r.loadLocked(modTimes); err != nil {
+				r.logf("TLS files changed, keeping the current ones: %v", err)
+			} else {
+				r.logf("TLS files reloaded: %s %s %s", r.files.CertFile, r.files.KeyFile, r.files.CAFile)
+			}
+		}
+	}
+	return r.cert, r.pool
+}
+
+func (r *reloader) load() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.checked = time.Now()
+	return r.loadLocked(r.stat())
+}
+
+func (r *reloader) loadLocked(modTimes [3]time.Time) error {
+	var cert *tls.Certificate
+	if r.files.CertFile != "" {
+		c, err := tls.LoadX509KeyPair(r.files.CertFile, r.files.KeyFile)
+		if err != nil {
+			return fmt.Errorf("load certificate: %w", err)
+		}
+		cert = &c
+	}
+
+	var pool *x509.CertPool
+	if r.files.CAFile != "" {
+		pem, err := os.ReadFile(r.files.CAFile)
+		if err != nil {
+			return fmt.Errorf("read CA: %w", err)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates in CA file %s", r.files.CAFile)
+		}
+	}
+
+	r.cert, r.pool, r.modTimes = cert, pool, modTimes
+	return nil
+}
+
+// stat returns the modification times of the files, zero for the unset or missing ones
+func (r *reloader) stat() [3]time.Time {
+	var modTimes [3]time.Time
+	for i, name := range []string{r.files.CertFile, r.files.KeyFile, r.files.CAFile} {
+		if name == "" {
+			continue
+		}
+		if info, err := os.Stat(name); err == nil {
+			modTimes[i] = info.ModTime()
+		}
+	}
+	return modTimes
+}
@@ -0,0 +1,217 @@
+package tlsconfig
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type issuer struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// issue writes the certificate of the hosts, localhost and 127.0.0.1 by default,
+// signed by the issuer (self-signed CA if it is nil) and its key
+func issue(t *testing.T, ca *issuer, name string, serial int64, certFile, keyFile string, hosts ...string) *issuer {
+	t.Helper()
+	if len(hosts) == 0 {
+		hosts = []string{"localhost", "127.0.0.1"}
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, host)
+		}
+	}
+	parent, signer := tmpl, key
+	if ca == nil {
+		tmpl.IsCA, tmpl.BasicConstraintsValid = true, true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		parent, signer = ca.cert, ca.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, signer)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	if keyFile != "" {
+		keyDER, err := x509.MarshalECPrivateKey(key)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+	}
+	return &issuer{cert: cert, key: key}
+}
+
+// testServer is the mTLS server of a CA, with the server certificate 2 and the client certificate 3
+type testServer struct {
+	dir      string
+	ca       *issuer
+	listener net.Listener
+	// serials receives the serial numbers of the accepted client certificates
+	serials chan int64
+}
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+	old := checkInterval
+	checkInterval = 0
+	t.Cleanup(func() { checkInterval = old })
+
+	s := &testServer{dir: t.TempDir(), serials: make(chan int64, 10)}
+	s.ca = issue(t, nil, "ca", 1, s.path("ca.pem"), "")
+	issue(t, s.ca, "server", 2, s.path("server.pem"), s.path("server.key"))
+	issue(t, s.ca, "client", 3, s.path("client.pem"), s.path("client.key"))
+
+	serverConf, err := Server(Files{CertFile: s.path("server.pem"), KeyFile: s.path("server.key"), CAFile: s.path("ca.pem")}, noop)
+	require.NoError(t, err)
+	s.listener, err = tls.Listen("tcp", "127.0.0.1:0", serverConf)
+	require.NoError(t, err)
+	t.Cleanup(func() { s.listener.Close() })
+
+	go func() {
+		for {
+			conn, err := s.listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				tc := conn.(*tls.Conn)
+				if tc.Handshake() == nil {
+					select {
+					case s.serials <- tc.ConnectionState().PeerCertificates[0].SerialNumber.Int64():
+					default:
+					}
+					io.WriteString(conn, "ok")
+				}
+			}()
+		}
+	}()
+	return s
+}
+
+func noop(string, ...any) {}
+
+func (s *testServer) path(name string) string { return filepath.Join(s.dir, name) }
+
+// clientFiles are the files of the client certificate issued by the server's CA
+func (s *testServer) clientFiles() Files {
+	return Files{CertFile: s.path("client.pem"), KeyFile: s.path("client.key"), CAFile: s.path("ca.pem")}
+}
+
+// dialByName returns the serial number of the server certificate verified for the server name
+func (s *testServer) dialByName(files Files, serverName string) (int64, error) {
+	conf, err := Client(files, serverName, noop)
+	if err != nil {
+		return 0, err
+	}
+	conn, err := tls.Dial("tcp", s.listener.Addr().String(), conf)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	// the server rejects a missing client certificate after the client's handshake is done
+	if _, err := io.ReadAll(conn); err != nil {
+		return 0, err
+	}
+	return conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64(), nil
+}
+
+func (s *testServer) dial(files Files) (int64, error) {
+	return s.dialByName(files, "127.0.0.1")
+}
+
+func TestMutualTLS(t *testing.T) {
+	t.Run("mTLS accepted", func(t *testing.T) {
+		s := newTestServer(t)
+		serial, err := s.dial(s.clientFiles())
+		require.NoError(t, err)
+		assert.Equal(t, int64(2), serial)
+		assert.Equal(t, int64(3), <-s.serials)
+	})
+
+	t.Run("missing client certificate", func(t *testing.T) {
+		s := newTestServer(t)
+		_, err := s.dial(Files{CAFile: s.path("ca.pem")})
+		assert.Error(t, err, "the client certificate is required")
+	})
+
+	t.Run("rotation", func(t *testing.T) {
+		// the rotated server certificate is used without a restart
+		s := newTestServer(t)
+		issue(t, s.ca, "server", 4, s.path("server.pem"), s.path("server.key"))
+		serial, err := s.dial(s.clientFiles())
+		require.NoError(t, err)
+		assert.Equal(t, int64(4), serial)
+
+		// the certificate of another host is rejected
+		issue(t, s.ca, "server", 7, s.path("server.pem"), s.path("server.key"), "collector.example.com", "10.0.0.1")
+		_, err = s.dial(s.clientFiles())
+		assert.ErrorContains(t, err, "127.0.0.1")
+		_, err = s.dialByName(s.clientFiles(), "localhost")
+		assert.Error(t, err)
+		serial, err = s.dialByName(s.clientFiles(), "collector.example.com")
+		require.NoError(t, err)
+		assert.Equal(t, int64(7), serial)
+	})
+
+	t.Run("wrong CA", func(t *testing.T) {
+		// the client from another CA is rejected, and so is the server by a client trusting another CA
+		s := newTestServer(t)
+		other := issue(t, nil, "other ca", 5, s.path("other-ca.pem"), "")
+		issue(t, other, "client", 6, s.path("other.pem"), s.path("other.key"))
+		_, err := s.dial(Files{CertFile: s.path("other.pem"), KeyFile: s.path("other.key"), CAFile: s.path("ca.pem")})
+		assert.Error(t, err)
+		_, err = s.dial(Files{CertFile: s.path("client.pem"), KeyFile: s.path("client.key"), CAFile: s.path("other-ca.pem")})
+		assert.Error(t, err)
+	})
+
+	t.Run("IP without a server name", func(t *testing.T) {
+		// the server is dialed by IP, which is not sent in SNI, so the name to verify must be set
+		s := newTestServer(t)
+		_, err := s.dialByName(s.clientFiles(), "")
+		assert.ErrorContains(t, err, "no server name")
+		serial, err := s.dialByName(s.clientFiles(), "localhost")
+		require.NoError(t, err)
+		assert.Equal(t, int64(2), serial)
+	})
+
+	t.Run("broken rotation", func(t *testing.T) {
+		// a broken rotation keeps the last good certificate
+		s := newTestServer(t)
+		_, err := s.dial(s.clientFiles())
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(s.path("server.pem"), []byte("garbage"), 0o600))
+		serial, err := s.dial(s.clientFiles())
+		require.NoError(t, err)
+		assert.Equal(t, int64(2), serial)
+	})
+}
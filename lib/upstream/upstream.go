@@ -0,0 +1,8 @@
+// Package upstream has the errors of the provider requests. It is shared by the requester returning
+// them and the packages classifying them, so those don't depend on the requester.
+package upstream
+
+import "errors"
+
+// RateLimitError is returned when the provider rate limits the requests
+var RateLimitError = errors.New("rate limit exceeded")